@@ -0,0 +1,265 @@
+package amqp
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// AckBatchConfig configures batching of acks (see ConsumeConfig.AckBatch).
+//
+// Acks of consecutive deliveries are accumulated and sent as a single cumulative ack (basic.ack with multiple flag),
+// when MaxCount deliveries are waiting for ack or MaxDelay elapsed since the first of them, whichever comes first.
+// Delivery is acked cumulatively only when all deliveries received before it were already acked or nacked,
+// so messages which are still processed are never acked by accident. Nacks are sent immediately.
+//
+// Batching increases throughput, but acked messages may be redelivered, when the subscriber crashes
+// or the connection is lost before the batch is flushed.
+//
+// Cumulative ack would ack also deliveries released without ack or nack (see ContextDoneRelease),
+// so after the first released delivery, acks on the channel are sent one by one.
+type AckBatchConfig struct {
+	// MaxCount is the number of deliveries waiting for ack, which triggers flush of the batch.
+	// When zero, batch is flushed only after MaxDelay.
+	MaxCount int
+
+	// MaxDelay is the maximum time the ack is delayed. It's required when batching is enabled.
+	MaxDelay time.Duration
+}
+
+func (c AckBatchConfig) enabled() bool {
+	return c.MaxCount > 0 || c.MaxDelay > 0
+}
+
+type batchedDeliveryState int
+
+const (
+	deliveryInFlight batchedDeliveryState = iota
+	// deliveryReady is acked by the subscriber, but the ack was not sent yet
+	deliveryReady
+	// deliverySettled was nacked or rejected
+	deliverySettled
+)
+
+type batchedDelivery struct {
+	tag   uint64
+	state batchedDeliveryState
+}
+
+// ackBatcher is amqp.Acknowledger, which delays acks of the deliveries from the single channel
+// and sends them as cumulative acks. Nacks and rejects are sent immediately.
+type ackBatcher struct {
+	config       AckBatchConfig
+	acknowledger amqp.Acknowledger
+	onFlushError func(err error)
+
+	// deliveries are ordered by the delivery tag, which is increasing on the channel
+	deliveries []batchedDelivery
+	ready      int
+	timer      *time.Timer
+	closed     bool
+	// released is true after a delivery was released, acks are not batched anymore
+	released bool
+	lock     sync.Mutex
+}
+
+func newAckBatcher(config AckBatchConfig, acknowledger amqp.Acknowledger, onFlushError func(err error)) *ackBatcher {
+	return &ackBatcher{
+		config:       config,
+		acknowledger: acknowledger,
+		onFlushError: onFlushError,
+	}
+}
+
+// received registers the delivery, it must be called in the order of delivery, before the delivery is acked.
+func (b *ackBatcher) received(delivery *amqp.Delivery) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.released {
+		return
+	}
+
+	b.deliveries = append(b.deliveries, batchedDelivery{tag: delivery.DeliveryTag})
+	delivery.Acknowledger = b
+}
+
+func (b *ackBatcher) Ack(tag uint64, multiple bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if multiple || b.closed || b.released {
+		return b.acknowledger.Ack(tag, multiple)
+	}
+
+	if !b.setState(tag, deliveryReady) {
+		return errors.Errorf("delivery %d not received by the ack batcher", tag)
+	}
+	b.ready++
+
+	if b.config.MaxCount > 0 && b.ready >= b.config.MaxCount {
+		return b.flush()
+	}
+	if b.timer == nil && b.config.MaxDelay > 0 {
+		b.timer = time.AfterFunc(b.config.MaxDelay, b.flushAfterDelay)
+	}
+
+	return nil
+}
+
+func (b *ackBatcher) Nack(tag uint64, multiple bool, requeue bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := b.acknowledger.Nack(tag, multiple, requeue); err != nil {
+		return err
+	}
+	b.setState(tag, deliverySettled)
+
+	return nil
+}
+
+func (b *ackBatcher) Reject(tag uint64, requeue bool) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if err := b.acknowledger.Reject(tag, requeue); err != nil {
+		return err
+	}
+	b.setState(tag, deliverySettled)
+
+	return nil
+}
+
+// release marks the delivery, which will be neither acked nor nacked (it's redelivered when the channel is closed).
+//
+// Acks, which can be sent cumulatively without acking the released delivery, are flushed,
+// the rest of acks (also of deliveries still in flight) are sent one by one.
+func (b *ackBatcher) release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.closed || b.released {
+		return
+	}
+
+	// the released delivery is still in flight, so the cumulative ack doesn't cover it
+	err := b.flush()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.released = true
+
+	if err == nil {
+		err = b.ackReadyOneByOne()
+	}
+	b.deliveries = nil
+	b.ready = 0
+
+	if err != nil {
+		b.onFlushError(err)
+	}
+}
+
+// setState sets the state of the delivery, it returns false when the delivery was not received.
+func (b *ackBatcher) setState(tag uint64, state batchedDeliveryState) bool {
+	i := sort.Search(len(b.deliveries), func(i int) bool {
+		return b.deliveries[i].tag >= tag
+	})
+	if i == len(b.deliveries) || b.deliveries[i].tag != tag {
+		return false
+	}
+
+	b.deliveries[i].state = state
+	return true
+}
+
+func (b *ackBatcher) flushAfterDelay() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.timer = nil
+	if b.closed {
+		return
+	}
+
+	if err := b.flush(); err != nil {
+		b.onFlushError(err)
+	}
+}
+
+// flush sends the cumulative ack of the last ready delivery, before which there are no deliveries in flight.
+func (b *ackBatcher) flush() error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	lastReady := -1
+	resolved := 0
+	for ; resolved < len(b.deliveries) && b.deliveries[resolved].state != deliveryInFlight; resolved++ {
+		if b.deliveries[resolved].state == deliveryReady {
+			lastReady = resolved
+		}
+	}
+
+	if lastReady >= 0 {
+		if err := b.acknowledger.Ack(b.deliveries[lastReady].tag, true); err != nil {
+			return errors.Wrap(err, "cannot send cumulative ack")
+		}
+		for _, delivery := range b.deliveries[:lastReady+1] {
+			if delivery.state == deliveryReady {
+				b.ready--
+			}
+		}
+	}
+	b.deliveries = append(b.deliveries[:0], b.deliveries[resolved:]...)
+
+	if b.ready > 0 && b.config.MaxDelay > 0 {
+		// remaining deliveries are waiting for deliveries in flight
+		b.timer = time.AfterFunc(b.config.MaxDelay, b.flushAfterDelay)
+	}
+
+	return nil
+}
+
+// close flushes the batch, acks of deliveries which are still waiting for deliveries in flight are sent separately.
+// After close, acks are sent immediately.
+func (b *ackBatcher) close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+
+	err := b.flush()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = b.ackReadyOneByOne()
+	b.deliveries = nil
+	b.ready = 0
+
+	return err
+}
+
+// ackReadyOneByOne sends acks of deliveries, which are waiting for deliveries in flight, without multiple flag.
+func (b *ackBatcher) ackReadyOneByOne() error {
+	for _, delivery := range b.deliveries {
+		if delivery.state == deliveryReady {
+			if err := b.acknowledger.Ack(delivery.tag, false); err != nil {
+				return errors.Wrap(err, "cannot send ack")
+			}
+		}
+	}
+
+	return nil
+}
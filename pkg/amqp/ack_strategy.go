@@ -0,0 +1,42 @@
+package amqp
+
+import (
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/streadway/amqp"
+)
+
+// AckOutcome is the decision made by AckStrategy about the delivery.
+type AckOutcome int
+
+const (
+	// AckOutcomeAck acks the delivery.
+	AckOutcomeAck AckOutcome = iota
+	// AckOutcomeNack nacks the delivery, according to Config.Consume (NoRequeueOnNack, Requeue).
+	AckOutcomeNack
+)
+
+// AckStrategy decides if the delivery of the message sent to the subscriber should be acked or nacked.
+//
+// Outcome is called in a separate goroutine for every message and it should block until the outcome is known.
+// closing is closed when the Subscriber is closing or the subscription is cancelled.
+//
+// Custom AckStrategy can be used, for example, to ack the delivery only after downstream commit.
+// Default AckStrategy is DefaultAckStrategy.
+type AckStrategy interface {
+	Outcome(delivery amqp.Delivery, msg *message.Message, closing <-chan struct{}) AckOutcome
+}
+
+// DefaultAckStrategy acks the delivery when the message is acked.
+// When message is nacked or the subscription is closing before ack, the delivery is nacked.
+type DefaultAckStrategy struct{}
+
+func (DefaultAckStrategy) Outcome(delivery amqp.Delivery, msg *message.Message, closing <-chan struct{}) AckOutcome {
+	select {
+	case <-closing:
+		return AckOutcomeNack
+	case <-msg.Acked():
+		return AckOutcomeAck
+	case <-msg.Nacked():
+		return AckOutcomeNack
+	}
+}
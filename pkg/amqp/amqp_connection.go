@@ -0,0 +1,91 @@
+package amqp
+
+import (
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// AMQPConnection is the connection to the AMQP broker used by Publisher and Subscriber.
+//
+// By default, the connection is dialed with github.com/streadway/amqp. Other implementations,
+// like the in-memory broker from the memamqp package, can be provided with ConnectionConfig.Dial.
+type AMQPConnection interface {
+	Channel() (AMQPChannel, error)
+
+	// ServerProperties returns properties sent by the broker when the connection was opened.
+	ServerProperties() amqp.Table
+
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking
+
+	IsClosed() bool
+	Close() error
+}
+
+// AMQPChannel is the channel opened by AMQPConnection.
+// It's the subset of *amqp.Channel methods used by Publisher and Subscriber, so *amqp.Channel implements it.
+type AMQPChannel interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Confirm(noWait bool) error
+
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	NotifyFlow(c chan bool) chan bool
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueueUnbind(name, key, exchange string, args amqp.Table) error
+	QueuePurge(name string, noWait bool) (int, error)
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Get(queue string, autoAck bool) (msg amqp.Delivery, ok bool, err error)
+
+	Tx() error
+	TxCommit() error
+	TxRollback() error
+
+	// Acknowledger acknowledges deliveries consumed by Consume and Get.
+	amqp.Acknowledger
+
+	Close() error
+}
+
+var _ AMQPChannel = (*amqp.Channel)(nil)
+
+// streadwayConnection adapts *amqp.Connection to AMQPConnection.
+type streadwayConnection struct {
+	*amqp.Connection
+}
+
+func (c streadwayConnection) Channel() (AMQPChannel, error) {
+	channel, err := c.Connection.Channel()
+	if err != nil {
+		// returning nil interface instead of typed nil *amqp.Channel
+		return nil, err
+	}
+
+	return channel, nil
+}
+
+func (c streadwayConnection) ServerProperties() amqp.Table {
+	return c.Properties
+}
+
+// ErrNotStreadwayConnection is returned by StreadwayConnection, when the connection was returned
+// by ConnectionConfig.Dial and it's not dialed with github.com/streadway/amqp.
+var ErrNotStreadwayConnection = errors.New("connection is not dialed with github.com/streadway/amqp")
+
+// StreadwayConnection returns the *amqp.Connection underlying the connection (like the one returned
+// by Publisher.Connection or Subscriber.Connection), for code which requires the concrete type.
+func StreadwayConnection(connection AMQPConnection) (*amqp.Connection, error) {
+	if c, ok := connection.(streadwayConnection); ok {
+		return c.Connection, nil
+	}
+
+	return nil, ErrNotStreadwayConnection
+}
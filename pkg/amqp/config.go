@@ -1,9 +1,14 @@
 package amqp
 
 import (
+	"context"
 	"crypto/tls"
+	"net/url"
+	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/ThreeDotsLabs/watermill/message"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/streadway/amqp"
 
@@ -197,11 +202,47 @@ func NewNonDurableQueueConfig(amqpURI string) Config {
 	}
 }
 
+// NewDurableTopicExchangeConfig creates config for routing by the topic exchange.
+// All topics are published to the single durable topic exchange with exchangeName,
+// and the topic is used as the routing key.
+//
+// Subscribed topic is used as the binding key, so it can be a pattern, like "orders.#" or "orders.*.created".
+// The queue name is generated from the subscribed topic (pattern) by generateQueueName, so it's stable
+// and one queue receives messages with all matching routing keys. Wildcards are not allowed in queue names,
+// GenerateQueueNameTopicPatternWithSuffix can be used to replace them. For example, with
+// GenerateQueueNameTopicPatternWithSuffix("billing"), Subscribe("orders.#") consumes from the
+// "orders.hash_billing" queue messages published with Publish("orders.created") and Publish("orders.eu.paid").
+func NewDurableTopicExchangeConfig(amqpURI string, exchangeName string, generateQueueName QueueNameGenerator) Config {
+	config := NewDurablePubSubConfig(amqpURI, generateQueueName)
+
+	config.Exchange.GenerateName = func(topic string) string {
+		return exchangeName
+	}
+	config.Exchange.Type = "topic"
+	// used as the publish routing key and as the binding key
+	config.Exchange.GenerateRoutingKey = func(topic string) string {
+		return topic
+	}
+
+	return config
+}
+
 type Config struct {
 	Connection ConnectionConfig
 
 	Marshaler Marshaler
 
+	// PublishMarshaler and ConsumeMarshaler override Marshaler for publishing and for consuming.
+	// It allows format migrations with one config, for example consuming messages in the old format
+	// while publishing in the new one. When nil, Marshaler is used.
+	PublishMarshaler Marshaler
+	ConsumeMarshaler Marshaler
+
+	// MarshalerFunc returns Marshaler for the topic.
+	// It allows to handle topics with different serialization formats with one Publisher or Subscriber.
+	// When nil or when it returns nil, PublishMarshaler or ConsumeMarshaler is used (or Marshaler when they are nil).
+	MarshalerFunc func(topic string) Marshaler
+
 	Exchange  ExchangeConfig
 	Queue     QueueConfig
 	QueueBind QueueBindConfig
@@ -212,70 +253,507 @@ type Config struct {
 	TopologyBuilder TopologyBuilder
 }
 
+// validateConnection validates config of the connection dialed by the Publisher or Subscriber.
+func (c Config) validateConnection() error {
+	if c.Connection.AmqpURI == "" && len(c.Connection.URIs) == 0 {
+		return errors.New("empty Config.AmqpURI")
+	}
+
+	return nil
+}
+
 func (c Config) validate() error {
 	var err error
 
-	if c.Connection.AmqpURI == "" {
-		err = multierror.Append(err, errors.New("empty Config.AmqpURI"))
-	}
-	if c.Marshaler == nil {
-		err = multierror.Append(err, errors.New("missing Config.Marshaler"))
-	}
 	if c.Exchange.GenerateName == nil {
 		err = multierror.Append(err, errors.New("missing Config.GenerateName"))
 	}
+	if typeErr := validateExchangeType(c.Exchange.Type); typeErr != nil {
+		err = multierror.Append(err, typeErr)
+	}
 
 	return err
 }
 
 func (c Config) ValidatePublisher() error {
+	return appendErrors(c.validateConnection(), c.validatePublisher())
+}
+
+// validatePublisher validates the publisher config without the connection config.
+func (c Config) validatePublisher() error {
 	err := c.validate()
 
-	if c.Publish.GenerateRoutingKey == nil {
+	if c.Marshaler == nil && c.PublishMarshaler == nil && c.MarshalerFunc == nil {
+		err = multierror.Append(err, errors.New("missing Config.Marshaler or Config.PublishMarshaler"))
+	}
+	// without GenerateRoutingKey, the queue name is used as the routing key for the default exchange
+	if c.Publish.GenerateRoutingKey == nil && c.Exchange.GenerateRoutingKey == nil && c.Queue.GenerateName == nil {
 		err = multierror.Append(err, errors.New("missing Config.GenerateRoutingKey"))
 	}
+	if c.Publish.ReturnFallbackTopic != "" && !c.Publish.Mandatory {
+		err = multierror.Append(err, errors.New("Config.Publish.ReturnFallbackTopic requires Config.Publish.Mandatory"))
+	}
+	if mode := c.Publish.DefaultDeliveryMode; mode != 0 && mode != amqp.Transient && mode != amqp.Persistent {
+		err = multierror.Append(err, errors.Errorf(
+			"invalid Config.Publish.DefaultDeliveryMode %d, it must be amqp.Transient or amqp.Persistent", mode,
+		))
+	}
+	if c.Publish.OnConfirmNack != nil && !c.Publish.ConfirmDelivery {
+		err = multierror.Append(err, errors.New("Config.Publish.OnConfirmNack requires Config.Publish.ConfirmDelivery"))
+	}
+	if c.Publish.ConfirmDelivery && c.Publish.Transactional {
+		err = multierror.Append(err, errors.New("Config.Publish.ConfirmDelivery cannot be used with Config.Publish.Transactional"))
+	}
 
 	return err
 }
 
 func (c Config) ValidateSubscriber() error {
+	return appendErrors(c.validateConnection(), c.validateSubscriber())
+}
+
+// validateSubscriber validates the subscriber config without the connection config.
+func (c Config) validateSubscriber() error {
 	err := c.validate()
 
+	if c.Marshaler == nil && c.ConsumeMarshaler == nil && c.MarshalerFunc == nil {
+		err = multierror.Append(err, errors.New("missing Config.Marshaler or Config.ConsumeMarshaler"))
+	}
 	if c.Queue.GenerateName == nil {
 		err = multierror.Append(err, errors.New("missing Config.Queue.GenerateName"))
 	}
+	if c.Queue.Overflow != "" && !c.Queue.Overflow.valid() {
+		err = multierror.Append(err, errors.Errorf(
+			"invalid Config.Queue.Overflow %q, allowed values are %q, %q and %q",
+			c.Queue.Overflow, QueueOverflowDropHead, QueueOverflowRejectPublish, QueueOverflowRejectPublishDLX,
+		))
+	}
+	if c.Consume.ReuseTopologyChannel && c.TopologyNoWait() {
+		err = multierror.Append(err, errors.New("Config.Consume.ReuseTopologyChannel cannot be used with NoWait declarations"))
+	}
+	if c.Consume.RepublishTimeout < 0 {
+		err = multierror.Append(err, errors.New("Config.Consume.RepublishTimeout cannot be negative"))
+	}
+	if c.Consume.SyncAck && c.Consume.AckBatch.enabled() {
+		err = multierror.Append(err, errors.New("Config.Consume.SyncAck cannot be used with Config.Consume.AckBatch"))
+	}
+	if c.Consume.Qos.PrefetchSize < 0 {
+		err = multierror.Append(err, errors.New("Config.Consume.Qos.PrefetchSize cannot be negative"))
+	}
+	if c.Consume.Qos.Distribution == QosDividedAmongConsumers && c.Consume.Qos.PrefetchCount <= 0 {
+		err = multierror.Append(err, errors.New(
+			"Config.Consume.Qos.PrefetchCount is required to divide it among consumers",
+		))
+	}
+	if c.Consume.AckBatch.enabled() && c.Consume.AckBatch.MaxDelay <= 0 {
+		err = multierror.Append(err, errors.New("Config.Consume.AckBatch.MaxDelay is required to flush acks batch"))
+	}
+	if c.Consume.Retry.enabled() && c.Consume.Requeue.enabled() {
+		err = multierror.Append(err, errors.New("Config.Consume.Retry cannot be used with Config.Consume.Requeue"))
+	}
+	if c.Consume.Retry.enabled() && c.Consume.NoRequeueOnNack {
+		err = multierror.Append(err, errors.New("Config.Consume.Retry cannot be used with Config.Consume.NoRequeueOnNack"))
+	}
+	if c.Consume.Retry.PriorityBump > 0 {
+		if _, ok := queueMaxPriority(queueArguments(c)); !ok {
+			err = multierror.Append(err, errors.New(
+				"Config.Consume.Retry.PriorityBump requires valid x-max-priority argument of the queue",
+			))
+		}
+	}
+	if c.Queue.ServerNamed && c.Consume.Requeue.enabled() && c.Consume.Requeue.GenerateDelayQueueName == nil {
+		// server generated names start with "amq.", which is reserved prefix
+		err = multierror.Append(err, errors.New(
+			"missing Config.Consume.Requeue.GenerateDelayQueueName, it's required for server named queues",
+		))
+	}
 
 	return err
 }
 
+// topicRoutingKeyConfig returns config, in which QueueBind.GenerateRoutingKey and Publish.GenerateRoutingKey
+// return the routing key generated for the topic by Exchange.GenerateRoutingKey.
+// When Exchange.GenerateRoutingKey is nil or the topic is mapped to the default exchange,
+// config is returned unchanged.
+func (c Config) topicRoutingKeyConfig(topic string) Config {
+	if c.Exchange.GenerateRoutingKey == nil {
+		return c
+	}
+	if c.Exchange.GenerateName == nil || c.Exchange.GenerateName(topic) == "" {
+		return c
+	}
+
+	routingKey := c.Exchange.GenerateRoutingKey(topic)
+	generateRoutingKey := func(string) string {
+		return routingKey
+	}
+
+	c.QueueBind.GenerateRoutingKey = generateRoutingKey
+	c.Publish.GenerateRoutingKey = generateRoutingKey
+
+	return c
+}
+
+// appendErrors returns multierror with all not nil errs, or nil when all errs are nil.
+func appendErrors(errs ...error) error {
+	var result error
+
+	for _, err := range errs {
+		if err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+
+	return result
+}
+
+// publishMarshaler returns Marshaler used to publish messages to the topic.
+func (c Config) publishMarshaler(topic string) Marshaler {
+	return c.marshaler(topic, c.PublishMarshaler)
+}
+
+// consumeMarshaler returns Marshaler used to consume messages from the topic.
+func (c Config) consumeMarshaler(topic string) Marshaler {
+	return c.marshaler(topic, c.ConsumeMarshaler)
+}
+
+func (c Config) marshaler(topic string, roleMarshaler Marshaler) Marshaler {
+	if c.MarshalerFunc != nil {
+		if marshaler := c.MarshalerFunc(topic); marshaler != nil {
+			return marshaler
+		}
+	}
+	if roleMarshaler != nil {
+		return roleMarshaler
+	}
+
+	return c.Marshaler
+}
+
+// ValidateTopology checks if exchange, queue and binding configuration is internally consistent,
+// without connecting to the broker.
+//
+// It detects configurations which would be rejected by RabbitMQ (or silently ignored) when the topology
+// is declared by DefaultTopologyBuilder, for example quorum queue declared as exclusive.
+// It can be called in CI or at startup as a config guard.
+func (c Config) ValidateTopology() error {
+	var err error
+
+	for i, binding := range c.QueueBind.ExtraBindings {
+		if binding.Exchange == "" {
+			err = multierror.Append(err, errors.Errorf(
+				"Config.QueueBind.ExtraBindings[%d]: queue cannot be bound to the default exchange", i,
+			))
+		}
+		if binding.ExchangeType == "" {
+			continue
+		}
+		if typeErr := validateExchangeType(binding.ExchangeType); typeErr != nil {
+			err = multierror.Append(err, errors.Wrapf(typeErr, "Config.QueueBind.ExtraBindings[%d]", i))
+		}
+	}
+
+	switch c.Exchange.Type {
+	case "", "direct", "fanout", "topic":
+	case "headers":
+		if len(c.QueueBind.Arguments) == 0 {
+			err = multierror.Append(err, errors.New(
+				"headers exchange routes by Config.QueueBind.Arguments, but they are empty",
+			))
+		}
+	case ConsistentHashExchangeType:
+		if c.Exchange.GenerateRoutingKey != nil {
+			err = multierror.Append(err, errors.New(
+				"Config.Exchange.GenerateRoutingKey cannot be used with consistent-hash exchange, binding keys are weights",
+			))
+		}
+	case DeduplicationExchangeType:
+		if _, ok := exchangeArguments(c)["x-cache-size"]; !ok {
+			err = multierror.Append(err, errors.New(
+				"deduplication exchange requires Config.Exchange.DeduplicationCacheSize",
+			))
+		}
+	default:
+		if typeErr := validateExchangeType(c.Exchange.Type); typeErr != nil {
+			err = multierror.Append(err, typeErr)
+		}
+	}
+
+	arguments := queueArguments(c)
+
+	queueType := "classic"
+	if value, ok := arguments["x-queue-type"]; ok {
+		typedValue, isString := value.(string)
+		if isString {
+			queueType = typedValue
+		} else {
+			// queue type is validated as classic, so the invalid value isn't reported twice
+			err = multierror.Append(err, errors.Errorf("x-queue-type argument must be a string, got %T", value))
+		}
+	}
+
+	switch queueType {
+	case "classic":
+	case "quorum", "stream":
+		if !c.Queue.Durable {
+			err = multierror.Append(err, errors.Errorf("%s queue must be durable", queueType))
+		}
+		if c.Queue.AutoDelete {
+			err = multierror.Append(err, errors.Errorf("%s queue cannot be auto-deleted", queueType))
+		}
+		if c.Queue.Exclusive {
+			err = multierror.Append(err, errors.Errorf("%s queue cannot be exclusive", queueType))
+		}
+		if c.Queue.ServerNamed {
+			err = multierror.Append(err, errors.Errorf(
+				"%s queue cannot be server named, server named queues are exclusive", queueType,
+			))
+		}
+		if queueType == "stream" && c.Consume.Qos.PrefetchCount <= 0 {
+			err = multierror.Append(err, errors.New("consuming from stream queue requires Config.Consume.Qos.PrefetchCount"))
+		}
+	default:
+		err = multierror.Append(err, errors.Errorf("unknown x-queue-type %q", queueType))
+	}
+
+	if _, ok := arguments["x-queue-mode"]; ok && queueType != "classic" {
+		err = multierror.Append(err, errors.Errorf("x-queue-mode argument is not supported by %s queue", queueType))
+	}
+
+	if _, ok := arguments["x-dead-letter-routing-key"]; ok {
+		if _, ok := arguments["x-dead-letter-exchange"]; !ok {
+			err = multierror.Append(err, errors.New("x-dead-letter-routing-key is set without x-dead-letter-exchange"))
+		}
+	}
+
+	if c.Queue.ConsumerTimeout < 0 {
+		err = multierror.Append(err, errors.New("Config.Queue.ConsumerTimeout cannot be negative"))
+	}
+
+	if c.Queue.MaxLength < 0 || c.Queue.MaxLengthBytes < 0 {
+		err = multierror.Append(err, errors.New("Config.Queue.MaxLength and Config.Queue.MaxLengthBytes cannot be negative"))
+	}
+	if value, ok := arguments["x-overflow"]; ok {
+		overflow, isString := value.(string)
+		switch {
+		case !isString || !QueueOverflow(overflow).valid():
+			err = multierror.Append(err, errors.Errorf("invalid x-overflow argument %#v", value))
+		case QueueOverflow(overflow) == QueueOverflowRejectPublishDLX && queueType != "classic":
+			err = multierror.Append(err, errors.Errorf("x-overflow %q is not supported by %s queue", overflow, queueType))
+		}
+
+		_, maxLength := arguments["x-max-length"]
+		_, maxLengthBytes := arguments["x-max-length-bytes"]
+		if !maxLength && !maxLengthBytes {
+			err = multierror.Append(err, errors.New("x-overflow is set without x-max-length or x-max-length-bytes"))
+		}
+	}
+	if c.Queue.ConsumerTimeout > 0 && c.Consume.AckBatch.MaxDelay >= c.Queue.ConsumerTimeout {
+		err = multierror.Append(err, errors.New(
+			"Config.Consume.AckBatch.MaxDelay must be shorter than Config.Queue.ConsumerTimeout",
+		))
+	}
+
+	if c.Consume.Requeue.enabled() && c.Consume.NoRequeueOnNack {
+		err = multierror.Append(err, errors.New(
+			"Config.Consume.Requeue.Delay has no effect when Config.Consume.NoRequeueOnNack is true",
+		))
+	}
+
+	return err
+}
+
+// maxNameLength is the maximum length of exchange name, queue name and routing key (AMQP's short string).
+const maxNameLength = 255
+
+// ValidateTopic validates exchange name, queue name and routing keys generated for the topic.
+//
+// Names and routing keys cannot be longer than 255 bytes, names must be also valid UTF-8.
+// Other characters are not restricted, because the broker accepts them (for example "/" or spaces).
+//
+// ValidateTopic is called by Publisher and Subscriber before the topic is used,
+// it can be also called at startup to detect misconfiguration early.
+func (c Config) ValidateTopic(topic string) error {
+	var err error
+
+	if c.Exchange.GenerateName != nil {
+		if exchangeName := c.Exchange.GenerateName(topic); exchangeName != "" {
+			if nameErr := validateName(exchangeName); nameErr != nil {
+				err = multierror.Append(err, errors.Wrapf(nameErr, "invalid exchange name %q", exchangeName))
+			}
+		}
+	}
+
+	if c.Queue.GenerateName != nil {
+		queueName := c.Queue.GenerateName(topic)
+		if nameErr := validateName(queueName); nameErr != nil {
+			err = multierror.Append(err, errors.Wrapf(nameErr, "invalid queue name %q", queueName))
+		}
+
+		if c.QueueBind.GenerateRoutingKey != nil {
+			if keyErr := validateRoutingKey(c.QueueBind.GenerateRoutingKey(queueName)); keyErr != nil {
+				err = multierror.Append(err, errors.Wrap(keyErr, "invalid queue bind routing key"))
+			}
+		}
+	}
+
+	if c.Publish.GenerateRoutingKey != nil {
+		if keyErr := validateRoutingKey(c.Publish.GenerateRoutingKey(topic)); keyErr != nil {
+			err = multierror.Append(err, errors.Wrap(keyErr, "invalid publish routing key"))
+		}
+	}
+
+	if c.Exchange.GenerateRoutingKey != nil {
+		if keyErr := validateRoutingKey(c.Exchange.GenerateRoutingKey(topic)); keyErr != nil {
+			err = multierror.Append(err, errors.Wrap(keyErr, "invalid exchange routing key"))
+		}
+	}
+
+	return err
+}
+
+func validateName(name string) error {
+	if len(name) > maxNameLength {
+		return errors.Errorf("name is %d bytes long, max length is %d bytes", len(name), maxNameLength)
+	}
+
+	if !utf8.ValidString(name) {
+		return errors.New("name is not valid UTF-8")
+	}
+
+	return nil
+}
+
+func validateRoutingKey(routingKey string) error {
+	if len(routingKey) > maxNameLength {
+		return errors.Errorf("routing key is %d bytes long, max length is %d bytes", len(routingKey), maxNameLength)
+	}
+
+	return nil
+}
+
 type ConnectionConfig struct {
 	AmqpURI string
 
+	// URIs is the list of AMQP URIs (for example nodes of the RabbitMQ cluster) used for client side failover.
+	// URIs are tried in order until the connection succeeds. On reconnect, the URI which succeeded the last time
+	// is tried first.
+	//
+	// When both AmqpURI and URIs are set, AmqpURI is tried first.
+	URIs []string
+
 	TLSConfig  *tls.Config
 	AmqpConfig *amqp.Config
 
 	Reconnect *ReconnectConfig
+
+	// When true, Healthy opens and closes a channel to check if the connection is actually alive.
+	// Otherwise, only connection state is checked, which may be stale after a silent network partition.
+	HealthCheckOpenChannel bool
+
+	// OnReconnect is called after every successful connection (including the first one), before the connection
+	// is marked as connected, so it's called before publishing and subscriptions resume.
+	// It allows to re-establish connection-scoped state, like declaring exchanges not managed by the Pub/Sub.
+	//
+	// When it returns an error, the connection is closed and treated as failed: the first connection fails
+	// NewPublisher or NewSubscriber, after reconnect the connection is retried.
+	// It's not called for the connection provided by the user (NewPublisherWithConnection, NewSubscriberWithConnection)
+	// and for connections returned by Dial, which are not dialed with github.com/streadway/amqp.
+	OnReconnect func(connection *amqp.Connection) error
+
+	// Dial replaces dialing the broker with github.com/streadway/amqp, it's called with every URI
+	// (after applying CredentialsProvider) on connect and reconnect.
+	// It allows to run Publisher and Subscriber on other AMQPConnection implementations,
+	// like the in-memory broker from the memamqp package. TLSConfig and AmqpConfig are ignored when it's set.
+	Dial func(amqpURI string) (AMQPConnection, error)
+
+	// CredentialsProvider is called before every connection (including reconnects) to get the username
+	// and password, which replace credentials from AmqpURI and URIs. It allows to reconnect with short-lived
+	// credentials (like OAuth 2 tokens), which are rotated while the process is running.
+	//
+	// When it returns an error, the connection fails like when the broker is not available.
+	// Credentials are ignored, when AmqpConfig.SASL is set.
+	CredentialsProvider func() (username, password string, err error)
+}
+
+func (c ConnectionConfig) uris() []string {
+	if c.AmqpURI == "" {
+		return c.URIs
+	}
+
+	return append([]string{c.AmqpURI}, c.URIs...)
+}
+
+// urisWithCredentials returns uris with credentials from CredentialsProvider, when it's set.
+func (c ConnectionConfig) urisWithCredentials() ([]string, error) {
+	uris := c.uris()
+	if c.CredentialsProvider == nil {
+		return uris, nil
+	}
+
+	username, password, err := c.CredentialsProvider()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get AMQP credentials from Config.Connection.CredentialsProvider")
+	}
+
+	withCredentials := make([]string, len(uris))
+	for i, amqpURI := range uris {
+		parsedURI, err := url.Parse(amqpURI)
+		if err != nil {
+			// URI itself is not included, because it may contain credentials
+			return nil, errors.Errorf("cannot parse AMQP URI at index %d", i)
+		}
+		parsedURI.User = url.UserPassword(username, password)
+		withCredentials[i] = parsedURI.String()
+	}
+
+	return withCredentials, nil
+}
+
+func (c ConnectionConfig) reconnectConfig() *ReconnectConfig {
+	if c.Reconnect == nil {
+		return DefaultReconnectConfig()
+	}
+
+	return c.Reconnect
 }
 
 // Config descriptions are based on descriptions from: https://github.com/streadway/amqp
 // Copyright (c) 2012, Sean Treadway, SoundCloud Ltd.
 // BSD 2-Clause "Simplified" License
 
+// ExchangeConfig configures the exchange declared by DefaultTopologyBuilder.
+//
+// Durable, AutoDeleted, Internal and NoWait are passed to ExchangeDeclare as they are.
+// Config constructors (like NewDurablePubSubConfig) only set the defaults, so they can be overridden
+// to match externally provisioned topology exactly. Otherwise, the broker rejects the declaration (406 error).
 type ExchangeConfig struct {
 	// GenerateName is generated based on the topic provided for Publish or Subscribe method.
 	//
 	// Exchange names starting with "amq." are reserved for pre-declared and
 	// standardized exchanges. The client MAY declare an exchange starting with
-	// "amq." if the passive option is set, or the exchange already exists.  Names can
-	// consist of a non-empty sequence of letters, digits, hyphen, underscore,
-	// period, or colon.
+	// "amq." if the passive option is set, or the exchange already exists.
+	//
+	// Names cannot be longer than 255 bytes and must be valid UTF-8, see Config.ValidateTopic.
+	// When GenerateName returns empty string, the default exchange is used.
 	GenerateName func(topic string) string
 
+	// GenerateRoutingKey generates the routing key used both for binding the queue to the exchange
+	// and for publishing to the exchange, so routing of the topic is consistent on both sides.
+	// When set, it takes precedence over QueueBind.GenerateRoutingKey and Publish.GenerateRoutingKey.
+	//
+	// It's not used when GenerateName returns empty string (the default exchange), in that case
+	// messages are routed by the queue name.
+	GenerateRoutingKey func(topic string) string
+
 	// Each exchange belongs to one of a set of exchange kinds/types implemented by
 	// the server. The exchange types define the functionality of the exchange - i.e.
 	// how messages are routed through it. Once an exchange is declared, its type
 	// cannot be changed.  The common types are "direct", "fanout", "topic" and
 	// "headers".
+	//
+	// Types provided by broker plugins must be registered with RegisterExchangeType,
+	// unless they are registered by default (like "x-delayed-message").
 	Type string
 
 	// Durable and Non-Auto-Deleted exchanges will survive server restarts and remain
@@ -302,11 +780,25 @@ type ExchangeConfig struct {
 	// When noWait is true, declare without waiting for a confirmation from the server.
 	// The channel may be closed as a result of an error.  Add a NotifyClose listener-
 	// to respond to any exceptions.
+	//
+	// It saves a round-trip per declaration, which speeds up startup of many topics.
+	// Errors are reported asynchronously, see Config.TopologyNoWait.
 	NoWait bool
 
 	// Optional amqp.Table of arguments that are specific to the server's implementation of
 	// the exchange can be sent for exchange types that require extra parameters.
+	//
+	// For the "x-delayed-message" exchange, "x-delayed-type" required by the plugin is set to "direct",
+	// unless it's set here. Like with QueueConfig.Arguments, arguments set here take precedence.
 	Arguments amqp.Table
+
+	// DeduplicationCacheSize is the maximum number of deduplication IDs remembered by the exchange
+	// of DeduplicationExchangeType type ("x-cache-size" argument, required by the plugin).
+	DeduplicationCacheSize int
+
+	// DeduplicationCacheTTL is the time after which the deduplication ID is forgotten by the exchange
+	// of DeduplicationExchangeType type ("x-cache-ttl" argument). By default, IDs are not expired.
+	DeduplicationCacheTTL time.Duration
 }
 
 // QueueNameGenerator generates QueueName based on the topic.
@@ -332,24 +824,52 @@ func GenerateQueueNameTopicNameWithSuffix(suffix string) QueueNameGenerator {
 	}
 }
 
+// GenerateQueueNameTopicPatternWithSuffix generates queue name from the topic exchange binding pattern,
+// with wildcards replaced by words ("*" by "star" and "#" by "hash"):
+// 	topic + "_" + suffix
+// For example, "orders.*.created" with suffix "billing" is mapped to "orders.star.created_billing".
+func GenerateQueueNameTopicPatternWithSuffix(suffix string) QueueNameGenerator {
+	replacer := strings.NewReplacer("*", "star", "#", "hash")
+
+	return func(topic string) string {
+		return replacer.Replace(topic) + "_" + suffix
+	}
+}
+
+// QueueConfig configures the queue declared by DefaultTopologyBuilder.
+//
+// Durable, AutoDelete, Exclusive and NoWait are passed to QueueDeclare as they are
+// (except server named queues, see ServerNamed). Config constructors only set the defaults,
+// so for example durable exchange can be used with transient queues.
+// AMQP doesn't support internal queues, Internal flag is available only for exchanges.
 type QueueConfig struct {
-	// GenerateRoutingKey is generated based on the topic provided for Subscribe.
+	// GenerateName generates the queue name based on the topic provided for Subscribe.
 	GenerateName QueueNameGenerator
 
+	// GenerateNames allows to consume the topic from multiple queues (for example sharded queues bound
+	// to the consistent-hash exchange). Subscribe declares every returned queue, starts a consumer
+	// with its own channel per queue and merges messages into one output channel.
+	// Acks and nacks are sent to the channel from which the message was delivered.
+	//
+	// Every queue is bound to the topic's exchange with QueueBind.GenerateRoutingKey(queueName).
+	// GenerateName is still required and it's used by Get, PurgeQueue, DeleteQueue, Rebind and Publish.
+	GenerateNames func(topic string) []string
+
 	// Durable and Non-Auto-Deleted queues will survive server restarts and remain
 	// when there are no remaining consumers or bindings.  Persistent publishings will
 	// be restored in this queue on server restart.  These queues are only able to be
 	// bound to durable exchanges.
 	Durable bool
 
-	// Non-Durable and Auto-Deleted exchanges will be deleted when there are no
-	// remaining bindings and not restored on server restart.  This lifetime is
-	// useful for temporary topologies that should not pollute the virtual host on
-	// failure or after the consumers have completed.
+	// Non-Durable and Auto-Deleted queues will not be redeclared on server restart
+	// and will be deleted by the server after a short time when the last consumer is
+	// canceled or the last consumer's channel is closed.  Queues with this lifetime
+	// can also be deleted normally with QueueDelete.  These durable queues can only
+	// be bound to non-durable exchanges.
 	//
-	// Non-Durable and Non-Auto-deleted exchanges will remain as long as the server is
-	// running including when there are no remaining bindings.  This is useful for
-	// temporary topologies that may have long delays between bindings.
+	// Non-Durable and Non-Auto-Deleted queues will remain declared as long as the
+	// server is running regardless of how many consumers.  This lifetime is useful
+	// for temporary topologies that may have long delays between consumer activity.
 	AutoDelete bool
 
 	// Exclusive queues are only accessible by the connection that declares them and
@@ -361,13 +881,133 @@ type QueueConfig struct {
 	// When noWait is true, the queue will assume to be declared on the server.  A
 	// channel exception will arrive if the conditions are met for existing queues
 	// or attempting to modify an existing queue from a different connection.
+	//
+	// Server named queue is always declared with noWait false, because the generated name
+	// is returned in the declare-ok. Errors are reported asynchronously, see Config.TopologyNoWait.
 	NoWait bool
 
-	// Optional amqpe.Table of arguments that are specific to the server's implementation of
+	// When true and GenerateName returns empty string, the queue name is generated by the broker.
+	// Server named queue is always declared as exclusive, auto-deleted and non-durable,
+	// so it exists only as long as the connection (and it's consumer).
+	// After reconnect, a new queue is declared.
+	//
+	// It's useful for temporary subscriptions, like RPC reply queues.
+	ServerNamed bool
+
+	// DeadLetterExchange is set as the "x-dead-letter-exchange" argument of the queue, when not empty.
+	// Rejected, expired or dropped because of queue length limit messages are republished to this exchange.
+	DeadLetterExchange string
+
+	// DeadLetterRoutingKey is set as the "x-dead-letter-routing-key" argument of the queue, when not empty.
+	// When empty, original routing key of the message is used.
+	DeadLetterRoutingKey string
+
+	// When true, queue is declared with the "x-message-deduplication" argument
+	// supported by the rabbitmq-message-deduplication plugin.
+	// To deduplicate messages before they are routed to queues, DeduplicationExchangeType can be used instead.
+	// Deduplication ID is read from the "x-deduplication-header" header,
+	// which can be set with DefaultMarshaler.GenerateDeduplicationID.
+	Deduplication bool
+
+	// When true, queue is declared with the "x-single-active-consumer" argument.
+	// Only one consumer of the queue receives messages at a time, other consumers are waiting
+	// and one of them takes over when the active consumer is cancelled or disconnected.
+	//
+	// It allows ordered processing with failover, when multiple subscribers consume from the same queue.
+	SingleActiveConsumer bool
+
+	// When Lazy is true, queue is declared with the "x-queue-mode: lazy" argument.
+	// Lazy queue moves messages to the disk as early as possible, which reduces memory usage
+	// of large backlogs, when consumers fall behind.
+	//
+	// Only classic queues support lazy mode, quorum and stream queues always store messages on the disk.
+	Lazy bool
+
+	// ConsumerTimeout is set as the "x-consumer-timeout" argument of the queue (in milliseconds), when not zero.
+	// RabbitMQ (3.12 and newer) closes the channel of the consumer, which didn't ack the delivery
+	// within the timeout, and all its unacked deliveries are redelivered.
+	//
+	// Subscriber logs a warning (and calls ConsumeConfig.OnConsumerTimeoutWarning), when the message
+	// is not acked or nacked after 80% of the timeout, so slow handlers are noticed before the channel is closed.
+	ConsumerTimeout time.Duration
+
+	// MaxLength and MaxLengthBytes are set as "x-max-length" and "x-max-length-bytes" arguments of the queue,
+	// when not zero. They limit the number of ready messages and their total body size in the queue.
+	// What happens when the limit is reached is defined by Overflow.
+	MaxLength      int64
+	MaxLengthBytes int64
+
+	// Overflow is set as the "x-overflow" argument of the queue, when not empty.
+	// When empty, the broker's default (QueueOverflowDropHead) is used.
+	//
+	// With QueueOverflowRejectPublish and QueueOverflowRejectPublishDLX, messages published to the full queue
+	// are nacked by the broker, so Publish returns an error only with Config.Publish.ConfirmDelivery
+	// (see also PublishConfig.OnConfirmNack). Without confirms, they are silently dropped.
+	Overflow QueueOverflow
+
+	// Optional amqp.Table of arguments that are specific to the server's implementation of
 	// the queue can be sent for queue types that require extra parameters.
+	//
+	// Arguments are merged with arguments generated from the other fields (like "x-dead-letter-exchange"
+	// from DeadLetterExchange or "x-consumer-timeout" from ConsumerTimeout), arguments set here take precedence.
 	Arguments amqp.Table
 }
 
+// QueueOverflow is the behavior of the queue, which reached its length limit (see QueueConfig.Overflow).
+type QueueOverflow string
+
+const (
+	// QueueOverflowDropHead drops (or dead-letters) the oldest messages from the front of the queue.
+	QueueOverflowDropHead QueueOverflow = "drop-head"
+	// QueueOverflowRejectPublish rejects newly published messages.
+	QueueOverflowRejectPublish QueueOverflow = "reject-publish"
+	// QueueOverflowRejectPublishDLX rejects newly published messages and dead-letters them.
+	// It's supported only by classic queues.
+	QueueOverflowRejectPublishDLX QueueOverflow = "reject-publish-dlx"
+)
+
+func (o QueueOverflow) valid() bool {
+	switch o {
+	case QueueOverflowDropHead, QueueOverflowRejectPublish, QueueOverflowRejectPublishDLX:
+		return true
+	default:
+		return false
+	}
+}
+
+// TopologyNoWait returns true when the queue, exchange or binding is declared with NoWait.
+//
+// Without waiting for declare-ok and bind-ok, the error of the declaration is not returned by the declaring
+// method. Instead, the broker closes the channel and the error surfaces asynchronously: Subscribe and
+// SubscribeInitialize return the error received with the channel close, after closing the channel used
+// to declare the topology (TopologyMismatchError is still detected), Publish returns it from the next call
+// on the closed channel.
+func (c Config) TopologyNoWait() bool {
+	if c.Queue.NoWait || c.Exchange.NoWait || c.QueueBind.NoWait {
+		return true
+	}
+	for _, binding := range c.QueueBind.ExtraBindings {
+		if binding.ExchangeType != "" && binding.ExchangeNoWait {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (q QueueConfig) serverNamed(queueName string) bool {
+	return q.ServerNamed && queueName == ""
+}
+
+// serverNamedQueueConfig returns config with queue flags required by server named queue.
+func (c Config) serverNamedQueueConfig() Config {
+	c.Queue.Durable = false
+	c.Queue.AutoDelete = true
+	c.Queue.Exclusive = true
+
+	return c
+}
+
 // QueueBind binds an exchange to a queue so that publishings to the exchange will
 // be routed to the queue when the publishing routing key matches the binding
 // routing key.
@@ -376,17 +1016,62 @@ type QueueBindConfig struct {
 
 	// When noWait is false and the queue could not be bound, the channel will be
 	// closed with an error.
+	//
+	// When noWait is true, binding errors are reported asynchronously, see Config.TopologyNoWait.
 	NoWait bool
 
 	// Optional amqpe.Table of arguments that are specific to the server's implementation of
 	// the queue bind can be sent for queue bind types that require extra parameters.
 	Arguments amqp.Table
+
+	// ExtraBindings binds the queue also to other exchanges, than the exchange generated for the topic.
+	// It allows to aggregate messages from exchanges owned by other services into a single queue.
+	//
+	// Bindings are declared by BuildTopology after the binding to the topic's exchange (also when the topic
+	// is consumed from the default exchange). Declarations are idempotent, so they are repeated after every reconnect.
+	ExtraBindings []ExchangeBinding
+}
+
+// ExchangeBinding is the binding of the queue to the exchange, see QueueBindConfig.ExtraBindings.
+type ExchangeBinding struct {
+	// Exchange is the name of the exchange, to which the queue is bound.
+	Exchange string
+
+	// ExchangeType is the type of the exchange. When not empty, the exchange is declared before binding
+	// with ExchangeDurable, ExchangeAutoDeleted, ExchangeInternal, ExchangeNoWait and ExchangeArguments.
+	// Like in ExchangeConfig, they are independent of the topic's exchange and must match the existing
+	// exchange declaration, otherwise subscribing fails with TopologyMismatchError.
+	//
+	// When empty, the exchange is not declared, it must be declared by its owner.
+	ExchangeType        string
+	ExchangeDurable     bool
+	ExchangeAutoDeleted bool
+	ExchangeInternal    bool
+	// When ExchangeNoWait is true, the declaration error is reported asynchronously, see Config.TopologyNoWait.
+	ExchangeNoWait    bool
+	ExchangeArguments amqp.Table
+
+	// RoutingKey is the binding key of the queue.
+	RoutingKey string
+
+	// Arguments of the binding (for example used by the headers exchange).
+	Arguments amqp.Table
 }
 
 type PublishConfig struct {
 	// GenerateRoutingKey is generated based on the topic provided for Publish.
+	//
+	// When nil and Exchange.GenerateName returns empty string, message is published to the default exchange
+	// with the routing key generated by Queue.GenerateName. It's required for other exchanges.
 	GenerateRoutingKey func(topic string) string
 
+	// RoutingKeyMetadataKey allows to set the routing key per message. When not empty and the message
+	// has the metadata with this key, its value is used as the routing key instead of GenerateRoutingKey.
+	//
+	// It's useful for the consistent-hash exchange (see NewDurableConsistentHashConfig), where the routing key
+	// is the partition key hashed to choose the queue, so messages with the same key are consumed in order.
+	RoutingKeyMetadataKey string
+
 	// Publishings can be undeliverable when the mandatory flag is true and no queue is
 	// bound that matches the routing key, or when the immediate flag is true and no
 	// consumer on the matched queue is ready to accept the delivery.
@@ -395,21 +1080,294 @@ type PublishConfig struct {
 	// Publishings can be undeliverable when the mandatory flag is true and no queue is
 	// bound that matches the routing key, or when the immediate flag is true and no
 	// consumer on the matched queue is ready to accept the delivery.
+	//
+	// Immediate is supported only for interoperability with AMQP 0-9-1 brokers, which still honor it.
+	// RabbitMQ (since 3.0) closes the connection with NOT_IMPLEMENTED error, when the flag is set.
+	// In that case Publish returns the error caused by ErrImmediateNotSupported (see IsImmediateNotSupportedError)
+	// and the connection is reconnected. Because the error is reported asynchronously, it may be returned
+	// by the next Publish instead; with ConfirmDelivery it's always returned by the Publish of the message.
 	Immediate bool
 
+	// ReturnFallbackTopic is the topic to which messages returned by the broker as unroutable
+	// (see Mandatory) are published, instead of dropping them. It requires Mandatory to be true.
+	//
+	// Returned messages are published in the background, with "x-returned-exchange", "x-returned-routing-key"
+	// and "x-returned-reason" headers. They are published without mandatory flag, so messages which are unroutable
+	// in the fallback topic as well are dropped.
+	ReturnFallbackTopic string
+
 	// With transactional enabled, all messages wil be added in transaction.
 	Transactional bool
+
+	// Retry configures retrying of Publish when channel or connection error occurs.
+	Retry PublishRetryConfig
+
+	// ConfirmDelivery enables publisher confirms.
+	// When true, Publish waits until every message is confirmed by the broker.
+	// Publish returns an error when the message was nacked by the broker.
+	//
+	// ConfirmDelivery cannot be used with Transactional.
+	ConfirmDelivery bool
+
+	// OnConfirmNack is called with every message nacked by the broker (for example when the queue is full
+	// with "x-overflow" set to "reject-publish" or the broker cannot store the message), when ConfirmDelivery is enabled.
+	// It allows to route such messages to a local fallback or retry them later.
+	//
+	// When set, nacked messages are considered handled, so Publish doesn't return an error for them.
+	// It's called synchronously from Publish, before Publish returns.
+	OnConfirmNack func(msg *message.Message)
+
+	// Timeout is the maximum time of Publish, including retries and waiting for confirms.
+	// After timeout, Publish returns an error. Messages may be still published, because publishing
+	// on the AMQP channel cannot be interrupted (for example when the connection is blocked by the broker).
+	// When zero, Publish has no timeout.
+	Timeout time.Duration
+
+	// ConfirmFlushTimeout is the maximum time Publisher.Close waits for outstanding confirms.
+	// When zero, 30 seconds is used.
+	ConfirmFlushTimeout time.Duration
+
+	// AppID is set as the AppId property of the published message, when it was not set by the Marshaler.
+	// It can be used to trace provenance of messages.
+	// It can be overridden per message with the AppIDMetadataKey metadata.
+	AppID string
+
+	// When FailFastWhenBlocked is true, Publish returns ErrConnectionBlocked immediately when the connection
+	// is blocked by the broker (for example because of memory or disk alarm).
+	// Otherwise, Publish hangs until the connection is unblocked.
+	FailFastWhenBlocked bool
+
+	// MaxMessageBytes is the maximum size of the marshaled body. Publish returns an error for larger messages,
+	// before they are sent to the broker. In non-transactional mode, messages before the oversized one are published.
+	// When zero, size is not limited.
+	MaxMessageBytes int
+
+	// LargeMessageWarnBytes is the soft limit of the marshaled body. Larger messages are still published,
+	// but they are logged with the UUID and size and reported to OnLargeMessage, because large messages
+	// hurt the broker's performance. When zero, large messages are not reported.
+	//
+	// Like MaxMessageBytes, it's compared with the size after marshaling, so compressed messages
+	// (see GzipMarshaler) are reported only when they are large after compression.
+	LargeMessageWarnBytes int
+
+	// OnLargeMessage is called with the marshaled body size of every message larger than LargeMessageWarnBytes.
+	// It can be used to report the metric of producers sending bloated payloads.
+	OnLargeMessage func(topic string, msg *message.Message, bodyBytes int)
+
+	// UserID is set as the UserId property of the published message, when it was not set by the Marshaler.
+	//
+	// RabbitMQ validates UserId against the user of the connection. When they don't match,
+	// the broker closes the channel and Publish returns an error.
+	// It can be overridden per message with the UserIDMetadataKey metadata.
+	UserID string
+
+	// DefaultDeliveryMode is set as the DeliveryMode property of published messages (amqp.Transient
+	// or amqp.Persistent), when not set by the Marshaler (DefaultMarshaler sets amqp.Persistent,
+	// unless NotPersistentDeliveryMode is true).
+	// It can be overridden per message with the DeliveryModeMetadataKey metadata.
+	DefaultDeliveryMode uint8
+
+	// DefaultPriority is set as the Priority property of published messages, when not set by the Marshaler.
+	// It can be overridden per message with the PriorityMetadataKey metadata.
+	// Priority is used only by queues declared with the "x-max-priority" argument.
+	DefaultPriority uint8
+
+	// CorrelationIDFunc generates the CorrelationId property of the published message,
+	// when it was not set by the Marshaler (for example by RPCMarshaler from the metadata).
+	// CorrelationIDFromUUID can be used to reuse the message UUID. When nil, CorrelationId is not generated.
+	CorrelationIDFunc func(msg *message.Message) string
+
+	// CorrelationIDHeader is the header to which the generated correlation ID is copied, when not empty.
+	// DefaultMarshaler maps headers to the metadata, so the ID is available in the metadata of the consumed message.
+	CorrelationIDHeader string
+
+	// When DisableTimestamp is false, Timestamp property of the published message is set to the publish time,
+	// when it was not set by the Marshaler. It allows to measure latency with Config.Consume.OnDeliveryLatency.
+	DisableTimestamp bool
+}
+
+func (p PublishConfig) confirmFlushTimeout() time.Duration {
+	if p.ConfirmFlushTimeout == 0 {
+		return 30 * time.Second
+	}
+
+	return p.ConfirmFlushTimeout
+}
+
+// PublishRetryConfig configures retrying of failed publishes.
+//
+// Publish is retried only when it's certain that the message was not accepted by the broker
+// (not connected, channel cannot be opened or message cannot be sent to the channel),
+// so retry doesn't cause duplicates. Before every retry, Publish waits for the connection.
+//
+// In transactional mode, the whole transaction is retried.
+// Otherwise, only messages which were not published are published again.
+type PublishRetryConfig struct {
+	// MaxAttempts is the maximum number of publish attempts.
+	// When lower than 2, Publish is not retried.
+	MaxAttempts int
+
+	// Backoff configures delays between attempts.
+	// When nil, DefaultReconnectConfig is used.
+	Backoff *ReconnectConfig
+}
+
+func (r PublishRetryConfig) backoffConfig() *backoff.ExponentialBackOff {
+	if r.Backoff == nil {
+		return DefaultReconnectConfig().backoffConfig()
+	}
+
+	return r.Backoff.backoffConfig()
 }
 
 type ConsumeConfig struct {
 	// When true, message will be not requeued when nacked.
 	NoRequeueOnNack bool
 
+	// When UseReject is true, messages are nacked with basic.reject instead of basic.nack.
+	// basic.nack is a RabbitMQ extension, which is not supported by some AMQP 0-9-1 brokers and proxies.
+	// Messages are always nacked one by one, so both methods have the same effect.
+	UseReject bool
+
+	// When AckOnReceive is true, the delivery is acked as soon as the message is sent to the subscriber,
+	// before it's processed (at-most-once delivery). Ack or nack of the message has no effect,
+	// it only cancels the message context.
+	//
+	// Unlike the broker's auto-ack, deliveries are still acked one by one after they are consumed,
+	// so Qos.PrefetchCount limits the number of prefetched messages. Message is lost when the handler fails
+	// or the process crashes after the ack. It's useful when reprocessing is worse than loss (like telemetry).
+	AckOnReceive bool
+
+	// ContextFunc allows to enrich the context of the consumed message with values derived from the delivery
+	// (for example tenant ID from the header or deadline from the expiration).
+	//
+	// The returned context must be derived from ctx, ctx is cancelled after the message is acked or nacked.
+	// When nil, ctx is used.
+	ContextFunc func(ctx context.Context, delivery amqp.Delivery) context.Context
+
+	// OnDeliveryLatency is called for every delivery with the Timestamp property set, with the time elapsed
+	// since the Timestamp (end-to-end latency, including time spent in the queue).
+	// It's called before filtering and unmarshaling, so it must be fast (for example update of a histogram).
+	//
+	// AMQP timestamp has seconds precision. Negative latency (because of clock skew) is reported as zero.
+	// Publisher sets the Timestamp to the publish time, unless Config.Publish.DisableTimestamp is true.
+	OnDeliveryLatency func(topic string, latency time.Duration, delivery amqp.Delivery)
+
+	// OnFlow is called when the broker pauses (active is false) or resumes (active is true) the channel
+	// of the subscription with channel.flow. Consuming of new deliveries is paused until the flow is resumed.
+	//
+	// RabbitMQ doesn't use channel.flow (it uses TCP backpressure and connection.blocked instead),
+	// but other AMQP 0-9-1 brokers may use it.
+	OnFlow func(topic string, active bool)
+
+	// OnConsumerTimeoutWarning is called when the message is not acked or nacked after 80% of
+	// Config.Queue.ConsumerTimeout since it was received. It allows to report slow handlers as a metric.
+	OnConsumerTimeoutWarning func(topic string, delivery amqp.Delivery, elapsed time.Duration)
+
+	// LivenessInterval enables periodic debug log with the number of messages received by the consumer
+	// since the last log. It allows to tell from the logs if the idle consumer is still consuming.
+	// When zero, liveness is not logged.
+	LivenessInterval time.Duration
+
+	// NackRetries is the number of retries of a failed nack, before the subscription is reconnected.
+	// Retries are done with linearly increasing delay, starting from 100ms.
+	// When zero, the subscription is reconnected after the first failed nack.
+	//
+	// Only the ack or nack of the delivery is retried, copies published by Retry and Requeue are not published again.
+	// Retries are stopped when the Subscriber is closed or the subscription is cancelled.
+	NackRetries int
+
+	// When ProcessInOrder is true, the next delivery is not sent to the subscriber until the current message
+	// is acked or nacked, so messages are processed and acked strictly in the order of delivery.
+	// Otherwise, acks are awaited asynchronously and the next messages can be processed before earlier ones
+	// are acked (for example when the subscriber processes messages concurrently).
+	//
+	// Nacked message is requeued, so it may be redelivered after messages which were already prefetched.
+	// Qos.PrefetchCount set to 1 keeps the order also in this case.
+	ProcessInOrder bool
+
+	// When SyncAck is true, every delivery is settled with the broker in the consuming loop, before the next delivery
+	// is sent to the subscriber. It's meant for tests: when the handler of the next message is called,
+	// the previous message was already acked or nacked and counted in Subscriber.Stats,
+	// so the state can be asserted without sleeps and retries.
+	//
+	// Unlike ProcessInOrder, which waits only for the ack or nack of the message, SyncAck also nacks
+	// deliveries which failed to be acked, couldn't be unmarshaled or weren't consumed before closing
+	// in the consuming loop, instead of nacking them in the background.
+	// It cannot be used with AckBatch, which defers acks.
+	SyncAck bool
+
+	// Requeue allows to delay redelivery of nacked messages.
+	Requeue RequeueConfig
+
+	// Retry allows to republish nacked messages to the retry exchange, instead of requeueing them.
+	// It cannot be used together with Requeue and NoRequeueOnNack.
+	Retry RetryConfig
+
+	// RepublishTimeout is the maximum time the copy of the nacked message published by Requeue or Retry
+	// waits for the broker's confirm. After timeout, or when the subscription is closing, the original delivery
+	// is requeued instead of acked, so the message may be duplicated, but it's never lost.
+	// When zero, 30 seconds is used.
+	RepublishTimeout time.Duration
+
+	// Filter is called for every delivery before unmarshaling.
+	// When it returns false, the delivery is acked and not sent to the subscriber.
+	//
+	// It's a client side alternative to the headers exchange, when the topology cannot be changed.
+	Filter func(amqp.Delivery) bool
+
+	// AckBatch enables batching of acks, which are sent as cumulative acks.
+	// When zero, every delivery is acked separately.
+	AckBatch AckBatchConfig
+
+	// AckStrategy decides if delivery should be acked or nacked.
+	// When nil, DefaultAckStrategy is used.
+	AckStrategy AckStrategy
+
+	// OnUnmarshalError decides what happens with deliveries which cannot be unmarshaled.
+	// Such deliveries will never succeed, so requeueing them may block the queue.
+	// By default, they are nacked like any other message (UnmarshalErrorRequeue).
+	OnUnmarshalError UnmarshalErrorPolicy
+
+	// LogUnmarshalErrorDelivery enables logging of the delivery, which cannot be unmarshaled, at trace level.
+	// The body (truncated to LogUnmarshalErrorBodyBytes), content type, content encoding and headers are logged,
+	// which helps to debug encoding mismatches. It's disabled by default, because the body may contain sensitive data.
+	LogUnmarshalErrorDelivery bool
+
+	// LogUnmarshalErrorBodyBytes is the maximum number of body bytes logged with LogUnmarshalErrorDelivery.
+	// When zero, up to 1024 bytes are logged. When negative, the whole body is logged.
+	LogUnmarshalErrorBodyBytes int
+
+	// OnContextDone decides what happens with in-flight messages (sent to the subscriber and not acked yet),
+	// when the ctx passed to Subscribe is done.
+	// By default, ProcessMessages waits until they are acked or nacked (ContextDoneWait).
+	OnContextDone ContextDonePolicy
+
+	// OnDeliveriesLost is called with UUIDs of the messages, which were sent to the subscriber and not acked
+	// or nacked yet, when the channel is closed (for example after the connection loss).
+	// These messages are requeued by the broker and redelivered after reconnect, so the application can
+	// reconcile them (for example mark them for deduplication). Acks and nacks of these messages fail.
+	//
+	// It's called from the consuming goroutine, before the subscription reconnects, so it shouldn't block.
+	// Acks which were batched by AckBatch and not flushed yet are not reported.
+	OnDeliveriesLost func(uuids []string)
+
+	// ReuseTopologyChannel declares the topology after reconnect on the channel used for consuming,
+	// instead of opening and closing a dedicated channel, which reduces channel churn on every reconnect.
+	// The topology is still declared on a dedicated channel by Subscribe and SubscribeInitialize.
+	//
+	// Declaration errors close the channel in AMQP, so when the declaration fails, the channel is closed
+	// and consuming is retried on a new one. It cannot be used with NoWait declarations (see Config.TopologyNoWait),
+	// because their errors would be reported only after consuming has started.
+	ReuseTopologyChannel bool
+
 	// The consumer is identified by a string that is unique and scoped for all
 	// consumers on this channel.  If you wish to eventually cancel the consumer, use
 	// the same non-empty identifier in Channel.Cancel.  An empty string will cause
-	// the library to generate a unique identity.  The consumer identity will be
-	// included in every Delivery in the ConsumerTag field
+	// the Subscriber to generate a unique identity for every subscription (see Subscription.ConsumerTag).
+	// The consumer identity will be included in every Delivery in the ConsumerTag field.
+	//
+	// Consumer can be cancelled with Subscriber.CancelConsumer.
 	Consumer string
 
 	// When exclusive is true, the server will ensure that this is the sole consumer
@@ -430,6 +1388,133 @@ type ConsumeConfig struct {
 	// Optional arguments can be provided that have specific semantics for the queue
 	// or server.
 	Arguments amqp.Table
+
+	// GenerateArguments generates consume arguments for the topic (for example x-stream-offset for stream queues
+	// or x-priority for consumer priorities).
+	// When nil or when it returns nil, Arguments are used.
+	GenerateArguments func(topic string) amqp.Table
+
+	// Priority is set as the "x-priority" consume argument, when not nil.
+	// Consumers with higher priority receive messages while they are active, consumers with lower priority
+	// receive messages only when higher priority consumers are blocked (for example by Qos) or down.
+	// It allows to run hot-standby consumers.
+	Priority *int
+}
+
+func (c ConsumeConfig) arguments(topic string) amqp.Table {
+	arguments := c.Arguments
+	if c.GenerateArguments != nil {
+		if generatedArguments := c.GenerateArguments(topic); generatedArguments != nil {
+			arguments = generatedArguments
+		}
+	}
+
+	generated := amqp.Table{}
+	if c.Priority != nil {
+		generated["x-priority"] = int32(*c.Priority)
+	}
+
+	return mergeArguments(generated, arguments)
+}
+
+// UnmarshalErrorPolicy defines what happens with the delivery, which cannot be unmarshaled.
+type UnmarshalErrorPolicy int
+
+const (
+	// UnmarshalErrorRequeue nacks the delivery in the same way as nacked messages
+	// (according to ConsumeConfig.NoRequeueOnNack and ConsumeConfig.Requeue).
+	UnmarshalErrorRequeue UnmarshalErrorPolicy = iota
+	// UnmarshalErrorDrop acks the delivery, so it's removed from the queue.
+	UnmarshalErrorDrop
+	// UnmarshalErrorDeadLetter nacks the delivery without requeue.
+	// The delivery is dead-lettered when the queue has dead letter exchange (see QueueConfig.DeadLetterExchange),
+	// otherwise it's dropped by the broker.
+	UnmarshalErrorDeadLetter
+)
+
+// ContextDonePolicy defines what happens with in-flight messages, when the ctx passed to Subscribe is done.
+//
+// Context of in-flight messages is cancelled in all cases, so handlers can stop the processing.
+type ContextDonePolicy int
+
+const (
+	// ContextDoneWait waits until in-flight messages are acked or nacked by the subscriber,
+	// before the channel is closed.
+	ContextDoneWait ContextDonePolicy = iota
+	// ContextDoneNack nacks in-flight messages immediately, in the same way as nacked messages
+	// (according to ConsumeConfig.NoRequeueOnNack, ConsumeConfig.Requeue and ConsumeConfig.Retry).
+	// Later ack or nack of the message has no effect.
+	ContextDoneNack
+	// ContextDoneRelease stops waiting for in-flight messages without acking or nacking them.
+	// Deliveries are requeued by the broker when the channel is closed, with the redelivered flag set.
+	// Later ack or nack of the message has no effect.
+	ContextDoneRelease
+)
+
+func (c ConsumeConfig) messageContext(ctx context.Context, delivery amqp.Delivery) context.Context {
+	if c.ContextFunc == nil {
+		return ctx
+	}
+
+	return c.ContextFunc(ctx, delivery)
+}
+
+func (c ConsumeConfig) ackStrategy() AckStrategy {
+	if c.AckStrategy == nil {
+		return DefaultAckStrategy{}
+	}
+
+	return c.AckStrategy
+}
+
+func (c ConsumeConfig) republishTimeout() time.Duration {
+	if c.RepublishTimeout == 0 {
+		return 30 * time.Second
+	}
+
+	return c.RepublishTimeout
+}
+
+// nack sends basic.nack, or basic.reject when UseReject is true.
+func (c ConsumeConfig) nack(delivery amqp.Delivery, requeue bool) error {
+	if c.UseReject {
+		return delivery.Reject(requeue)
+	}
+
+	return delivery.Nack(false, requeue)
+}
+
+// RequeueConfig configures delayed requeue of nacked messages.
+//
+// Without delay, nacked message is redelivered by the broker immediately, which may cause
+// a hot loop when handler fails because of a transient error.
+// With Delay set, nacked message is published to the delay queue and acked, after the broker confirmed the copy.
+// When the copy cannot be published (for example because the delay queue doesn't exist), the message is requeued
+// without delay, so it's not lost.
+// Delay queue has no consumers, so the message is dead-lettered back to the original queue
+// after the delay passes (message TTL).
+//
+// Delay queue is declared by DefaultTopologyBuilder. Delay is ignored when Consume.NoRequeueOnNack is true.
+type RequeueConfig struct {
+	// Delay after which the nacked message is delivered again.
+	// When zero, nacked messages are requeued immediately.
+	Delay time.Duration
+
+	// GenerateDelayQueueName generates name of the delay queue based on the consumed queue name.
+	// When nil, queue name with "_delay" suffix is used.
+	GenerateDelayQueueName func(queueName string) string
+}
+
+func (r RequeueConfig) enabled() bool {
+	return r.Delay > 0
+}
+
+func (r RequeueConfig) delayQueueName(queueName string) string {
+	if r.GenerateDelayQueueName != nil {
+		return r.GenerateDelayQueueName(queueName)
+	}
+
+	return queueName + "_delay"
 }
 
 // Qos controls how many messages or how many bytes the server will try to keep on
@@ -448,10 +1533,23 @@ type QosConfig struct {
 	// Instead, it will dispatch it to the next worker that is not still busy.
 	PrefetchCount int
 
+	// Distribution tells how PrefetchCount is applied, when the queue is consumed by multiple consumers
+	// (for example by multiple subscriptions or instances of the service).
+	// By default, PrefetchCount is applied to every consumer (QosPerConsumer).
+	Distribution QosDistribution
+
+	// Consumers is the number of consumers of the queue, among which PrefetchCount is divided
+	// with QosDividedAmongConsumers. When zero, it's treated as a single consumer.
+	Consumers int
+
 	// With a prefetch size greater than zero, the server will try to keep at least
 	// that many bytes of deliveries flushed to the network before receiving
 	// acknowledgments from the consumers.  This option is ignored when consumers are
 	// started with noAck.
+	//
+	// RabbitMQ doesn't support prefetch size, it closes the connection with NOT_IMPLEMENTED error
+	// when it's set. So when the broker reports itself as RabbitMQ, PrefetchSize is not sent
+	// and a warning is logged instead. Other brokers receive it as configured.
 	PrefetchSize int
 
 	// When global is true, these Qos settings apply to all existing and future
@@ -462,14 +1560,77 @@ type QosConfig struct {
 	// how the global flag is implemented in RabbitMQ, as it differs from the
 	// AMQP 0.9.1 specification in that global Qos settings are limited in scope to
 	// channels, not connections (https://www.rabbitmq.com/consumer-prefetch.html).
+	//
+	// Every subscription (including every topic of SubscribeMulti) consumes from its own channel,
+	// so with RabbitMQ Global applies the limit to every subscription separately, as when it's false.
+	// There is no connection-wide prefetch limit: the total number of unacknowledged messages
+	// of the Subscriber is up to PrefetchCount multiplied by the number of subscriptions.
+	// Subscriber logs a warning, when Global is set and more than one subscription is running.
 	Global bool
 }
 
+// QosDistribution tells how QosConfig.PrefetchCount is applied to consumers, see QosConfig.Distribution.
+type QosDistribution int
+
+const (
+	// QosPerConsumer applies PrefetchCount to every consumer, so the total number of unacknowledged
+	// messages grows with the number of consumers.
+	QosPerConsumer QosDistribution = iota
+	// QosDividedAmongConsumers interprets PrefetchCount as the total for all consumers.
+	// Every consumer's prefetch count is PrefetchCount divided by QosConfig.Consumers, rounded down
+	// (so the total is never exceeded), but at least 1 (because zero means no limit).
+	//
+	// For example, PrefetchCount 10 with 3 consumers gives prefetch count 3 to every consumer (9 in total),
+	// with 20 consumers every consumer gets prefetch count 1 (20 in total).
+	QosDividedAmongConsumers
+)
+
+// prefetchSize returns PrefetchSize, which is sent to the broker with serverProperties.
+// supported is false, when PrefetchSize is set, but it's not supported by the broker (RabbitMQ), zero is returned then.
+func (q QosConfig) prefetchSize(serverProperties amqp.Table) (size int, supported bool) {
+	if q.PrefetchSize > 0 && isRabbitMQ(serverProperties) {
+		return 0, false
+	}
+
+	return q.PrefetchSize, true
+}
+
+// isRabbitMQ returns true when the broker's server properties have "product" set to "RabbitMQ".
+func isRabbitMQ(serverProperties amqp.Table) bool {
+	product, _ := serverProperties["product"].(string)
+	return product == "RabbitMQ"
+}
+
+// prefetchCount returns the prefetch count of the single consumer according to Distribution.
+func (q QosConfig) prefetchCount() int {
+	if q.Distribution != QosDividedAmongConsumers || q.PrefetchCount <= 0 || q.Consumers <= 1 {
+		return q.PrefetchCount
+	}
+
+	prefetchCount := q.PrefetchCount / q.Consumers
+	if prefetchCount < 1 {
+		return 1
+	}
+
+	return prefetchCount
+}
+
 type ReconnectConfig struct {
 	BackoffInitialInterval     time.Duration
 	BackoffRandomizationFactor float64
 	BackoffMultiplier          float64
 	BackoffMaxInterval         time.Duration
+
+	// MaxAttempts is the maximum number of consecutive failed attempts to reconnect to AMQP
+	// or to restart consuming of the subscription. When zero, reconnect is retried until the Pub/Sub is closed.
+	//
+	// When the connection cannot be reestablished, it's not reconnected anymore and all subscriptions are stopped.
+	// When consuming cannot be restarted, the subscription is stopped. The output channel of the stopped
+	// subscription is closed and the error is returned by Subscription.Err (see also Subscriber.SubscribeWithErrors),
+	// so the application can crash and restart instead of waiting forever.
+	//
+	// It's not used by PublishRetryConfig.Backoff, which has its own MaxAttempts.
+	MaxAttempts int
 }
 
 func DefaultReconnectConfig() *ReconnectConfig {
@@ -481,13 +1642,17 @@ func DefaultReconnectConfig() *ReconnectConfig {
 	}
 }
 
+func (r ReconnectConfig) attemptsExhausted(failedAttempts int) bool {
+	return r.MaxAttempts > 0 && failedAttempts >= r.MaxAttempts
+}
+
 func (r ReconnectConfig) backoffConfig() *backoff.ExponentialBackOff {
 	return &backoff.ExponentialBackOff{
 		InitialInterval:     r.BackoffInitialInterval,
 		RandomizationFactor: r.BackoffRandomizationFactor,
 		Multiplier:          r.BackoffMultiplier,
 		MaxInterval:         r.BackoffMaxInterval,
-		MaxElapsedTime:      0, // no support for disabling reconnect, only close of Pub/Sub can stop reconnecting
+		MaxElapsedTime:      0, // reconnect is stopped only by close of Pub/Sub or by MaxAttempts
 		Clock:               backoff.SystemClock,
 	}
 }
@@ -0,0 +1,446 @@
+package amqp_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	stdAmqp "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ThreeDotsLabs/watermill-amqp/pkg/amqp"
+)
+
+func TestConfig_ValidateTopic(t *testing.T) {
+	testCases := []struct {
+		Name  string
+		Topic string
+		Valid bool
+	}{
+		{
+			Name:  "valid",
+			Topic: "topic_name-1.2:3",
+			Valid: true,
+		},
+		{
+			Name:  "too_long",
+			Topic: strings.Repeat("a", 256),
+			Valid: false,
+		},
+		{
+			Name:  "max_length",
+			Topic: strings.Repeat("a", 250),
+			Valid: true,
+		},
+		{
+			Name:  "slash_and_space",
+			Topic: "tenant/topic name",
+			Valid: true,
+		},
+		{
+			Name:  "invalid_utf8",
+			Topic: "topic\xff",
+			Valid: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			config := amqp.NewDurablePubSubConfig("amqp://", amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+
+			err := config.ValidateTopic(tc.Topic)
+			if tc.Valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestConfig_ValidateTopic_routing_key(t *testing.T) {
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Publish.GenerateRoutingKey = func(topic string) string {
+		return strings.Repeat(topic, 300)
+	}
+
+	assert.Error(t, config.ValidateTopic("a"))
+}
+
+func TestConfig_ValidateTopology(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config func() amqp.Config
+		Valid  bool
+	}{
+		{
+			Name: "durable_pubsub",
+			Config: func() amqp.Config {
+				return amqp.NewDurablePubSubConfig("amqp://", amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+			},
+			Valid: true,
+		},
+		{
+			Name: "quorum_queue",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.Arguments = stdAmqp.Table{"x-queue-type": "quorum"}
+				return config
+			},
+			Valid: true,
+		},
+		{
+			Name: "quorum_exclusive_queue",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.Arguments = stdAmqp.Table{"x-queue-type": "quorum"}
+				config.Queue.Exclusive = true
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "non_durable_stream_queue",
+			Config: func() amqp.Config {
+				config := amqp.NewNonDurableQueueConfig("amqp://")
+				config.Queue.Arguments = stdAmqp.Table{"x-queue-type": "stream"}
+				config.Consume.Qos.PrefetchCount = 10
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "stream_queue_without_prefetch",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.Arguments = stdAmqp.Table{"x-queue-type": "stream"}
+				config.Consume.Qos.PrefetchCount = 0
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "lazy_queue",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.Lazy = true
+				return config
+			},
+			Valid: true,
+		},
+		{
+			Name: "lazy_quorum_queue",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.Arguments = stdAmqp.Table{"x-queue-type": "quorum"}
+				config.Queue.Lazy = true
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "unknown_queue_type",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.Arguments = stdAmqp.Table{"x-queue-type": "foo"}
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "headers_exchange_without_bind_arguments",
+			Config: func() amqp.Config {
+				config := amqp.NewDurablePubSubConfig("amqp://", amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+				config.Exchange.Type = "headers"
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "extra_binding_to_default_exchange",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.QueueBind.ExtraBindings = []amqp.ExchangeBinding{{RoutingKey: "foo"}}
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "extra_binding_with_unknown_exchange_type",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.QueueBind.ExtraBindings = []amqp.ExchangeBinding{{Exchange: "events", ExchangeType: "foo"}}
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "extra_binding_to_not_declared_exchange",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.QueueBind.ExtraBindings = []amqp.ExchangeBinding{{Exchange: "events", RoutingKey: "foo"}}
+				return config
+			},
+			Valid: true,
+		},
+		{
+			Name: "plugin_exchange_type",
+			Config: func() amqp.Config {
+				config := amqp.NewDurablePubSubConfig("amqp://", amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+				config.Exchange.Type = "x-delayed-message"
+				return config
+			},
+			Valid: true,
+		},
+		{
+			Name: "unknown_exchange_type",
+			Config: func() amqp.Config {
+				config := amqp.NewDurablePubSubConfig("amqp://", amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+				config.Exchange.Type = "foo"
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "consumer_timeout",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.ConsumerTimeout = time.Minute
+				config.Consume.AckBatch = amqp.AckBatchConfig{MaxCount: 10, MaxDelay: time.Second}
+				return config
+			},
+			Valid: true,
+		},
+		{
+			Name: "ack_batch_delay_longer_than_consumer_timeout",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.ConsumerTimeout = time.Second
+				config.Consume.AckBatch = amqp.AckBatchConfig{MaxCount: 10, MaxDelay: time.Minute}
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "max_length_with_reject_publish",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.MaxLength = 100
+				config.Queue.Overflow = amqp.QueueOverflowRejectPublish
+				return config
+			},
+			Valid: true,
+		},
+		{
+			Name: "negative_max_length_bytes",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.MaxLengthBytes = -1
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "overflow_without_max_length",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.Overflow = amqp.QueueOverflowDropHead
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "invalid_overflow_argument",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.Arguments = stdAmqp.Table{"x-max-length": int64(100), "x-overflow": "drop-tail"}
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "reject_publish_dlx_quorum_queue",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.Arguments = stdAmqp.Table{"x-queue-type": "quorum"}
+				config.Queue.MaxLength = 100
+				config.Queue.Overflow = amqp.QueueOverflowRejectPublishDLX
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "unregistered_plugin_exchange_type",
+			Config: func() amqp.Config {
+				config := amqp.NewDurablePubSubConfig("amqp://", amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+				config.Exchange.Type = "x-unregistered"
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "deduplication_exchange",
+			Config: func() amqp.Config {
+				config := amqp.NewDurablePubSubConfig("amqp://", amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+				config.Exchange.Type = amqp.DeduplicationExchangeType
+				config.Exchange.DeduplicationCacheSize = 1000
+				return config
+			},
+			Valid: true,
+		},
+		{
+			Name: "deduplication_exchange_without_cache_size",
+			Config: func() amqp.Config {
+				config := amqp.NewDurablePubSubConfig("amqp://", amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+				config.Exchange.Type = amqp.DeduplicationExchangeType
+				return config
+			},
+			Valid: false,
+		},
+		{
+			Name: "dead_letter_routing_key_without_exchange",
+			Config: func() amqp.Config {
+				config := amqp.NewDurableQueueConfig("amqp://")
+				config.Queue.DeadLetterRoutingKey = "dlq"
+				return config
+			},
+			Valid: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			err := tc.Config().ValidateTopology()
+			if tc.Valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestConfig_ValidateTopology_queue_type_not_string(t *testing.T) {
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Queue.Arguments = stdAmqp.Table{"x-queue-type": 1}
+
+	err := config.ValidateTopology()
+	require.IsType(t, &multierror.Error{}, err)
+	require.Len(t, err.(*multierror.Error).Errors, 1)
+	assert.EqualError(t, err.(*multierror.Error).Errors[0], "x-queue-type argument must be a string, got int")
+}
+
+func TestRegisterExchangeType(t *testing.T) {
+	config := amqp.NewDurablePubSubConfig("amqp://", amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+	config.Exchange.Type = "x-registered"
+
+	err := config.ValidateSubscriber()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "allowed types: direct, fanout, headers, topic")
+	}
+	assert.Error(t, config.ValidatePublisher())
+
+	amqp.RegisterExchangeType(config.Exchange.Type)
+
+	assert.NoError(t, config.ValidateSubscriber())
+	assert.NoError(t, config.ValidatePublisher())
+	assert.NoError(t, config.ValidateTopology())
+}
+
+func TestNewDurableConsistentHashConfig(t *testing.T) {
+	config := amqp.NewDurableConsistentHashConfig(
+		"amqp://",
+		func(topic string) []string {
+			return []string{topic + "_1", topic + "_2"}
+		},
+		map[string]int{"topic_2": 3},
+		"partition_key",
+	)
+
+	assert.NoError(t, config.ValidatePublisher())
+	assert.NoError(t, config.ValidateSubscriber())
+	assert.NoError(t, config.ValidateTopology())
+
+	assert.Equal(t, "topic_1", config.Queue.GenerateName("topic"))
+	assert.Equal(t, "1", config.QueueBind.GenerateRoutingKey("topic_1"))
+	assert.Equal(t, "3", config.QueueBind.GenerateRoutingKey("topic_2"))
+
+	config.Exchange.GenerateRoutingKey = func(topic string) string {
+		return topic
+	}
+	assert.Error(t, config.ValidateTopology())
+}
+
+func TestConfig_role_marshalers(t *testing.T) {
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Marshaler = nil
+	config.PublishMarshaler = amqp.GzipMarshaler{}
+
+	assert.NoError(t, config.ValidatePublisher())
+	assert.Error(t, config.ValidateSubscriber())
+
+	config.ConsumeMarshaler = amqp.DefaultMarshaler{}
+
+	assert.NoError(t, config.ValidatePublisher())
+	assert.NoError(t, config.ValidateSubscriber())
+}
+
+func TestConfig_sync_ack_with_ack_batch(t *testing.T) {
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Consume.SyncAck = true
+	assert.NoError(t, config.ValidateSubscriber())
+
+	config.Consume.AckBatch = amqp.AckBatchConfig{MaxCount: 10, MaxDelay: time.Second}
+	assert.Error(t, config.ValidateSubscriber())
+}
+
+func TestConfig_default_exchange_routing_key(t *testing.T) {
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Publish.GenerateRoutingKey = nil
+	assert.NoError(t, config.ValidatePublisher())
+
+	config.Queue.GenerateName = nil
+	assert.Error(t, config.ValidatePublisher())
+}
+
+func TestConfig_retry_priority_bump(t *testing.T) {
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Consume.Retry = amqp.RetryConfig{MaxRetries: 3, PriorityBump: 1}
+	assert.Error(t, config.ValidateSubscriber())
+
+	config.Queue.Arguments = stdAmqp.Table{"x-max-priority": int32(5)}
+	assert.NoError(t, config.ValidateSubscriber())
+}
+
+func TestConfig_reuse_topology_channel(t *testing.T) {
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Consume.ReuseTopologyChannel = true
+	assert.NoError(t, config.ValidateSubscriber())
+
+	config.QueueBind.ExtraBindings = []amqp.ExchangeBinding{
+		{Exchange: "events", ExchangeType: stdAmqp.ExchangeFanout, ExchangeNoWait: true},
+	}
+	assert.Error(t, config.ValidateSubscriber())
+
+	config.QueueBind.ExtraBindings = nil
+	config.QueueBind.NoWait = true
+	assert.Error(t, config.ValidateSubscriber())
+}
+
+func TestConfig_negative_prefetch_size(t *testing.T) {
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Consume.Qos.PrefetchSize = -1
+	assert.Error(t, config.ValidateSubscriber())
+}
+
+func TestConfig_queue_overflow(t *testing.T) {
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Queue.MaxLength = 100
+	config.Queue.Overflow = amqp.QueueOverflowRejectPublishDLX
+	assert.NoError(t, config.ValidateSubscriber())
+
+	config.Queue.Overflow = "drop-tail"
+	assert.Error(t, config.ValidateSubscriber())
+}
@@ -1,7 +1,9 @@
 package amqp
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 
 	"github.com/cenkalti/backoff/v3"
 	"github.com/pkg/errors"
@@ -11,17 +13,36 @@ import (
 )
 
 type connectionWrapper struct {
+	// openedChannels and closedChannels are accessed atomically, they are first to be 64-bit aligned
+	openedChannels int64
+	closedChannels int64
+
 	config Config
 
 	logger watermill.LoggerAdapter
 
-	amqpConnection     *amqp.Connection
+	amqpConnection     AMQPConnection
 	amqpConnectionLock sync.Mutex
 	connected          chan struct{}
+	// reconnectExhausted is closed when ReconnectConfig.MaxAttempts were exceeded and the connection is not reconnected anymore
+	reconnectExhausted chan struct{}
+	// lastURIIndex is the index of the URI from ConnectionConfig.uris() used by the last successful connection
+	lastURIIndex int
+
+	lastError     error
+	lastErrorLock sync.RWMutex
+
+	blocked          bool
+	blockedListeners []chan amqp.Blocking
+	blockedLock      sync.RWMutex
 
 	publishBindingsLock     sync.RWMutex
 	publishBindingsPrepared map[string]struct{}
 
+	// externalConnection is true when the connection was provided by the user (see newExistingConnection),
+	// it's not closed by Close and it's not reconnected
+	externalConnection bool
+
 	closing chan struct{}
 	closed  bool
 
@@ -38,10 +59,11 @@ func newConnection(
 	}
 
 	pubSub := &connectionWrapper{
-		config:    config,
-		logger:    logger,
-		closing:   make(chan struct{}),
-		connected: make(chan struct{}),
+		config:             config,
+		logger:             logger,
+		closing:            make(chan struct{}),
+		connected:          make(chan struct{}),
+		reconnectExhausted: make(chan struct{}),
 	}
 	if err := pubSub.connect(); err != nil {
 		return nil, err
@@ -52,6 +74,42 @@ func newConnection(
 	return pubSub, nil
 }
 
+// newExistingConnection wraps the connection managed by the user.
+// The connection is not closed by Close and it's not reconnected when closed.
+func newExistingConnection(
+	connection *amqp.Connection,
+	config Config,
+	logger watermill.LoggerAdapter,
+) (*connectionWrapper, error) {
+	if connection == nil {
+		return nil, errors.New("connection cannot be nil")
+	}
+	if connection.IsClosed() {
+		return nil, errors.New("connection is closed")
+	}
+	if logger == nil {
+		logger = watermill.NopLogger{}
+	}
+
+	pubSub := &connectionWrapper{
+		config:             config,
+		logger:             logger,
+		closing:            make(chan struct{}),
+		connected:          make(chan struct{}),
+		reconnectExhausted: make(chan struct{}),
+		amqpConnection:     streadwayConnection{connection},
+		externalConnection: true,
+	}
+
+	go pubSub.handleBlocked(connection.NotifyBlocked(make(chan amqp.Blocking, 1)))
+	notifyCloseConnection := connection.NotifyClose(make(chan *amqp.Error, 1))
+	close(pubSub.connected)
+
+	go pubSub.handleExternalConnectionClose(notifyCloseConnection)
+
+	return pubSub, nil
+}
+
 func (c *connectionWrapper) Close() error {
 	if c.closed {
 		return nil
@@ -64,7 +122,10 @@ func (c *connectionWrapper) Close() error {
 
 	c.publishingWg.Wait()
 
-	if err := c.amqpConnection.Close(); err != nil {
+	if c.externalConnection {
+		// connection is managed by the user, channels are closed by stopped subscriptions
+		c.logger.Debug("Not closing connection provided by the user", nil)
+	} else if err := c.amqpConnection.Close(); err != nil {
 		c.logger.Error("Connection close error", err, nil)
 	}
 
@@ -82,29 +143,156 @@ func (c *connectionWrapper) connect() error {
 		return errors.New("both Config.AmqpConfig.TLSClientConfig and Config.TLSConfig are set")
 	}
 
-	var connection *amqp.Connection
-	var err error
+	uris, err := c.config.Connection.urisWithCredentials()
+	if err != nil {
+		c.setLastError(err)
+		return err
+	}
 
-	if amqpConfig != nil {
-		connection, err = amqp.DialConfig(c.config.Connection.AmqpURI, *c.config.Connection.AmqpConfig)
-	} else if c.config.Connection.TLSConfig != nil {
-		connection, err = amqp.DialTLS(c.config.Connection.AmqpURI, c.config.Connection.TLSConfig)
-	} else {
-		connection, err = amqp.Dial(c.config.Connection.AmqpURI)
+	var connection AMQPConnection
+
+	// starting from the URI which succeeded the last time
+	for i := 0; i < len(uris); i++ {
+		uriIndex := (c.lastURIIndex + i) % len(uris)
+
+		connection, err = c.dial(uris[uriIndex])
+		if err == nil {
+			c.lastURIIndex = uriIndex
+			break
+		}
+
+		if len(uris) > 1 {
+			c.logger.Error("Cannot connect to AMQP URI, trying next one", err, watermill.LogFields{
+				"amqp_uri_index": uriIndex,
+			})
+		}
 	}
 
 	if err != nil {
-		return errors.Wrap(err, "cannot connect to AMQP")
+		err = errors.Wrap(err, "cannot connect to AMQP")
+		c.setLastError(err)
+		return err
 	}
+
+	// OnReconnect receives *amqp.Connection, so it's not called for connections from ConnectionConfig.Dial
+	if amqpConnection, err := StreadwayConnection(connection); c.config.Connection.OnReconnect != nil && err == nil {
+		if err := c.config.Connection.OnReconnect(amqpConnection); err != nil {
+			err = errors.Wrap(err, "Config.Connection.OnReconnect failed")
+			if closeErr := connection.Close(); closeErr != nil {
+				c.logger.Error("Cannot close connection after OnReconnect failure", closeErr, nil)
+			}
+			c.setLastError(err)
+			return err
+		}
+	}
+
 	c.amqpConnection = connection
+	c.setLastError(nil)
+	// new connection is not blocked until the broker notifies otherwise
+	c.setBlocked(amqp.Blocking{Active: false})
+	go c.handleBlocked(connection.NotifyBlocked(make(chan amqp.Blocking, 1)))
 	close(c.connected)
 
-	c.logger.Info("Connected to AMQP", nil)
+	c.logger.Info("Connected to AMQP", watermill.LogFields{"amqp_uri_index": c.lastURIIndex})
 
 	return nil
 }
 
-func (c *connectionWrapper) Connection() *amqp.Connection {
+func (c *connectionWrapper) dial(amqpURI string) (AMQPConnection, error) {
+	if c.config.Connection.Dial != nil {
+		return c.config.Connection.Dial(amqpURI)
+	}
+
+	var connection *amqp.Connection
+	var err error
+
+	if c.config.Connection.AmqpConfig != nil {
+		connection, err = amqp.DialConfig(amqpURI, *c.config.Connection.AmqpConfig)
+	} else if c.config.Connection.TLSConfig != nil {
+		connection, err = amqp.DialTLS(amqpURI, c.config.Connection.TLSConfig)
+	} else {
+		connection, err = amqp.Dial(amqpURI)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return streadwayConnection{connection}, nil
+}
+
+// LastError returns the last error of connecting to AMQP or the error with which the connection was closed.
+// It's cleared when the connection is established.
+func (c *connectionWrapper) LastError() error {
+	c.lastErrorLock.RLock()
+	defer c.lastErrorLock.RUnlock()
+
+	return c.lastError
+}
+
+func (c *connectionWrapper) setLastError(err error) {
+	c.lastErrorLock.Lock()
+	defer c.lastErrorLock.Unlock()
+
+	c.lastError = err
+}
+
+// Blocked returns true when the broker blocked publishing on the connection (connection.blocked),
+// for example because of memory or disk alarm.
+// Publishing on the blocked connection hangs until the connection is unblocked.
+func (c *connectionWrapper) Blocked() bool {
+	c.blockedLock.RLock()
+	defer c.blockedLock.RUnlock()
+
+	return c.blocked
+}
+
+// NotifyBlocked registers a listener for connection blocked and unblocked notifications.
+// Notifications are preserved across reconnects.
+//
+// Notifications are sent without blocking, so the listener should be buffered.
+// Notification is dropped when the listener is full.
+func (c *connectionWrapper) NotifyBlocked(listener chan amqp.Blocking) chan amqp.Blocking {
+	c.blockedLock.Lock()
+	defer c.blockedLock.Unlock()
+
+	c.blockedListeners = append(c.blockedListeners, listener)
+
+	return listener
+}
+
+func (c *connectionWrapper) handleBlocked(notifyBlocked chan amqp.Blocking) {
+	// notifyBlocked is closed when the connection is closed
+	for blocking := range notifyBlocked {
+		if blocking.Active {
+			c.logger.Info("AMQP connection blocked by the broker", watermill.LogFields{"reason": blocking.Reason})
+		} else {
+			c.logger.Info("AMQP connection unblocked by the broker", nil)
+		}
+
+		c.setBlocked(blocking)
+	}
+}
+
+func (c *connectionWrapper) setBlocked(blocking amqp.Blocking) {
+	c.blockedLock.Lock()
+	defer c.blockedLock.Unlock()
+
+	if c.blocked == blocking.Active {
+		return
+	}
+	c.blocked = blocking.Active
+
+	for _, listener := range c.blockedListeners {
+		select {
+		case listener <- blocking:
+		default:
+		}
+	}
+}
+
+// Connection returns the current connection to the AMQP broker.
+// The *amqp.Connection of connections dialed with github.com/streadway/amqp is returned by StreadwayConnection.
+func (c *connectionWrapper) Connection() AMQPConnection {
 	return c.amqpConnection
 }
 
@@ -112,6 +300,27 @@ func (c *connectionWrapper) Connected() chan struct{} {
 	return c.connected
 }
 
+// WaitForConnection blocks until the connection to the AMQP broker is established,
+// ctx is done or Pub/Sub is closed.
+// It is useful after reconnect, to not poll IsConnected.
+func (c *connectionWrapper) WaitForConnection(ctx context.Context) error {
+	// connected is not reset by Close, so closing must be checked first
+	select {
+	case <-c.closing:
+		return errors.New("pub/sub is closed")
+	default:
+	}
+
+	select {
+	case <-c.Connected():
+		return nil
+	case <-c.closing:
+		return errors.New("pub/sub is closed")
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "not connected to AMQP")
+	}
+}
+
 func (c *connectionWrapper) IsConnected() bool {
 	select {
 	case <-c.connected:
@@ -121,6 +330,77 @@ func (c *connectionWrapper) IsConnected() bool {
 	}
 }
 
+// Healthy returns nil when connection to the AMQP broker is established.
+// It is suitable for readiness probes.
+//
+// When Config.Connection.HealthCheckOpenChannel is true, a channel is opened and closed
+// to prove that the connection is live.
+func (c *connectionWrapper) Healthy() error {
+	if c.closed {
+		return errors.New("pub/sub is closed")
+	}
+
+	if !c.IsConnected() {
+		return errors.New("not connected to AMQP")
+	}
+
+	if !c.config.Connection.HealthCheckOpenChannel {
+		return nil
+	}
+
+	channel, err := c.openChannel()
+	if err != nil {
+		return errors.Wrap(err, "cannot open channel")
+	}
+
+	if err := c.closeChannel(channel); err != nil {
+		return errors.Wrap(err, "cannot close channel")
+	}
+
+	return nil
+}
+
+// ChannelStats contains the number of AMQP channels opened and closed by the publisher or subscriber.
+type ChannelStats struct {
+	Opened int64
+	Closed int64
+}
+
+// Open returns the number of channels, which were opened and not closed yet.
+func (s ChannelStats) Open() int64 {
+	return s.Opened - s.Closed
+}
+
+// ChannelStats returns the number of AMQP channels opened and closed since the publisher or subscriber was created.
+//
+// It's intended for debugging and detecting leaks of channels in tests: when all publishing is finished
+// and subscriptions are stopped, ChannelStats().Open() should be zero.
+// Channels closed because of connection loss are not counted as closed, until they are closed explicitly.
+func (c *connectionWrapper) ChannelStats() ChannelStats {
+	return ChannelStats{
+		Opened: atomic.LoadInt64(&c.openedChannels),
+		Closed: atomic.LoadInt64(&c.closedChannels),
+	}
+}
+
+// openChannel opens a new channel, it must be closed with closeChannel.
+func (c *connectionWrapper) openChannel() (AMQPChannel, error) {
+	channel, err := c.amqpConnection.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt64(&c.openedChannels, 1)
+	return channel, nil
+}
+
+// closeChannel closes the channel opened with openChannel.
+// Channel is counted as closed even when closing fails, because it cannot be used anymore.
+func (c *connectionWrapper) closeChannel(channel AMQPChannel) error {
+	atomic.AddInt64(&c.closedChannels, 1)
+	return channel.Close()
+}
+
 func (c *connectionWrapper) handleConnectionClose() {
 	for {
 		c.logger.Debug("handleConnectionClose is waiting for p.connected", nil)
@@ -135,17 +415,39 @@ func (c *connectionWrapper) handleConnectionClose() {
 			return
 		case err := <-notifyCloseConnection:
 			c.connected = make(chan struct{})
+			if err != nil {
+				c.setLastError(err)
+			}
 			c.logger.Error("Received close notification from AMQP, reconnecting", err, nil)
-			c.reconnect()
+			if !c.reconnect() {
+				return
+			}
 		}
 	}
 }
 
-func (c *connectionWrapper) reconnect() {
-	reconnectConfig := c.config.Connection.Reconnect
-	if reconnectConfig == nil {
-		reconnectConfig = DefaultReconnectConfig()
+// handleExternalConnectionClose marks the connection provided by the user as disconnected, when it's closed.
+// It's not reconnected, because the connection is managed by the user.
+func (c *connectionWrapper) handleExternalConnectionClose(notifyCloseConnection chan *amqp.Error) {
+	select {
+	case <-c.closing:
+		c.logger.Debug("Stopping handleExternalConnectionClose", nil)
+	case err := <-notifyCloseConnection:
+		c.connected = make(chan struct{})
+		if err == nil {
+			c.setLastError(errors.New("connection provided by the user was closed"))
+		} else {
+			c.setLastError(err)
+		}
+		c.logger.Error("Connection provided by the user was closed, it will not be reconnected", err, nil)
 	}
+}
+
+// reconnect reconnects to AMQP until it succeeds, the Pub/Sub is closed or ReconnectConfig.MaxAttempts are exceeded.
+// It returns false when the connection was not reestablished.
+func (c *connectionWrapper) reconnect() bool {
+	reconnectConfig := c.config.Connection.reconnectConfig()
+	failedAttempts := 0
 
 	if err := backoff.Retry(func() error {
 		err := c.connect()
@@ -153,15 +455,31 @@ func (c *connectionWrapper) reconnect() {
 			return nil
 		}
 
-		c.logger.Error("Cannot reconnect to AMQP, retrying", err, nil)
-
 		if c.closed {
 			return backoff.Permanent(errors.Wrap(err, "closing AMQP connection"))
 		}
 
+		failedAttempts++
+		if reconnectConfig.attemptsExhausted(failedAttempts) {
+			return backoff.Permanent(errors.Wrapf(ErrReconnectAttemptsExhausted, "after %d attempts: %s", failedAttempts, err))
+		}
+
+		c.logger.Error("Cannot reconnect to AMQP, retrying", err, nil)
+
 		return err
 	}, reconnectConfig.backoffConfig()); err != nil {
-		// should only exit, if closing Pub/Sub
-		c.logger.Error("AMQP reconnect failed failed", err, nil)
+		c.logger.Error("AMQP reconnect failed", err, nil)
+
+		if errors.Cause(err) == ErrReconnectAttemptsExhausted {
+			c.setLastError(err)
+			close(c.reconnectExhausted)
+		}
+		return false
 	}
+
+	return true
 }
+
+// ErrReconnectAttemptsExhausted is the cause of the error, with which the connection or the subscription is stopped,
+// when ReconnectConfig.MaxAttempts were exceeded.
+var ErrReconnectAttemptsExhausted = errors.New("reconnect attempts exhausted")
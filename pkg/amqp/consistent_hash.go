@@ -0,0 +1,62 @@
+package amqp
+
+import (
+	"strconv"
+)
+
+// ConsistentHashExchangeType is the type of the exchange provided by the rabbitmq_consistent_hash_exchange plugin.
+//
+// Consistent-hash exchange routes the message to one of the bound queues, based on the hash of the routing key.
+// Binding key is not matched with the routing key, it's the weight of the queue (number of hash ring points).
+const ConsistentHashExchangeType = "x-consistent-hash"
+
+// ConsistentHashBindingWeights returns QueueBindConfig.GenerateRoutingKey for the consistent-hash exchange.
+// Queue is bound with the weight from weights as the binding key. Queues missing in weights
+// (or with non-positive weight) are bound with weight 1.
+//
+// Queue with a higher weight receives proportionally more messages (partition keys).
+func ConsistentHashBindingWeights(weights map[string]int) func(queueName string) string {
+	return func(queueName string) string {
+		weight, ok := weights[queueName]
+		if !ok || weight < 1 {
+			weight = 1
+		}
+
+		return strconv.Itoa(weight)
+	}
+}
+
+// NewDurableConsistentHashConfig creates config for the topic partitioned by the key to multiple queues.
+// Messages with the same partition key are routed to the same queue, so they can be processed in order,
+// while the topic is consumed by multiple consumers.
+//
+// Exchange name is set to the topic name and the exchange is declared as durable consistent-hash exchange
+// (see ConsistentHashExchangeType). Every queue returned by generateQueueNames is declared as durable
+// and bound with the weight from weights (see ConsistentHashBindingWeights).
+// Routing key (partition key) is set from the message metadata with partitionKeyMetadataKey
+// (see PublishConfig.RoutingKeyMetadataKey), messages without it are routed with the empty routing key.
+//
+// Subscribe consumes from all queues. To scale consumers, every consumer can consume a single queue
+// with SubscribeQueue (after the topology is declared with SubscribeInitialize). Per-key order is kept
+// when every queue has a single consumer (see QueueConfig.SingleActiveConsumer) processing messages in order.
+func NewDurableConsistentHashConfig(
+	amqpURI string,
+	generateQueueNames func(topic string) []string,
+	weights map[string]int,
+	partitionKeyMetadataKey string,
+) Config {
+	config := NewDurablePubSubConfig(amqpURI, func(topic string) string {
+		// used by Get, PurgeQueue and DeleteQueue
+		if names := generateQueueNames(topic); len(names) > 0 {
+			return names[0]
+		}
+		return ""
+	})
+
+	config.Exchange.Type = ConsistentHashExchangeType
+	config.Queue.GenerateNames = generateQueueNames
+	config.QueueBind.GenerateRoutingKey = ConsistentHashBindingWeights(weights)
+	config.Publish.RoutingKeyMetadataKey = partitionKeyMetadataKey
+
+	return config
+}
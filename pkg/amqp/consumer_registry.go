@@ -0,0 +1,110 @@
+package amqp
+
+import (
+	"sync"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+// errConsumerCancelled is returned by ProcessMessages, when the consumer was cancelled with Subscriber.CancelConsumer.
+var errConsumerCancelled = errors.New("consumer cancelled")
+
+// consumerRegistry tracks channels of running consumers by their consumer tags.
+type consumerRegistry struct {
+	consumers map[string][]*registeredConsumer
+	lock      sync.Mutex
+}
+
+type registeredConsumer struct {
+	channel AMQPChannel
+
+	// cancelled is true when the consumer was cancelled with Subscriber.CancelConsumer
+	cancelled     bool
+	cancelledLock sync.Mutex
+}
+
+func (c *registeredConsumer) markCancelled() {
+	c.cancelledLock.Lock()
+	defer c.cancelledLock.Unlock()
+
+	c.cancelled = true
+}
+
+func (c *registeredConsumer) isCancelled() bool {
+	c.cancelledLock.Lock()
+	defer c.cancelledLock.Unlock()
+
+	return c.cancelled
+}
+
+func newConsumerRegistry() *consumerRegistry {
+	return &consumerRegistry{consumers: map[string][]*registeredConsumer{}}
+}
+
+// register adds the consumer, returned func removes it.
+func (r *consumerRegistry) register(tag string, channel AMQPChannel) (*registeredConsumer, func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	consumer := &registeredConsumer{channel: channel}
+	r.consumers[tag] = append(r.consumers[tag], consumer)
+
+	return consumer, func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+
+		consumers := r.consumers[tag]
+		for i := range consumers {
+			if consumers[i] == consumer {
+				r.consumers[tag] = append(consumers[:i:i], consumers[i+1:]...)
+				break
+			}
+		}
+		if len(r.consumers[tag]) == 0 {
+			delete(r.consumers, tag)
+		}
+	}
+}
+
+func (r *consumerRegistry) get(tag string) []*registeredConsumer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]*registeredConsumer(nil), r.consumers[tag]...)
+}
+
+// CancelConsumer stops the consumer with the tag (see ConsumeConfig.Consumer and Subscription.ConsumerTag)
+// with basic.cancel, while keeping the connection open.
+//
+// The broker stops sending new deliveries to the consumer, but messages which were already delivered
+// are processed and acked as usual, unlike Subscription.Cancel, which nacks them.
+// When all delivered messages are acked or nacked, the subscription is stopped and its output channel is closed.
+// The subscription is not restarted after reconnect.
+//
+// When ConsumeConfig.Consumer is set, all subscriptions of the Subscriber are using the same tag
+// and all of them are cancelled.
+func (s *Subscriber) CancelConsumer(tag string) error {
+	consumers := s.consumers.get(tag)
+	if len(consumers) == 0 {
+		return errors.Errorf("no running consumer with tag %s", tag)
+	}
+
+	var err error
+	for _, consumer := range consumers {
+		consumer.markCancelled()
+
+		if cancelErr := consumer.channel.Cancel(tag, s.config.Consume.NoWait); cancelErr != nil {
+			err = multierror.Append(err, errors.Wrap(cancelErr, "cannot cancel consumer"))
+		}
+	}
+
+	s.logger.Info("Consumer cancelled", watermill.LogFields{
+		"amqp_consumer_tag": tag,
+		"consumers":         len(consumers),
+	})
+
+	return err
+}
@@ -0,0 +1,57 @@
+package amqp
+
+import (
+	"context"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+type ctxKey int
+
+const (
+	deliveryContextKey ctxKey = iota
+)
+
+// deliveryHolder holds the delivery until the message is acked or nacked.
+type deliveryHolder struct {
+	lock     sync.RWMutex
+	delivery *amqp.Delivery
+}
+
+func (h *deliveryHolder) get() (amqp.Delivery, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	if h.delivery == nil {
+		return amqp.Delivery{}, false
+	}
+
+	return *h.delivery, true
+}
+
+func (h *deliveryHolder) release() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.delivery = nil
+}
+
+func contextWithDelivery(ctx context.Context, delivery amqp.Delivery) (context.Context, *deliveryHolder) {
+	holder := &deliveryHolder{delivery: &delivery}
+	return context.WithValue(ctx, deliveryContextKey, holder), holder
+}
+
+// DeliveryFromContext returns the raw AMQP delivery of the consumed message from the message's context.
+// It gives access to fields, which are not part of the message metadata (like ConsumerTag, DeliveryTag or Exchange).
+//
+// The delivery is available only until the message is acked or nacked.
+// It should be used only for reading, acking or nacking the delivery directly breaks ack handling of the Subscriber.
+func DeliveryFromContext(ctx context.Context) (amqp.Delivery, bool) {
+	holder, ok := ctx.Value(deliveryContextKey).(*deliveryHolder)
+	if !ok {
+		return amqp.Delivery{}, false
+	}
+
+	return holder.get()
+}
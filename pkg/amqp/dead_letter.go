@@ -0,0 +1,66 @@
+package amqp
+
+import (
+	"strconv"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// DeathReasonMetadataKey is the metadata key with the reason, why the message was dead-lettered last time
+	// (one of DeathReasonRejected, DeathReasonExpired, DeathReasonMaxLen or DeathReasonDeliveryLimit).
+	//
+	// It's set by DefaultMarshaler from the x-death header, which is added by RabbitMQ to dead-lettered messages,
+	// so the consumer of the dead letter queue can tell why the message was dead-lettered.
+	DeathReasonMetadataKey = "_watermill_death_reason"
+	// DeathQueueMetadataKey is the metadata key with the queue, from which the message was dead-lettered last time.
+	DeathQueueMetadataKey = "_watermill_death_queue"
+	// DeathCountMetadataKey is the metadata key with the number of times the message was dead-lettered
+	// from DeathQueueMetadataKey queue with DeathReasonMetadataKey reason.
+	DeathCountMetadataKey = "_watermill_death_count"
+)
+
+// Reasons of dead-lettering, see DeathReasonMetadataKey.
+const (
+	// DeathReasonRejected is the reason of the message nacked or rejected without requeue.
+	DeathReasonRejected = "rejected"
+	// DeathReasonExpired is the reason of the message, which expired because of the message or queue TTL.
+	DeathReasonExpired = "expired"
+	// DeathReasonMaxLen is the reason of the message dropped from the queue, which exceeded its length limit.
+	DeathReasonMaxLen = "maxlen"
+	// DeathReasonDeliveryLimit is the reason of the message, which exceeded the delivery limit of the quorum queue.
+	DeathReasonDeliveryLimit = "delivery_limit"
+)
+
+// deathMetadata returns the metadata describing the last dead-lettering of the message from the x-death header.
+//
+// x-death is an array of tables (one for every queue and reason pair), the most recent dead-lettering is the first.
+// When x-death is missing or invalid, x-first-death-reason and x-first-death-queue headers are used.
+func deathMetadata(headers amqp.Table) map[string]string {
+	metadata := map[string]string{}
+
+	if deaths, ok := headers["x-death"].([]interface{}); ok && len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp.Table); ok {
+			if reason, ok := death["reason"].(string); ok {
+				metadata[DeathReasonMetadataKey] = reason
+			}
+			if queue, ok := death["queue"].(string); ok {
+				metadata[DeathQueueMetadataKey] = queue
+			}
+			if count, ok := death["count"].(int64); ok {
+				metadata[DeathCountMetadataKey] = strconv.FormatInt(count, 10)
+			}
+		}
+	}
+
+	if _, ok := metadata[DeathReasonMetadataKey]; !ok {
+		if reason, ok := headers["x-first-death-reason"].(string); ok {
+			metadata[DeathReasonMetadataKey] = reason
+		}
+		if queue, ok := headers["x-first-death-queue"].(string); ok {
+			metadata[DeathQueueMetadataKey] = queue
+		}
+	}
+
+	return metadata
+}
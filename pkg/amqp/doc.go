@@ -6,6 +6,8 @@
 // - Qos settings
 // - TLS support
 // - Publish Transactions support (optional, can be enabled in config)
+// - Publisher confirms support (optional, can be enabled in config)
+// - Request/reply (RPC) support with RPCClient
 //
 // Nomenclature
 //
@@ -16,6 +18,22 @@
 // It is used to generate exchange name, routing key and queue name, depending on the context.
 // To check how topic is mapped, please check Exchange.GenerateName, Queue.GenerateName and Publish.GenerateRoutingKey.
 //
+// When Exchange.GenerateName returns empty string, messages are published to the default ("") exchange.
+// The default exchange routes messages directly to the queue named by the routing key,
+// so when Publish.GenerateRoutingKey is not set, the queue name generated by Queue.GenerateName
+// is used as the routing key. No exchange is declared.
+// This is the simplest point-to-point pattern (see NewDurableQueueConfig).
+//
 // In case of any problem to find to what exchange name, routing key and queue name are set,
 // just enable logging with debug level and check it in logs.
+//
+// Connection abstraction
+//
+// Publisher and Subscriber use the broker through AMQPConnection and AMQPChannel interfaces, which are implemented
+// by github.com/streadway/amqp (the default) and by the in-memory broker from the memamqp package
+// (see ConnectionConfig.Dial). It's a breaking change of the API:
+// - TopologyBuilder.BuildTopology and TopologyBuilder.ExchangeDeclare receive AMQPChannel instead of *amqp.Channel,
+//   custom builders must change only the signature, because *amqp.Channel implements AMQPChannel,
+// - Publisher.Connection and Subscriber.Connection return AMQPConnection instead of *amqp.Connection,
+//   the *amqp.Connection is returned by StreadwayConnection.
 package amqp
@@ -0,0 +1,84 @@
+package amqp
+
+import (
+	"encoding/json"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// EnvelopeContentType is the ContentType of the publishings marshaled by EnvelopeMarshaler.
+const EnvelopeContentType = "application/vnd.watermill.envelope+json"
+
+// EnvelopeMarshaler marshals the whole message (UUID, metadata and payload) as a JSON envelope into the body.
+//
+// Unlike DefaultMarshaler, metadata is not mapped to headers, so it's preserved exactly,
+// even when the message is passed by systems which don't keep the headers (or change their types).
+// It's useful when the broker is only a transport between Watermill services.
+//
+// The envelope is a JSON object with "uuid", "metadata" and "payload" (base64 encoded) fields.
+// On consume, the message is reconstructed only from the body, AMQP headers (like x-death set by the broker)
+// are not copied to the metadata. UUID is also published as the MessageUUIDHeaderKey header,
+// so it's visible in the broker's management UI.
+type EnvelopeMarshaler struct {
+	// When true, messages are published with transient delivery mode instead of persistent.
+	NotPersistentDeliveryMode bool
+}
+
+type messageEnvelope struct {
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+// ContentType returns EnvelopeContentType, see ContentTypeMarshaler.
+func (m EnvelopeMarshaler) ContentType() string {
+	return EnvelopeContentType
+}
+
+func (m EnvelopeMarshaler) Marshal(msg *message.Message) (amqp.Publishing, error) {
+	body, err := json.Marshal(messageEnvelope{
+		UUID:     msg.UUID,
+		Metadata: msg.Metadata,
+		Payload:  msg.Payload,
+	})
+	if err != nil {
+		return amqp.Publishing{}, errors.Wrapf(err, "cannot marshal envelope of message %s", msg.UUID)
+	}
+
+	publishing := amqp.Publishing{
+		Body:        body,
+		ContentType: EnvelopeContentType,
+		Headers:     amqp.Table{MessageUUIDHeaderKey: msg.UUID},
+	}
+	if !m.NotPersistentDeliveryMode {
+		publishing.DeliveryMode = amqp.Persistent
+	}
+
+	return publishing, nil
+}
+
+func (m EnvelopeMarshaler) Unmarshal(amqpMsg amqp.Delivery) (*message.Message, error) {
+	var envelope messageEnvelope
+	if err := json.Unmarshal(amqpMsg.Body, &envelope); err != nil {
+		return nil, errors.Wrap(err, "cannot unmarshal envelope")
+	}
+	if envelope.UUID == "" {
+		return nil, errors.New("missing message UUID in envelope")
+	}
+
+	payload := envelope.Payload
+	if payload == nil {
+		// consistent with DefaultMarshaler, empty payload is unmarshaled as zero-length payload
+		payload = []byte{}
+	}
+
+	msg := message.NewMessage(envelope.UUID, payload)
+	msg.Metadata = make(message.Metadata, len(envelope.Metadata))
+	for key, value := range envelope.Metadata {
+		msg.Metadata[key] = value
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,110 @@
+package amqp
+
+import (
+	"fmt"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// TopologyMismatchError is returned when the queue or exchange already exists with different properties
+// or arguments than declared (AMQP's PRECONDITION_FAILED error).
+//
+// Retrying in this case is pointless, so the subscription is stopped instead of reconnecting.
+// To fix it, the existing queue or exchange must be deleted or the config must be aligned with it.
+type TopologyMismatchError struct {
+	Topic string
+	Err   *amqp.Error
+}
+
+func (e *TopologyMismatchError) Error() string {
+	return fmt.Sprintf(
+		"declared topology for topic %s differs from the existing queue or exchange: %s",
+		e.Topic, e.Err.Reason,
+	)
+}
+
+func (e *TopologyMismatchError) Cause() error {
+	return e.Err
+}
+
+// IsTopologyMismatchError returns true when err is (or is caused by) TopologyMismatchError.
+func IsTopologyMismatchError(err error) bool {
+	return findError(err, func(err error) bool {
+		_, ok := err.(*TopologyMismatchError)
+		return ok
+	}) != nil
+}
+
+// ErrImmediateNotSupported is the cause of the Publish error, when the broker doesn't support
+// Config.Publish.Immediate (like RabbitMQ since 3.0) and closed the connection with NOT_IMPLEMENTED error.
+var ErrImmediateNotSupported = errors.New("immediate flag is not supported by the AMQP broker, disable Config.Publish.Immediate")
+
+// IsImmediateNotSupportedError returns true when err is (or is caused by) ErrImmediateNotSupported.
+func IsImmediateNotSupportedError(err error) bool {
+	return findError(err, func(err error) bool {
+		return err == ErrImmediateNotSupported
+	}) != nil
+}
+
+// newTopologyMismatchError returns TopologyMismatchError when err is caused by AMQP's PRECONDITION_FAILED error,
+// otherwise err is returned.
+func newTopologyMismatchError(topic string, err error) error {
+	amqpErr := findError(err, func(err error) bool {
+		amqpErr, ok := err.(*amqp.Error)
+		return ok && amqpErr.Code == amqp.PreconditionFailed
+	})
+	if amqpErr == nil {
+		return err
+	}
+
+	return &TopologyMismatchError{Topic: topic, Err: amqpErr.(*amqp.Error)}
+}
+
+// findError returns the first error from err's causes (including errors aggregated by multierror),
+// for which match returns true.
+func findError(err error, match func(error) bool) error {
+	for err != nil {
+		if match(err) {
+			return err
+		}
+
+		switch typedErr := err.(type) {
+		case *multierror.Error:
+			for _, err := range typedErr.Errors {
+				if found := findError(err, match); found != nil {
+					return found
+				}
+			}
+			return nil
+		case interface{ Cause() error }:
+			err = typedErr.Cause()
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// PublishError is returned by Publisher.Publish, when the message cannot be published or confirmed.
+// It describes where the message was published, which helps to debug routing problems.
+type PublishError struct {
+	Topic        string
+	ExchangeName string
+	RoutingKey   string
+	MessageUUID  string
+	Err          error
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf(
+		"cannot publish message %s to topic %s (exchange %q, routing key %q): %s",
+		e.MessageUUID, e.Topic, e.ExchangeName, e.RoutingKey, e.Err,
+	)
+}
+
+func (e *PublishError) Cause() error {
+	return e.Err
+}
@@ -0,0 +1,72 @@
+package amqp
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DeduplicationExchangeType is the exchange type of the rabbitmq-message-deduplication plugin.
+//
+// Deduplication exchange drops messages with the deduplication ID (see DefaultMarshaler.GenerateDeduplicationID)
+// already seen by the exchange, before they are routed to any queue. The size of the cache of seen IDs
+// must be set with ExchangeConfig.DeduplicationCacheSize.
+const DeduplicationExchangeType = "x-message-deduplication"
+
+var (
+	// exchangeTypes are exchange types accepted by the config validation,
+	// built-in AMQP types and types of popular RabbitMQ plugins
+	exchangeTypes = map[string]struct{}{
+		"direct":                  {},
+		"fanout":                  {},
+		"topic":                   {},
+		"headers":                 {},
+		"x-delayed-message":       {},
+		"x-consistent-hash":       {},
+		"x-message-deduplication": {},
+		"x-modulus-hash":          {},
+		"x-random":                {},
+		"x-recent-history":        {},
+	}
+	exchangeTypesLock sync.RWMutex
+)
+
+// RegisterExchangeType allows to use the exchange type provided by the broker plugin in ExchangeConfig.Type.
+//
+// Config validation (ValidatePublisher, ValidateSubscriber and ValidateTopology) rejects unknown exchange types,
+// so a typo is reported at startup instead of by the broker when the exchange is declared.
+// Built-in AMQP types and types of popular RabbitMQ plugins (like x-delayed-message) are registered by default.
+func RegisterExchangeType(exchangeType string) {
+	exchangeTypesLock.Lock()
+	defer exchangeTypesLock.Unlock()
+
+	exchangeTypes[exchangeType] = struct{}{}
+}
+
+// validateExchangeType returns an error listing the allowed types, when exchangeType is not registered.
+// Empty type is allowed, it's used when the default exchange is used.
+func validateExchangeType(exchangeType string) error {
+	if exchangeType == "" {
+		return nil
+	}
+
+	exchangeTypesLock.RLock()
+	defer exchangeTypesLock.RUnlock()
+
+	if _, ok := exchangeTypes[exchangeType]; ok {
+		return nil
+	}
+
+	allowed := make([]string, 0, len(exchangeTypes))
+	for registered := range exchangeTypes {
+		allowed = append(allowed, registered)
+	}
+	sort.Strings(allowed)
+
+	return errors.Errorf(
+		"unknown exchange type %q, allowed types: %s (other types can be registered with RegisterExchangeType)",
+		exchangeType, strings.Join(allowed, ", "),
+	)
+}
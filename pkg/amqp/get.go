@@ -0,0 +1,213 @@
+package amqp
+
+import (
+	"context"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// Get fetches a single message from the queue generated for the topic with basic.get (polling mode),
+// without keeping the consumer open. It returns false when the queue is empty.
+//
+// It suits cron-style workers, which wake up, drain the queue and exit.
+// Get doesn't declare the topology, SubscribeInitialize can be used for that.
+//
+// Returned message must be acked or nacked, like messages from Subscribe (according to Config.Consume.AckStrategy).
+// The AMQP channel is kept open until the message is acked or nacked, or the Subscriber is closed.
+// When the message cannot be unmarshaled, it's handled according to Config.Consume.OnUnmarshalError
+// and the error is returned.
+func (s *Subscriber) Get(topic string) (*message.Message, bool, error) {
+	if err := s.checkSubscribe(); err != nil {
+		return nil, false, err
+	}
+
+	target, err := s.pollTarget(topic)
+	if err != nil {
+		return nil, false, err
+	}
+	logFields := target.logFields()
+
+	channel, err := s.openSubscribeChannel(logFields)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to open channel")
+	}
+
+	amqpMsg, ok, err := channel.Get(target.queueName, false)
+	if err != nil {
+		s.closeGetChannel(channel, logFields)
+		return nil, false, errors.Wrap(err, "cannot get message")
+	}
+	if !ok {
+		s.logger.Trace("Queue is empty", logFields)
+		s.closeGetChannel(channel, logFields)
+		return nil, false, nil
+	}
+
+	sub := &subscription{
+		logFields:   logFields,
+		channel:     channel,
+		topic:       topic,
+		queueName:   target.queueName,
+		logger:      s.logger,
+		closing:     s.closing,
+		config:      s.config,
+		counters:    s.counters,
+		republisher: newRepublisher(s.connectionWrapper, s.config.Consume.republishTimeout(), s.closing, logFields),
+	}
+	sub.counters.addReceived()
+	sub.observeLatency(amqpMsg)
+
+	msg, err := s.config.consumeMarshaler(topic).Unmarshal(amqpMsg)
+	if err != nil {
+		unproc := make(chan undelivered, 1)
+		sub.handleUnmarshalError(amqpMsg, err, unproc, logFields)
+		close(unproc)
+		sub.nackUndelivered(unproc, make(chan error, 1))
+
+		sub.republisher.close()
+		s.closeGetChannel(channel, logFields)
+		return nil, false, errors.Wrap(err, "cannot unmarshal message")
+	}
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	ctx, delivery := contextWithDelivery(ctx, amqpMsg)
+	msg.SetContext(s.config.Consume.messageContext(ctx, amqpMsg))
+
+	msgLogFields := logFields.Add(watermill.LogFields{"message_uuid": msg.UUID})
+	s.logger.Trace("Message fetched with basic.get", msgLogFields)
+
+	s.subscribingWg.Add(1)
+	go func() {
+		defer s.subscribingWg.Done()
+		defer s.closeGetChannel(channel, logFields)
+		defer sub.republisher.close()
+		defer cancelCtx()
+		defer delivery.release()
+
+		if err := sub.resolveDelivery(ctx, amqpMsg, msg, msgLogFields); err != nil {
+			s.logger.Error("Cannot ack or nack message fetched with basic.get", err, msgLogFields)
+		}
+	}()
+
+	return msg, true, nil
+}
+
+// Drain fetches up to max messages from the queue generated for the topic with basic.get and acks them.
+// It stops when the queue is empty, max messages were fetched or ctx is done.
+//
+// It's destructive: fetched messages are removed from the queue before Drain returns,
+// regardless of Config.Consume.AckStrategy and whether the returned messages are acked.
+// It's meant for tooling, like inspecting the contents of the dead letter queue.
+//
+// When a message cannot be unmarshaled, it's handled according to Config.Consume.OnUnmarshalError (like in Get)
+// and Drain continues with the next message. Messages, which should be requeued, are kept unacked
+// until Drain returns, so they are not fetched again. Unmarshal errors are returned together with
+// the drained messages. Such messages count to max as well.
+func (s *Subscriber) Drain(ctx context.Context, topic string, max int) ([]*message.Message, error) {
+	if err := s.checkSubscribe(); err != nil {
+		return nil, err
+	}
+	if max <= 0 {
+		return nil, errors.New("max must be positive")
+	}
+
+	target, err := s.pollTarget(topic)
+	if err != nil {
+		return nil, err
+	}
+	logFields := target.logFields()
+
+	channel, err := s.openSubscribeChannel(logFields)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open channel")
+	}
+	defer s.closeGetChannel(channel, logFields)
+
+	sub := &subscription{
+		logFields:   logFields,
+		channel:     channel,
+		topic:       topic,
+		queueName:   target.queueName,
+		logger:      s.logger,
+		closing:     s.closing,
+		config:      s.config,
+		counters:    s.counters,
+		republisher: newRepublisher(s.connectionWrapper, s.config.Consume.republishTimeout(), s.closing, logFields),
+	}
+	defer sub.republisher.close()
+
+	// every fetched message may be undecodable
+	unproc := make(chan undelivered, max)
+	defer func() {
+		// messages are nacked before the channel is closed, otherwise they would be redelivered
+		close(unproc)
+		sub.nackUndelivered(unproc, make(chan error, 1))
+	}()
+
+	var msgs []*message.Message
+	var unmarshalErr error
+	for fetched := 0; fetched < max; fetched++ {
+		select {
+		case <-ctx.Done():
+			return msgs, unmarshalErr
+		case <-s.closing:
+			return msgs, unmarshalErr
+		default:
+		}
+
+		amqpMsg, ok, err := channel.Get(target.queueName, false)
+		if err != nil {
+			return msgs, multierror.Append(unmarshalErr, errors.Wrap(err, "cannot get message"))
+		}
+		if !ok {
+			break
+		}
+		s.counters.addReceived()
+
+		msg, err := s.config.consumeMarshaler(topic).Unmarshal(amqpMsg)
+		if err != nil {
+			sub.handleUnmarshalError(amqpMsg, err, unproc, logFields)
+			unmarshalErr = multierror.Append(unmarshalErr, errors.Wrapf(
+				err, "cannot unmarshal message with delivery tag %d", amqpMsg.DeliveryTag,
+			))
+			continue
+		}
+
+		if err := amqpMsg.Ack(false); err != nil {
+			return msgs, multierror.Append(unmarshalErr, errors.Wrapf(err, "cannot ack message %s", msg.UUID))
+		}
+		s.counters.addAcked()
+		msgs = append(msgs, msg)
+	}
+
+	s.logger.Debug("Queue drained", logFields.Add(watermill.LogFields{"messages_count": len(msgs)}))
+
+	return msgs, unmarshalErr
+}
+
+// pollTarget returns the consume target of the topic for basic.get.
+func (s *Subscriber) pollTarget(topic string) (consumeTarget, error) {
+	if err := s.config.ValidateTopic(topic); err != nil {
+		return consumeTarget{}, errors.Wrapf(err, "invalid topic %s", topic)
+	}
+
+	target := consumeTarget{
+		topic:        topic,
+		queueName:    s.config.Queue.GenerateName(topic),
+		exchangeName: s.config.Exchange.GenerateName(topic),
+	}
+	if target.queueName == "" {
+		return consumeTarget{}, errors.New("queue name for the topic is empty, server named queues are not supported")
+	}
+
+	return target, nil
+}
+
+func (s *Subscriber) closeGetChannel(channel AMQPChannel, logFields watermill.LogFields) {
+	if err := s.closeChannel(channel); err != nil {
+		s.logger.Error("Failed to close channel", err, logFields)
+	}
+}
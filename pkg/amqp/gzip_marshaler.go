@@ -0,0 +1,89 @@
+package amqp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// GzipContentEncoding is the ContentEncoding of the publishings compressed by GzipMarshaler.
+const GzipContentEncoding = "gzip"
+
+// GzipMarshaler compresses bodies of published messages with gzip and sets ContentEncoding to "gzip".
+//
+// Deliveries are decompressed based on the ContentEncoding property, not the config,
+// so messages from producers with and without compression can be consumed by the same subscriber.
+type GzipMarshaler struct {
+	// Marshaler is the wrapped marshaler. When nil, DefaultMarshaler is used.
+	Marshaler Marshaler
+
+	// MinSize is the minimum size of the body (in bytes), which is compressed.
+	// Smaller bodies are published without compression, because compression doesn't pay off for them.
+	MinSize int
+}
+
+func (m GzipMarshaler) marshaler() Marshaler {
+	if m.Marshaler == nil {
+		return DefaultMarshaler{}
+	}
+
+	return m.Marshaler
+}
+
+// ContentType returns the content type of the wrapped marshaler, when it's ContentTypeMarshaler.
+// Compression doesn't change the content type, only ContentEncoding.
+func (m GzipMarshaler) ContentType() string {
+	if contentTypeMarshaler, ok := m.marshaler().(ContentTypeMarshaler); ok {
+		return contentTypeMarshaler.ContentType()
+	}
+
+	return ""
+}
+
+func (m GzipMarshaler) Marshal(msg *message.Message) (amqp.Publishing, error) {
+	publishing, err := m.marshaler().Marshal(msg)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	if len(publishing.Body) < m.MinSize || publishing.ContentEncoding != "" {
+		return publishing, nil
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(publishing.Body); err != nil {
+		return amqp.Publishing{}, errors.Wrap(err, "cannot compress body")
+	}
+	if err := writer.Close(); err != nil {
+		return amqp.Publishing{}, errors.Wrap(err, "cannot compress body")
+	}
+
+	publishing.Body = compressed.Bytes()
+	publishing.ContentEncoding = GzipContentEncoding
+
+	return publishing, nil
+}
+
+func (m GzipMarshaler) Unmarshal(amqpMsg amqp.Delivery) (*message.Message, error) {
+	if amqpMsg.ContentEncoding == GzipContentEncoding {
+		reader, err := gzip.NewReader(bytes.NewReader(amqpMsg.Body))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decompress body")
+		}
+
+		body, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decompress body")
+		}
+
+		amqpMsg.Body = body
+		amqpMsg.ContentEncoding = ""
+	}
+
+	return m.marshaler().Unmarshal(amqpMsg)
+}
@@ -1,6 +1,12 @@
 package amqp
 
 import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/pkg/errors"
 	"github.com/streadway/amqp"
@@ -8,12 +14,36 @@ import (
 
 const MessageUUIDHeaderKey = "_watermill_message_uuid"
 
+// DeduplicationHeaderKey is the header used by the rabbitmq-message-deduplication plugin.
+const DeduplicationHeaderKey = "x-deduplication-header"
+
 // Marshaler marshals Watermill's message to amqp.Publishing and unmarshals amqp.Delivery to Watermill's message.
 type Marshaler interface {
 	Marshal(msg *message.Message) (amqp.Publishing, error)
 	Unmarshal(amqpMsg amqp.Delivery) (*message.Message, error)
 }
 
+// ContentTypeMarshaler is an optional interface of Marshaler, which declares the content type of the bodies it produces.
+//
+// When the publishing returned by Marshal has no ContentType, Publisher sets it to ContentType(),
+// so consumers can dispatch by the content type without every Marshal implementation setting it.
+// Marshalers which don't implement it are used as before.
+type ContentTypeMarshaler interface {
+	Marshaler
+	ContentType() string
+}
+
+// applyMarshalerContentType sets ContentType of the publishing, when it's empty and marshaler is ContentTypeMarshaler.
+func applyMarshalerContentType(marshaler Marshaler, publishing *amqp.Publishing) {
+	if publishing.ContentType != "" {
+		return
+	}
+
+	if contentTypeMarshaler, ok := marshaler.(ContentTypeMarshaler); ok {
+		publishing.ContentType = contentTypeMarshaler.ContentType()
+	}
+}
+
 type DefaultMarshaler struct {
 	// PostprocessPublishing can be used to make some extra processing with amqp.Publishing,
 	// for example add CorrelationId and ContentType:
@@ -36,23 +66,127 @@ type DefaultMarshaler struct {
 	// not be restored to durable queues, persistent messages will be restored to
 	// durable queues and lost on non-durable queues during server restart.
 	NotPersistentDeliveryMode bool
+
+	// GenerateDeduplicationID is used to generate value of the "x-deduplication-header" header,
+	// used by the rabbitmq-message-deduplication plugin.
+	// When nil or when empty string is returned, header is not set.
+	//
+	// To use value from the metadata, DeduplicationIDFromMetadata can be used.
+	GenerateDeduplicationID func(msg *message.Message) string
+
+	// When true, message UUID is set as the MessageId property of the publishing
+	// and MessageId of the delivery is used as the message UUID.
+	// It aligns Watermill's message UUID with the broker's native identifier.
+	//
+	// The UUID header is still set, so messages can be consumed by subscribers without this option.
+	// When MessageId of the delivery is empty, UUID is read from the header.
+	UseMessageIDAsUUID bool
+
+	// HeaderMetadataPrefix allows to set arbitrary AMQP headers from the metadata, for example "amqp_header_".
+	//
+	// When set, metadata with keys starting with the prefix are published as headers with the prefix stripped.
+	// When both the prefixed and not prefixed metadata are set (for example "amqp_header_foo" and "foo"),
+	// they must have the same value, otherwise Marshal returns an error.
+	// On consume, every header is also copied to the metadata with the prefix added
+	// and only string headers are copied to the metadata without the prefix.
+	//
+	// When empty, every metadata is published as header with the same key
+	// and every header is copied to the metadata with the same key.
+	//
+	// Non-string header values (for example numbers set by other clients or x-death table set by the broker)
+	// are converted to strings deterministically:
+	// 	- integers and floats are formatted in decimal notation (int64(3) is "3", 1.5 is "1.5"),
+	// 	- bool is "true" or "false" and nil (void) is "",
+	// 	- []byte is copied as it is,
+	// 	- time.Time is formatted as RFC 3339 in UTC (AMQP timestamps have seconds precision),
+	// 	- amqp.Decimal is formatted as "<value>e-<scale>",
+	// 	- arrays and tables are formatted as JSON array and JSON object (with sorted keys),
+	// 	  with nested values converted to strings in the same way.
+	HeaderMetadataPrefix string
+
+	// When true, Marshal returns an error for the message with nil payload.
+	// Otherwise, nil payload is published as an empty body.
+	//
+	// Empty body is always unmarshaled to the non-nil, zero-length payload.
+	RejectNilPayload bool
+
+	// When ExpirationFromContextDeadline is true and the context of the message has a deadline,
+	// the time remaining until the deadline is set as the Expiration property (per-message TTL),
+	// so the broker drops the message, when it's not consumed before the deadline.
+	//
+	// Remaining time is rounded up to milliseconds. When the deadline was already exceeded, Expiration is "0",
+	// so the message is dropped unless it can be delivered to a consumer immediately.
+	ExpirationFromContextDeadline bool
+}
+
+// expirationUntil returns the Expiration property (in milliseconds, rounded up) of the message
+// which should expire at deadline.
+func expirationUntil(deadline time.Time, now time.Time) string {
+	remaining := deadline.Sub(now)
+	if remaining <= 0 {
+		return "0"
+	}
+
+	milliseconds := (remaining + time.Millisecond - 1) / time.Millisecond
+	return strconv.FormatInt(int64(milliseconds), 10)
+}
+
+// DeduplicationIDFromMetadata returns GenerateDeduplicationID func, which uses value of the metadata key
+// as the deduplication ID.
+func DeduplicationIDFromMetadata(key string) func(msg *message.Message) string {
+	return func(msg *message.Message) string {
+		return msg.Metadata.Get(key)
+	}
 }
 
 func (d DefaultMarshaler) Marshal(msg *message.Message) (amqp.Publishing, error) {
+	body := msg.Payload
+	if body == nil {
+		if d.RejectNilPayload {
+			return amqp.Publishing{}, errors.Errorf("payload of message %s is nil", msg.UUID)
+		}
+		body = []byte{}
+	}
+
 	headers := make(amqp.Table, len(msg.Metadata)+1) // metadata + plus uuid
 
 	for key, value := range msg.Metadata {
-		headers[key] = value
+		headerKey := key
+		if d.HeaderMetadataPrefix != "" && strings.HasPrefix(key, d.HeaderMetadataPrefix) {
+			headerKey = strings.TrimPrefix(key, d.HeaderMetadataPrefix)
+		}
+		// metadata is iterated in random order, so the header can't be just overwritten
+		if existing, ok := headers[headerKey]; ok && existing != value {
+			return amqp.Publishing{}, errors.Errorf(
+				"metadata %s and %s%s of message %s have different values, but are published as the same header",
+				headerKey, d.HeaderMetadataPrefix, headerKey, msg.UUID,
+			)
+		}
+		headers[headerKey] = value
 	}
 	headers[MessageUUIDHeaderKey] = msg.UUID
 
+	if d.GenerateDeduplicationID != nil {
+		if deduplicationID := d.GenerateDeduplicationID(msg); deduplicationID != "" {
+			headers[DeduplicationHeaderKey] = deduplicationID
+		}
+	}
+
 	publishing := amqp.Publishing{
-		Body:    msg.Payload,
+		Body:    body,
 		Headers: headers,
 	}
+	if d.UseMessageIDAsUUID {
+		publishing.MessageId = msg.UUID
+	}
 	if !d.NotPersistentDeliveryMode {
 		publishing.DeliveryMode = amqp.Persistent
 	}
+	if d.ExpirationFromContextDeadline {
+		if deadline, ok := msg.Context().Deadline(); ok {
+			publishing.Expiration = expirationUntil(deadline, time.Now())
+		}
+	}
 
 	if d.PostprocessPublishing != nil {
 		publishing = d.PostprocessPublishing(publishing)
@@ -61,30 +195,127 @@ func (d DefaultMarshaler) Marshal(msg *message.Message) (amqp.Publishing, error)
 	return publishing, nil
 }
 
-func (DefaultMarshaler) Unmarshal(amqpMsg amqp.Delivery) (*message.Message, error) {
-	msgUUID, ok := amqpMsg.Headers[MessageUUIDHeaderKey]
-	if !ok {
-		return nil, errors.Errorf("missing %s header", MessageUUIDHeaderKey)
+// Unmarshal unmarshals the delivery to the message with headers copied to the metadata (see HeaderMetadataPrefix).
+//
+// When the message was dead-lettered, the reason, queue and count of the last dead-lettering are parsed
+// from the x-death header to DeathReasonMetadataKey, DeathQueueMetadataKey and DeathCountMetadataKey metadata.
+func (d DefaultMarshaler) Unmarshal(amqpMsg amqp.Delivery) (*message.Message, error) {
+	msgUUIDStr, err := d.unmarshalMessageUUID(amqpMsg)
+	if err != nil {
+		return nil, err
 	}
 
-	msgUUIDStr, ok := msgUUID.(string)
-	if !ok {
-		return nil, errors.Errorf("message UUID is not a string, but: %#v", msgUUID)
+	payload := amqpMsg.Body
+	if payload == nil {
+		// empty body may be received as nil, it's unmarshaled consistently as zero-length payload
+		payload = []byte{}
 	}
 
-	msg := message.NewMessage(msgUUIDStr, amqpMsg.Body)
-	msg.Metadata = make(message.Metadata, len(amqpMsg.Headers)-1) // headers - minus uuid
+	msg := message.NewMessage(msgUUIDStr, payload)
+	msg.Metadata = make(message.Metadata, len(amqpMsg.Headers))
 
 	for key, value := range amqpMsg.Headers {
 		if key == MessageUUIDHeaderKey {
 			continue
 		}
 
-		msg.Metadata[key], ok = value.(string)
-		if !ok {
-			return nil, errors.Errorf("metadata %s is not a string, but %#v", key, value)
+		if d.HeaderMetadataPrefix != "" {
+			msg.Metadata[d.HeaderMetadataPrefix+key] = headerValueToString(value)
+
+			if stringValue, ok := value.(string); ok {
+				msg.Metadata[key] = stringValue
+			}
+			continue
 		}
+
+		msg.Metadata[key] = headerValueToString(value)
+	}
+
+	for key, value := range deathMetadata(amqpMsg.Headers) {
+		msg.Metadata[key] = value
 	}
 
 	return msg, nil
 }
+
+func (d DefaultMarshaler) unmarshalMessageUUID(amqpMsg amqp.Delivery) (string, error) {
+	if d.UseMessageIDAsUUID && amqpMsg.MessageId != "" {
+		return amqpMsg.MessageId, nil
+	}
+
+	msgUUID, ok := amqpMsg.Headers[MessageUUIDHeaderKey]
+	if !ok {
+		return "", errors.Errorf("missing %s header", MessageUUIDHeaderKey)
+	}
+
+	msgUUIDStr, ok := msgUUID.(string)
+	if !ok {
+		return "", errors.Errorf("message UUID is not a string, but: %#v", msgUUID)
+	}
+
+	return msgUUIDStr, nil
+}
+
+// headerValueToString converts AMQP header value to the metadata string.
+func headerValueToString(value interface{}) string {
+	switch typedValue := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return typedValue
+	case []byte:
+		return string(typedValue)
+	case bool:
+		return strconv.FormatBool(typedValue)
+	case int8:
+		return strconv.FormatInt(int64(typedValue), 10)
+	case uint16:
+		return strconv.FormatUint(uint64(typedValue), 10)
+	case uint32:
+		return strconv.FormatUint(uint64(typedValue), 10)
+	case int16:
+		return strconv.FormatInt(int64(typedValue), 10)
+	case int32:
+		return strconv.FormatInt(int64(typedValue), 10)
+	case int64:
+		return strconv.FormatInt(typedValue, 10)
+	case int:
+		return strconv.Itoa(typedValue)
+	case uint8:
+		return strconv.FormatUint(uint64(typedValue), 10)
+	case float32:
+		return strconv.FormatFloat(float64(typedValue), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64)
+	case amqp.Decimal:
+		return fmt.Sprintf("%de-%d", typedValue.Value, typedValue.Scale)
+	case time.Time:
+		return typedValue.UTC().Format(time.RFC3339)
+	case []interface{}:
+		values := make([]string, len(typedValue))
+		for i, value := range typedValue {
+			values[i] = headerValueToString(value)
+		}
+		return marshalHeaderJSON(values)
+	case amqp.Table:
+		values := make(map[string]string, len(typedValue))
+		for key, value := range typedValue {
+			values[key] = headerValueToString(value)
+		}
+		return marshalHeaderJSON(values)
+	default:
+		return fmt.Sprintf("%v", typedValue)
+	}
+}
+
+// marshalHeaderJSON formats the array or table header converted to strings.
+// Map keys are sorted by encoding/json, so the output is deterministic.
+func marshalHeaderJSON(value interface{}) string {
+	b, err := json.Marshal(value)
+	if err != nil {
+		// strings and maps of strings are always marshaled
+		return fmt.Sprintf("%v", value)
+	}
+
+	return string(b)
+}
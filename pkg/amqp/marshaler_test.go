@@ -1,7 +1,11 @@
 package amqp_test
 
 import (
+	"bytes"
+	"context"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -60,6 +64,170 @@ func TestDefaultMarshaler_postprocess_publishing(t *testing.T) {
 	assert.Equal(t, marshaled.ContentType, "application/json")
 }
 
+func TestDefaultMarshaler_deduplication_id(t *testing.T) {
+	marshaler := amqp.DefaultMarshaler{
+		GenerateDeduplicationID: amqp.DeduplicationIDFromMetadata("idempotency_key"),
+	}
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	msg.Metadata.Set("idempotency_key", "key")
+
+	marshaled, err := marshaler.Marshal(msg)
+	require.NoError(t, err)
+
+	assert.Equal(t, "key", marshaled.Headers[amqp.DeduplicationHeaderKey])
+
+	msg = message.NewMessage(watermill.NewUUID(), []byte("payload"))
+
+	marshaled, err = marshaler.Marshal(msg)
+	require.NoError(t, err)
+
+	assert.NotContains(t, marshaled.Headers, amqp.DeduplicationHeaderKey)
+}
+
+func TestDefaultMarshaler_use_message_id_as_uuid(t *testing.T) {
+	marshaler := amqp.DefaultMarshaler{UseMessageIDAsUUID: true}
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	msg.Metadata.Set("foo", "bar")
+
+	marshaled, err := marshaler.Marshal(msg)
+	require.NoError(t, err)
+	assert.Equal(t, msg.UUID, marshaled.MessageId)
+
+	unmarshaledMsg, err := marshaler.Unmarshal(stdAmqp.Delivery{
+		MessageId: "native-id",
+		Body:      marshaled.Body,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "native-id", unmarshaledMsg.UUID)
+	assert.Empty(t, unmarshaledMsg.Metadata)
+
+	unmarshaledMsg, err = marshaler.Unmarshal(publishingToDelivery(marshaled))
+	require.NoError(t, err)
+	assert.True(t, msg.Equals(unmarshaledMsg))
+}
+
+func TestDefaultMarshaler_header_metadata_prefix(t *testing.T) {
+	marshaler := amqp.DefaultMarshaler{HeaderMetadataPrefix: "amqp_header_"}
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	msg.Metadata.Set("foo", "bar")
+	msg.Metadata.Set("amqp_header_x-custom", "value")
+
+	marshaled, err := marshaler.Marshal(msg)
+	require.NoError(t, err)
+
+	assert.Equal(t, "bar", marshaled.Headers["foo"])
+	assert.Equal(t, "value", marshaled.Headers["x-custom"])
+	assert.NotContains(t, marshaled.Headers, "amqp_header_x-custom")
+
+	delivery := publishingToDelivery(marshaled)
+	delivery.Headers["x-count"] = int64(3)
+	delivery.Headers["x-enabled"] = true
+
+	unmarshaledMsg, err := marshaler.Unmarshal(delivery)
+	require.NoError(t, err)
+
+	assert.Equal(t, "bar", unmarshaledMsg.Metadata.Get("foo"))
+	assert.Equal(t, "bar", unmarshaledMsg.Metadata.Get("amqp_header_foo"))
+	assert.Equal(t, "value", unmarshaledMsg.Metadata.Get("amqp_header_x-custom"))
+	assert.Equal(t, "3", unmarshaledMsg.Metadata.Get("amqp_header_x-count"))
+	assert.Equal(t, "true", unmarshaledMsg.Metadata.Get("amqp_header_x-enabled"))
+	assert.NotContains(t, unmarshaledMsg.Metadata, "x-count")
+
+	// consumed message has both prefixed and not prefixed metadata with the same value
+	remarshaled, err := marshaler.Marshal(unmarshaledMsg)
+	require.NoError(t, err)
+	assert.Equal(t, "bar", remarshaled.Headers["foo"])
+	assert.NotContains(t, remarshaled.Headers, "amqp_header_foo")
+
+	msg.Metadata.Set("amqp_header_foo", "baz")
+	_, err = marshaler.Marshal(msg)
+	assert.Error(t, err)
+}
+
+func TestDefaultMarshaler_nil_payload(t *testing.T) {
+	marshaler := amqp.DefaultMarshaler{}
+
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+
+	marshaled, err := marshaler.Marshal(msg)
+	require.NoError(t, err)
+	assert.NotNil(t, marshaled.Body)
+	assert.Len(t, marshaled.Body, 0)
+
+	for _, body := range [][]byte{nil, {}} {
+		delivery := publishingToDelivery(marshaled)
+		delivery.Body = body
+
+		unmarshaledMsg, err := marshaler.Unmarshal(delivery)
+		require.NoError(t, err)
+		assert.NotNil(t, unmarshaledMsg.Payload)
+		assert.Len(t, unmarshaledMsg.Payload, 0)
+	}
+
+	_, err = amqp.DefaultMarshaler{RejectNilPayload: true}.Marshal(msg)
+	assert.Error(t, err)
+
+	_, err = amqp.DefaultMarshaler{RejectNilPayload: true}.Marshal(message.NewMessage(watermill.NewUUID(), []byte{}))
+	assert.NoError(t, err)
+}
+
+func TestRPCMarshaler(t *testing.T) {
+	marshaler := amqp.RPCMarshaler{}
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	msg.Metadata.Set(amqp.ReplyToMetadataKey, "reply_queue")
+	msg.Metadata.Set(amqp.CorrelationIDMetadataKey, "correlation")
+
+	marshaled, err := marshaler.Marshal(msg)
+	require.NoError(t, err)
+
+	assert.Equal(t, "reply_queue", marshaled.ReplyTo)
+	assert.Equal(t, "correlation", marshaled.CorrelationId)
+
+	delivery := publishingToDelivery(marshaled)
+	delivery.ReplyTo = marshaled.ReplyTo
+	delivery.CorrelationId = marshaled.CorrelationId
+
+	unmarshaledMsg, err := marshaler.Unmarshal(delivery)
+	require.NoError(t, err)
+
+	assert.True(t, msg.Equals(unmarshaledMsg))
+}
+
+func TestGzipMarshaler(t *testing.T) {
+	marshaler := amqp.GzipMarshaler{MinSize: 100}
+
+	largeMsg := message.NewMessage(watermill.NewUUID(), bytes.Repeat([]byte("payload"), 100))
+	largeMsg.Metadata.Set("foo", "bar")
+
+	marshaled, err := marshaler.Marshal(largeMsg)
+	require.NoError(t, err)
+	assert.Equal(t, amqp.GzipContentEncoding, marshaled.ContentEncoding)
+	assert.True(t, len(marshaled.Body) < len(largeMsg.Payload))
+
+	delivery := publishingToDelivery(marshaled)
+	delivery.ContentEncoding = marshaled.ContentEncoding
+
+	unmarshaledMsg, err := marshaler.Unmarshal(delivery)
+	require.NoError(t, err)
+	assert.True(t, largeMsg.Equals(unmarshaledMsg))
+
+	smallMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+
+	marshaled, err = marshaler.Marshal(smallMsg)
+	require.NoError(t, err)
+	assert.Empty(t, marshaled.ContentEncoding)
+	assert.Equal(t, smallMsg.Payload, message.Payload(marshaled.Body))
+
+	// not compressed messages from other producers are consumed as well
+	unmarshaledMsg, err = marshaler.Unmarshal(publishingToDelivery(marshaled))
+	require.NoError(t, err)
+	assert.True(t, smallMsg.Equals(unmarshaledMsg))
+}
+
 func BenchmarkDefaultMarshaler_Marshal(b *testing.B) {
 	m := amqp.DefaultMarshaler{}
 
@@ -95,3 +263,211 @@ func publishingToDelivery(marshaled stdAmqp.Publishing) stdAmqp.Delivery {
 		Headers: marshaled.Headers,
 	}
 }
+
+func TestDefaultMarshaler_retry_count(t *testing.T) {
+	marshaler := amqp.DefaultMarshaler{}
+
+	marshaled, err := marshaler.Marshal(message.NewMessage(watermill.NewUUID(), []byte("payload")))
+	require.NoError(t, err)
+
+	delivery := publishingToDelivery(marshaled)
+	delivery.Headers[amqp.RetryCountHeader] = int64(2)
+
+	unmarshaledMsg, err := marshaler.Unmarshal(delivery)
+	require.NoError(t, err)
+
+	assert.Equal(t, "2", unmarshaledMsg.Metadata.Get(amqp.RetryCountHeader))
+}
+
+func TestDefaultMarshaler_non_string_headers(t *testing.T) {
+	marshaler := amqp.DefaultMarshaler{}
+
+	marshaled, err := marshaler.Marshal(message.NewMessage(watermill.NewUUID(), []byte("payload")))
+	require.NoError(t, err)
+
+	timestamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+
+	headers := map[string]interface{}{
+		"int8":      int8(-8),
+		"uint16":    uint16(16),
+		"int32":     int32(32),
+		"int64":     int64(64),
+		"float64":   1.5,
+		"bool":      true,
+		"nil":       nil,
+		"bytes":     []byte("bytes"),
+		"timestamp": timestamp,
+		"decimal":   stdAmqp.Decimal{Scale: 2, Value: 12345},
+		"array":     []interface{}{"a", int64(1), true},
+		"table":     stdAmqp.Table{"b": int32(2), "a": "1", "nested": stdAmqp.Table{"c": nil}},
+	}
+	expected := map[string]string{
+		"int8":      "-8",
+		"uint16":    "16",
+		"int32":     "32",
+		"int64":     "64",
+		"float64":   "1.5",
+		"bool":      "true",
+		"nil":       "",
+		"bytes":     "bytes",
+		"timestamp": "2020-01-02T02:04:05Z",
+		"decimal":   "12345e-2",
+		"array":     `["a","1","true"]`,
+		"table":     `{"a":"1","b":"2","nested":"{\"c\":\"\"}"}`,
+	}
+
+	delivery := publishingToDelivery(marshaled)
+	for key, value := range headers {
+		delivery.Headers[key] = value
+	}
+
+	unmarshaledMsg, err := marshaler.Unmarshal(delivery)
+	require.NoError(t, err)
+
+	for key, value := range expected {
+		assert.Equal(t, value, unmarshaledMsg.Metadata.Get(key), key)
+	}
+}
+
+func TestEnvelopeMarshaler(t *testing.T) {
+	marshaler := amqp.EnvelopeMarshaler{}
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	msg.Metadata.Set("foo", "bar")
+	msg.Metadata.Set("empty", "")
+
+	marshaled, err := marshaler.Marshal(msg)
+	require.NoError(t, err)
+	assert.Equal(t, amqp.EnvelopeContentType, marshaled.ContentType)
+	assert.Equal(t, amqp.EnvelopeContentType, amqp.ContentTypeMarshaler(marshaler).ContentType())
+	assert.Equal(t, stdAmqp.Persistent, marshaled.DeliveryMode)
+	assert.Equal(t, msg.UUID, marshaled.Headers[amqp.MessageUUIDHeaderKey])
+
+	delivery := publishingToDelivery(marshaled)
+	// headers are not the source of the message
+	delivery.Headers = stdAmqp.Table{"x-death": []interface{}{}}
+
+	unmarshaledMsg, err := marshaler.Unmarshal(delivery)
+	require.NoError(t, err)
+	assert.True(t, msg.Equals(unmarshaledMsg))
+	assert.Equal(t, "", unmarshaledMsg.Metadata.Get("x-death"))
+
+	_, err = marshaler.Unmarshal(stdAmqp.Delivery{Body: []byte("payload")})
+	assert.Error(t, err)
+
+	_, err = marshaler.Unmarshal(stdAmqp.Delivery{Body: []byte(`{"payload":"cGF5bG9hZA=="}`)})
+	assert.Error(t, err)
+}
+
+func TestEnvelopeMarshaler_empty_payload(t *testing.T) {
+	marshaler := amqp.EnvelopeMarshaler{NotPersistentDeliveryMode: true}
+
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+
+	marshaled, err := marshaler.Marshal(msg)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, marshaled.DeliveryMode)
+
+	unmarshaledMsg, err := marshaler.Unmarshal(publishingToDelivery(marshaled))
+	require.NoError(t, err)
+	assert.Equal(t, msg.UUID, unmarshaledMsg.UUID)
+	assert.Empty(t, unmarshaledMsg.Payload)
+	assert.Empty(t, unmarshaledMsg.Metadata)
+}
+
+func TestDefaultMarshaler_expiration_from_context_deadline(t *testing.T) {
+	marshaler := amqp.DefaultMarshaler{ExpirationFromContextDeadline: true}
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	marshaled, err := marshaler.Marshal(msg)
+	require.NoError(t, err)
+	assert.Empty(t, marshaled.Expiration, "message without deadline should not expire")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	msg.SetContext(ctx)
+
+	marshaled, err = marshaler.Marshal(msg)
+	require.NoError(t, err)
+	expiration, err := strconv.ParseInt(marshaled.Expiration, 10, 64)
+	require.NoError(t, err)
+	assert.True(t, expiration > 59000 && expiration <= 60000, "unexpected expiration %d", expiration)
+
+	expiredCtx, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	msg.SetContext(expiredCtx)
+
+	marshaled, err = marshaler.Marshal(msg)
+	require.NoError(t, err)
+	assert.Equal(t, "0", marshaled.Expiration)
+
+	marshaled, err = amqp.DefaultMarshaler{}.Marshal(msg)
+	require.NoError(t, err)
+	assert.Empty(t, marshaled.Expiration)
+}
+
+func TestDefaultMarshaler_death_reason(t *testing.T) {
+	marshaler := amqp.DefaultMarshaler{}
+
+	marshaled, err := marshaler.Marshal(message.NewMessage(watermill.NewUUID(), []byte("payload")))
+	require.NoError(t, err)
+
+	testCases := []struct {
+		Name           string
+		Headers        stdAmqp.Table
+		ExpectedReason string
+		ExpectedQueue  string
+		ExpectedCount  string
+	}{
+		{
+			Name: "x-death",
+			Headers: stdAmqp.Table{
+				"x-death": []interface{}{
+					stdAmqp.Table{"reason": "expired", "queue": "orders_delay", "count": int64(2)},
+					stdAmqp.Table{"reason": "rejected", "queue": "orders", "count": int64(1)},
+				},
+				"x-first-death-reason": "rejected",
+				"x-first-death-queue":  "orders",
+			},
+			ExpectedReason: amqp.DeathReasonExpired,
+			ExpectedQueue:  "orders_delay",
+			ExpectedCount:  "2",
+		},
+		{
+			Name: "only_first_death_headers",
+			Headers: stdAmqp.Table{
+				"x-first-death-reason": "maxlen",
+				"x-first-death-queue":  "orders",
+			},
+			ExpectedReason: amqp.DeathReasonMaxLen,
+			ExpectedQueue:  "orders",
+		},
+		{
+			Name: "invalid_x-death",
+			Headers: stdAmqp.Table{
+				"x-death": []interface{}{"rejected"},
+			},
+		},
+		{
+			Name:    "not_dead-lettered",
+			Headers: stdAmqp.Table{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			delivery := publishingToDelivery(marshaled)
+			delivery.Headers = stdAmqp.Table{amqp.MessageUUIDHeaderKey: marshaled.Headers[amqp.MessageUUIDHeaderKey]}
+			for key, value := range tc.Headers {
+				delivery.Headers[key] = value
+			}
+
+			msg, err := marshaler.Unmarshal(delivery)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.ExpectedReason, msg.Metadata.Get(amqp.DeathReasonMetadataKey))
+			assert.Equal(t, tc.ExpectedQueue, msg.Metadata.Get(amqp.DeathQueueMetadataKey))
+			assert.Equal(t, tc.ExpectedCount, msg.Metadata.Get(amqp.DeathCountMetadataKey))
+		})
+	}
+}
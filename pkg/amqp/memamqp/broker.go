@@ -0,0 +1,774 @@
+// Package memamqp provides in-memory test double of the AMQP broker.
+//
+// Broker implements amqp.AMQPConnection and amqp.AMQPChannel, so the real amqp.Publisher and amqp.Subscriber
+// run on top of it (see NewPublisher and NewSubscriber, or set Config.Connection.Dial to Broker.Dial).
+// Topology is declared, messages are published, consumed, acked and reconnected by the same code,
+// which is used with RabbitMQ.
+//
+// It allows to test handlers without running RabbitMQ. It's not a replacement for integration tests,
+// only the subset of the broker's behavior used by the Pub/Sub is emulated:
+//   - "direct", "fanout", "topic" and "headers" exchanges, the default exchange and pre-declared "amq.*" exchanges,
+//     exchanges of broker plugins (like "x-delayed-message") are rejected,
+//   - publisher confirms, transactions (only for publishing), mandatory flag and returns,
+//   - consumer prefetch (prefetch size is ignored), exclusive consumers and single active consumer,
+//   - requeueing of unacked messages when the channel is closed,
+//   - dead lettering of rejected and expired messages, with message and queue TTL,
+//   - server named, exclusive and auto-delete queues,
+//   - channel errors for missing or inequivalent topology and unknown delivery tags, which close the channel
+//     like the broker does.
+//
+// Messages are not persisted, queue length limits, priorities, consumer priorities, flow control and
+// user ID validation are not emulated. Connections can be closed with CloseConnections and blocked with Block,
+// to test reconnecting and blocked publishing.
+package memamqp
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	stdAmqp "github.com/streadway/amqp"
+
+	"github.com/ThreeDotsLabs/watermill-amqp/pkg/amqp"
+)
+
+// Broker is an in-memory AMQP broker shared by Publishers and Subscribers.
+type Broker struct {
+	// lock guards the whole state of the broker, including connections, channels and consumers
+	lock        sync.Mutex
+	exchanges   map[string]*exchange
+	queues      map[string]*queue
+	connections map[*connection]struct{}
+
+	// messageSeq is the sequence number of the last enqueued message, it keeps order of requeued messages
+	messageSeq uint64
+
+	blocked       bool
+	blockedReason string
+}
+
+func NewBroker() *Broker {
+	b := &Broker{
+		exchanges:   map[string]*exchange{},
+		queues:      map[string]*queue{},
+		connections: map[*connection]struct{}{},
+	}
+
+	for name, kind := range map[string]string{
+		"amq.direct":  stdAmqp.ExchangeDirect,
+		"amq.fanout":  stdAmqp.ExchangeFanout,
+		"amq.topic":   stdAmqp.ExchangeTopic,
+		"amq.headers": stdAmqp.ExchangeHeaders,
+		"amq.match":   stdAmqp.ExchangeHeaders,
+	} {
+		b.exchanges[name] = &exchange{name: name, kind: kind, durable: true}
+	}
+
+	return b
+}
+
+// Dial opens a new connection to the broker, it can be used as Config.Connection.Dial.
+// amqpURI is ignored.
+func (b *Broker) Dial(amqpURI string) (amqp.AMQPConnection, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	c := newConnection(b)
+	b.connections[c] = struct{}{}
+
+	return c, nil
+}
+
+// QueueLength returns number of messages in the queue, which are not delivered to any consumer.
+func (b *Broker) QueueLength(queueName string) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	q, ok := b.queues[queueName]
+	if !ok {
+		return 0
+	}
+
+	b.expire(q)
+
+	return len(q.ready)
+}
+
+// CloseConnections closes all connections with the connection-forced error, like when the broker is restarted.
+// Unacked messages are requeued, topology and messages are kept (apart from exclusive queues).
+// Publishers and Subscribers reconnect like to RabbitMQ.
+func (b *Broker) CloseConnections() {
+	b.lock.Lock()
+	closeErr := &stdAmqp.Error{
+		Code:   stdAmqp.ConnectionForced,
+		Reason: "CONNECTION_FORCED - broker forced connection closure with reason 'shutdown'",
+		Server: true,
+	}
+
+	var notifications []func()
+	for c := range b.connections {
+		notifications = append(notifications, c.shutdown(closeErr))
+	}
+	b.lock.Unlock()
+
+	for _, notify := range notifications {
+		go notify()
+	}
+}
+
+// Block sends connection.blocked to all connections, like when the broker raised a memory or disk alarm.
+// Until Unblock is called, messages published on any connection are not routed and not confirmed,
+// like when the broker stops reading from the connection.
+func (b *Broker) Block(reason string) {
+	b.lock.Lock()
+	b.blocked = true
+	b.blockedReason = reason
+	connections := b.connectionsSnapshot()
+	b.lock.Unlock()
+
+	for _, c := range connections {
+		c.syncBlocking()
+	}
+}
+
+// Unblock sends connection.unblocked to all connections and routes messages published while the broker was blocked.
+func (b *Broker) Unblock() {
+	b.lock.Lock()
+	b.blocked = false
+	b.blockedReason = ""
+	connections := b.connectionsSnapshot()
+	b.lock.Unlock()
+
+	for _, c := range connections {
+		c.syncBlocking()
+		c.flushBlocked()
+	}
+}
+
+func (b *Broker) connectionsSnapshot() []*connection {
+	connections := make([]*connection, 0, len(b.connections))
+	for c := range b.connections {
+		connections = append(connections, c)
+	}
+
+	return connections
+}
+
+type exchange struct {
+	name       string
+	kind       string
+	durable    bool
+	autoDelete bool
+	internal   bool
+	bindings   []binding
+}
+
+type binding struct {
+	queue      *queue
+	routingKey string
+	args       stdAmqp.Table
+}
+
+func (e *exchange) matches(b binding, routingKey string, headers stdAmqp.Table) bool {
+	switch e.kind {
+	case stdAmqp.ExchangeFanout:
+		return true
+	case stdAmqp.ExchangeDirect:
+		return b.routingKey == routingKey
+	case stdAmqp.ExchangeTopic:
+		return topicMatches(strings.Split(b.routingKey, "."), strings.Split(routingKey, "."))
+	case stdAmqp.ExchangeHeaders:
+		return headersMatch(b.args, headers)
+	default:
+		return false
+	}
+}
+
+// topicMatches matches routing key words against binding key words,
+// where "*" matches exactly one word and "#" matches zero or more words.
+func topicMatches(bindingWords []string, routingWords []string) bool {
+	if len(bindingWords) == 0 {
+		return len(routingWords) == 0
+	}
+
+	switch bindingWords[0] {
+	case "#":
+		for i := 0; i <= len(routingWords); i++ {
+			if topicMatches(bindingWords[1:], routingWords[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(routingWords) > 0 && topicMatches(bindingWords[1:], routingWords[1:])
+	default:
+		return len(routingWords) > 0 &&
+			bindingWords[0] == routingWords[0] &&
+			topicMatches(bindingWords[1:], routingWords[1:])
+	}
+}
+
+// headersMatch matches headers against binding arguments, according to "x-match" ("all" by default or "any").
+// Arguments starting with "x-" are not matched.
+func headersMatch(bindingArgs stdAmqp.Table, headers stdAmqp.Table) bool {
+	matchAny := bindingArgs["x-match"] == "any"
+
+	matched := 0
+	expected := 0
+	for key, value := range bindingArgs {
+		if strings.HasPrefix(key, "x-") {
+			continue
+		}
+		expected++
+
+		if headerValue, ok := headers[key]; ok && reflect.DeepEqual(headerValue, value) {
+			matched++
+		}
+	}
+
+	if matchAny {
+		return matched > 0
+	}
+
+	return matched == expected
+}
+
+// route returns queues to which the message published to the exchange with routingKey is routed.
+func (b *Broker) route(exchangeName string, routingKey string, headers stdAmqp.Table) ([]*queue, *stdAmqp.Error) {
+	if exchangeName == "" {
+		// default exchange routes to the queue with name equal to the routing key
+		if q, ok := b.queues[routingKey]; ok {
+			return []*queue{q}, nil
+		}
+		return nil, nil
+	}
+
+	e, ok := b.exchanges[exchangeName]
+	if !ok {
+		return nil, notFound("no exchange '%s' in vhost '/'", exchangeName)
+	}
+
+	var queues []*queue
+	routed := map[*queue]struct{}{}
+	for _, binding := range e.bindings {
+		if _, ok := routed[binding.queue]; ok || !e.matches(binding, routingKey, headers) {
+			continue
+		}
+
+		routed[binding.queue] = struct{}{}
+		queues = append(queues, binding.queue)
+	}
+
+	return queues, nil
+}
+
+var exchangeKinds = map[string]struct{}{
+	stdAmqp.ExchangeDirect:  {},
+	stdAmqp.ExchangeFanout:  {},
+	stdAmqp.ExchangeTopic:   {},
+	stdAmqp.ExchangeHeaders: {},
+}
+
+func (b *Broker) declareExchange(name, kind string, durable, autoDelete, internal bool) *stdAmqp.Error {
+	if name == "" {
+		return accessRefused("operation not permitted on the default exchange")
+	}
+
+	if e, ok := b.exchanges[name]; ok {
+		switch {
+		case e.kind != kind:
+			return inequivalentArg("type", "exchange", name, kind, e.kind)
+		case e.durable != durable:
+			return inequivalentArg("durable", "exchange", name, durable, e.durable)
+		case e.autoDelete != autoDelete:
+			return inequivalentArg("auto_delete", "exchange", name, autoDelete, e.autoDelete)
+		case e.internal != internal:
+			return inequivalentArg("internal", "exchange", name, internal, e.internal)
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(name, "amq.") {
+		return accessRefused("exchange name '%s' contains reserved prefix 'amq.*'", name)
+	}
+	if _, ok := exchangeKinds[kind]; !ok {
+		return commandInvalid("unknown exchange type '%s'", kind)
+	}
+
+	b.exchanges[name] = &exchange{
+		name:       name,
+		kind:       kind,
+		durable:    durable,
+		autoDelete: autoDelete,
+		internal:   internal,
+	}
+
+	return nil
+}
+
+// namedExchange returns the exchange to which queues can be bound.
+func (b *Broker) namedExchange(name string) (*exchange, *stdAmqp.Error) {
+	if name == "" {
+		return nil, accessRefused("operation not permitted on the default exchange")
+	}
+
+	e, ok := b.exchanges[name]
+	if !ok {
+		return nil, notFound("no exchange '%s' in vhost '/'", name)
+	}
+
+	return e, nil
+}
+
+func (b *Broker) bindQueue(q *queue, routingKey string, e *exchange, args stdAmqp.Table) {
+	newBinding := binding{queue: q, routingKey: routingKey, args: args}
+	for _, existing := range e.bindings {
+		if existing.queue == q && existing.routingKey == routingKey && reflect.DeepEqual(existing.args, args) {
+			return
+		}
+	}
+
+	e.bindings = append(e.bindings, newBinding)
+}
+
+func (b *Broker) unbindQueue(q *queue, routingKey string, e *exchange, args stdAmqp.Table) {
+	b.removeBindings(e, func(existing binding) bool {
+		return existing.queue == q && existing.routingKey == routingKey && reflect.DeepEqual(existing.args, args)
+	})
+}
+
+// removeBindings removes matching bindings of the exchange. Auto-delete exchange is deleted
+// when its last binding is removed.
+func (b *Broker) removeBindings(e *exchange, matches func(binding) bool) {
+	bindings := e.bindings[:0]
+	for _, existing := range e.bindings {
+		if !matches(existing) {
+			bindings = append(bindings, existing)
+		}
+	}
+
+	removed := len(bindings) < len(e.bindings)
+	e.bindings = bindings
+
+	if removed && e.autoDelete && len(e.bindings) == 0 {
+		delete(b.exchanges, e.name)
+	}
+}
+
+// equivalentQueueArgs are queue arguments, which must be the same when the queue is redeclared.
+var equivalentQueueArgs = []string{
+	"x-dead-letter-exchange",
+	"x-dead-letter-routing-key",
+	"x-expires",
+	"x-max-length",
+	"x-max-length-bytes",
+	"x-max-priority",
+	"x-message-ttl",
+	"x-overflow",
+	"x-queue-mode",
+	"x-queue-type",
+	"x-single-active-consumer",
+}
+
+func (b *Broker) declareQueue(
+	owner *connection,
+	name string,
+	durable, autoDelete, exclusive bool,
+	args stdAmqp.Table,
+) (*queue, *stdAmqp.Error) {
+	if name == "" {
+		name = "amq.gen-" + watermill.NewShortUUID()
+	} else if q, ok := b.queues[name]; ok {
+		if err := q.checkAccess(owner); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case q.durable != durable:
+			return nil, inequivalentArg("durable", "queue", name, durable, q.durable)
+		case q.autoDelete != autoDelete:
+			return nil, inequivalentArg("auto_delete", "queue", name, autoDelete, q.autoDelete)
+		}
+		for _, arg := range equivalentQueueArgs {
+			if !equalArgs(args[arg], q.args[arg]) {
+				return nil, inequivalentArg(arg, "queue", name, args[arg], q.args[arg])
+			}
+		}
+
+		return q, nil
+	} else if strings.HasPrefix(name, "amq.") {
+		return nil, accessRefused("queue name '%s' contains reserved prefix 'amq.*'", name)
+	}
+
+	q := &queue{
+		name:       name,
+		durable:    durable,
+		autoDelete: autoDelete,
+		exclusive:  exclusive,
+		args:       args,
+	}
+	if exclusive {
+		q.owner = owner
+	}
+	b.queues[name] = q
+
+	return q, nil
+}
+
+// accessibleQueue returns the queue, which can be used by the connection.
+func (b *Broker) accessibleQueue(c *connection, name string) (*queue, *stdAmqp.Error) {
+	q, ok := b.queues[name]
+	if !ok {
+		return nil, notFound("no queue '%s' in vhost '/'", name)
+	}
+
+	if err := q.checkAccess(c); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// deleteQueue deletes the queue with its bindings and cancels its consumers.
+// It returns the number of messages, which were not delivered.
+func (b *Broker) deleteQueue(q *queue) int {
+	q.deleted = true
+	delete(b.queues, q.name)
+
+	for _, e := range b.exchanges {
+		b.removeBindings(e, func(existing binding) bool {
+			return existing.queue == q
+		})
+	}
+
+	// consumers of the deleted queue are cancelled by the broker
+	for _, c := range q.consumers {
+		delete(c.channel.consumers, c.tag)
+		c.close()
+	}
+	q.consumers = nil
+
+	deleted := len(q.ready)
+	q.ready = nil
+
+	return deleted
+}
+
+// removeConsumer removes the consumer from its queue. Auto-delete queue is deleted,
+// when its last consumer is removed.
+func (b *Broker) removeConsumer(c *consumer) {
+	q := c.queue
+
+	for i, existing := range q.consumers {
+		if existing == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+
+	if q.autoDelete && len(q.consumers) == 0 && !q.deleted {
+		b.deleteQueue(q)
+		return
+	}
+
+	b.dispatch(q)
+}
+
+// enqueue adds the delivery to the queue and delivers it when there is a consumer.
+func (b *Broker) enqueue(q *queue, delivery stdAmqp.Delivery) {
+	b.messageSeq++
+	m := &queuedMessage{seq: b.messageSeq, delivery: delivery}
+
+	if ttl, ok := q.messageTTL(delivery); ok {
+		m.expiresAt = time.Now().Add(ttl)
+		b.scheduleExpiration(q, m.expiresAt)
+	}
+
+	q.ready = append(q.ready, m)
+	b.dispatch(q)
+}
+
+// requeue returns the message to the queue, on its original position.
+func (b *Broker) requeue(q *queue, m *queuedMessage) {
+	if q.deleted {
+		return
+	}
+
+	m.delivery.Redelivered = true
+	q.insert(m)
+
+	if !m.expiresAt.IsZero() {
+		b.scheduleExpiration(q, m.expiresAt)
+	}
+}
+
+func (b *Broker) scheduleExpiration(q *queue, at time.Time) {
+	time.AfterFunc(time.Until(at), func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		b.dispatch(q)
+	})
+}
+
+// expire dead-letters expired messages from the head of the queue.
+// Like in RabbitMQ, messages are expired only when they reach the head of the queue.
+func (b *Broker) expire(q *queue) {
+	now := time.Now()
+
+	for len(q.ready) > 0 && q.ready[0].expired(now) {
+		m := q.ready[0]
+		q.ready = q.ready[1:]
+
+		b.deadLetter(q, m, amqp.DeathReasonExpired)
+	}
+}
+
+// dispatch delivers messages of the queue to the consumers with free prefetch capacity, in round-robin.
+func (b *Broker) dispatch(q *queue) {
+	if q.deleted {
+		return
+	}
+
+	for {
+		b.expire(q)
+		if len(q.ready) == 0 {
+			return
+		}
+
+		c := q.nextConsumer()
+		if c == nil {
+			return
+		}
+
+		m := q.ready[0]
+		q.ready = q.ready[1:]
+
+		c.push(c.channel.deliver(q, m, c, c.noAck))
+	}
+}
+
+// deadLetter publishes the message to the queue's dead letter exchange ("x-dead-letter-exchange" argument).
+// Message is dropped, when the queue has no dead letter exchange or the exchange doesn't exist.
+func (b *Broker) deadLetter(q *queue, m *queuedMessage, reason string) {
+	deadLetterExchange, ok := q.args["x-dead-letter-exchange"].(string)
+	if !ok {
+		return
+	}
+
+	delivery := m.delivery
+	routingKey := delivery.RoutingKey
+	if deadLetterRoutingKey, ok := q.args["x-dead-letter-routing-key"].(string); ok {
+		routingKey = deadLetterRoutingKey
+	}
+
+	headers := copyTable(delivery.Headers)
+	headers["x-death"] = addDeath(headers["x-death"], stdAmqp.Table{
+		"count":        int64(1),
+		"reason":       reason,
+		"queue":        q.name,
+		"time":         time.Now(),
+		"exchange":     delivery.Exchange,
+		"routing-keys": []interface{}{delivery.RoutingKey},
+	})
+	for key, value := range map[string]string{
+		"x-first-death-reason":   reason,
+		"x-first-death-queue":    q.name,
+		"x-first-death-exchange": delivery.Exchange,
+	} {
+		if _, ok := headers[key]; !ok {
+			headers[key] = value
+		}
+	}
+
+	delivery.Headers = headers
+	delivery.Exchange = deadLetterExchange
+	delivery.RoutingKey = routingKey
+	delivery.Redelivered = false
+	// per-message TTL is removed, so the message doesn't expire again in the dead letter queue
+	delivery.Expiration = ""
+
+	queues, err := b.route(deadLetterExchange, routingKey, headers)
+	if err != nil {
+		return
+	}
+	for _, target := range queues {
+		b.enqueue(target, delivery)
+	}
+}
+
+// addDeath adds death to x-death header. Like in RabbitMQ, deaths are counted for every queue and reason pair,
+// and the most recent one is the first.
+func addDeath(xDeath interface{}, death stdAmqp.Table) []interface{} {
+	deaths, _ := xDeath.([]interface{})
+
+	updated := []interface{}{death}
+	for _, existing := range deaths {
+		existingDeath, ok := existing.(stdAmqp.Table)
+		if ok && existingDeath["queue"] == death["queue"] && existingDeath["reason"] == death["reason"] {
+			count, _ := existingDeath["count"].(int64)
+			death["count"] = count + 1
+			continue
+		}
+
+		updated = append(updated, existing)
+	}
+
+	return updated
+}
+
+type queue struct {
+	name       string
+	durable    bool
+	autoDelete bool
+	exclusive  bool
+	args       stdAmqp.Table
+	// owner is the connection which declared the exclusive queue
+	owner *connection
+
+	ready         []*queuedMessage
+	consumers     []*consumer
+	consumerIndex int
+	deleted       bool
+}
+
+type queuedMessage struct {
+	seq       uint64
+	delivery  stdAmqp.Delivery
+	expiresAt time.Time
+}
+
+func (m *queuedMessage) expired(now time.Time) bool {
+	return !m.expiresAt.IsZero() && !now.Before(m.expiresAt)
+}
+
+func (q *queue) checkAccess(c *connection) *stdAmqp.Error {
+	if q.exclusive && q.owner != c {
+		return resourceLocked("cannot obtain exclusive access to locked queue '%s' in vhost '/'", q.name)
+	}
+
+	return nil
+}
+
+// insert adds the message to the ready messages, ordered by sequence number.
+func (q *queue) insert(m *queuedMessage) {
+	i := len(q.ready)
+	for i > 0 && q.ready[i-1].seq > m.seq {
+		i--
+	}
+
+	q.ready = append(q.ready, nil)
+	copy(q.ready[i+1:], q.ready[i:])
+	q.ready[i] = m
+}
+
+// messageTTL returns the time to live of the message, the lower of "x-message-ttl" queue argument
+// and the message Expiration.
+func (q *queue) messageTTL(delivery stdAmqp.Delivery) (time.Duration, bool) {
+	ttl, ok := tableInt(q.args["x-message-ttl"])
+
+	if delivery.Expiration != "" {
+		if expiration, err := strconv.ParseInt(delivery.Expiration, 10, 64); err == nil && (!ok || expiration < ttl) {
+			ttl, ok = expiration, true
+		}
+	}
+
+	return time.Duration(ttl) * time.Millisecond, ok
+}
+
+// nextConsumer returns the next consumer with free prefetch capacity, or nil when there is none.
+// With "x-single-active-consumer", only the first consumer receives messages.
+func (q *queue) nextConsumer() *consumer {
+	candidates := q.consumers
+	if singleActive, _ := q.args["x-single-active-consumer"].(bool); singleActive && len(candidates) > 0 {
+		candidates = candidates[:1]
+	}
+
+	for i := 0; i < len(candidates); i++ {
+		index := (q.consumerIndex + i) % len(candidates)
+		if candidates[index].hasCapacity() {
+			q.consumerIndex = index + 1
+			return candidates[index]
+		}
+	}
+
+	return nil
+}
+
+func (q *queue) hasExclusiveConsumer() bool {
+	for _, c := range q.consumers {
+		if c.exclusive {
+			return true
+		}
+	}
+
+	return false
+}
+
+func publishingToDelivery(exchangeName string, routingKey string, publishing stdAmqp.Publishing) stdAmqp.Delivery {
+	return stdAmqp.Delivery{
+		Headers:         copyTable(publishing.Headers),
+		ContentType:     publishing.ContentType,
+		ContentEncoding: publishing.ContentEncoding,
+		DeliveryMode:    publishing.DeliveryMode,
+		Priority:        publishing.Priority,
+		CorrelationId:   publishing.CorrelationId,
+		ReplyTo:         publishing.ReplyTo,
+		Expiration:      publishing.Expiration,
+		MessageId:       publishing.MessageId,
+		Timestamp:       publishing.Timestamp,
+		Type:            publishing.Type,
+		UserId:          publishing.UserId,
+		AppId:           publishing.AppId,
+		Exchange:        exchangeName,
+		RoutingKey:      routingKey,
+		Body:            publishing.Body,
+	}
+}
+
+func copyTable(table stdAmqp.Table) stdAmqp.Table {
+	copied := make(stdAmqp.Table, len(table))
+	for key, value := range table {
+		copied[key] = value
+	}
+
+	return copied
+}
+
+// tableInt returns the integer value of the table field, which may have any integer type.
+func tableInt(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
+
+// equalArgs compares argument values, integers are equal regardless of their type.
+func equalArgs(a, b interface{}) bool {
+	aInt, aIsInt := tableInt(a)
+	bInt, bIsInt := tableInt(b)
+	if aIsInt && bIsInt {
+		return aInt == bInt
+	}
+
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,854 @@
+package memamqp
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill"
+	stdAmqp "github.com/streadway/amqp"
+
+	"github.com/ThreeDotsLabs/watermill-amqp/pkg/amqp"
+)
+
+// channel implements amqp.AMQPChannel.
+//
+// Like in github.com/streadway/amqp, errors of asynchronous methods (like Publish or Ack) and methods called
+// with noWait are not returned, the channel is closed and the error is sent to NotifyClose listeners.
+type channel struct {
+	conn   *connection
+	broker *Broker
+
+	// publishLock serializes publishing, so confirms and returns are sent in the order of publishings
+	publishLock sync.Mutex
+
+	// fields below are guarded by Broker.lock
+	closed             bool
+	confirmMode        bool
+	publishSeq         uint64
+	txMode             bool
+	txPublishings      []publishing
+	blockedPublishings []publishing
+	consumers          map[string]*consumer
+	unacked            map[uint64]*unackedDelivery
+	deliveryTag        uint64
+	prefetchCount      int
+	prefetchGlobal     bool
+
+	listeners channelListeners
+}
+
+type publishing struct {
+	exchange   string
+	routingKey string
+	mandatory  bool
+	msg        stdAmqp.Publishing
+	// confirmTag is the delivery tag of the confirmation, it's zero when the channel is not in confirm mode
+	confirmTag uint64
+}
+
+type unackedDelivery struct {
+	queue   *queue
+	message *queuedMessage
+	// consumer is nil for deliveries received with Get
+	consumer *consumer
+}
+
+func newChannel(conn *connection) *channel {
+	return &channel{
+		conn:      conn,
+		broker:    conn.broker,
+		consumers: map[string]*consumer{},
+		unacked:   map[uint64]*unackedDelivery{},
+	}
+}
+
+// fail closes the channel with the error. It must be called with Broker.lock held.
+// Error is returned only when the caller waits for the broker's response (noWait is false).
+func (ch *channel) fail(err *stdAmqp.Error, noWait bool) error {
+	go ch.shutdown(err)()
+
+	if noWait {
+		return nil
+	}
+	return err
+}
+
+func (ch *channel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return stdAmqp.ErrClosed
+	}
+
+	ch.prefetchCount = prefetchCount
+	ch.prefetchGlobal = global
+	ch.dispatchConsumed()
+
+	return nil
+}
+
+func (ch *channel) Confirm(noWait bool) error {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return stdAmqp.ErrClosed
+	}
+	if ch.txMode {
+		return ch.fail(preconditionFailed("cannot switch from tx to confirm mode"), noWait)
+	}
+
+	ch.confirmMode = true
+
+	return nil
+}
+
+func (ch *channel) NotifyClose(c chan *stdAmqp.Error) chan *stdAmqp.Error {
+	ch.listeners.register(func() { ch.listeners.closes = append(ch.listeners.closes, c) }, func() { close(c) })
+	return c
+}
+
+// NotifyFlow registers the listener, flow control is not emulated, so it never receives notifications.
+func (ch *channel) NotifyFlow(c chan bool) chan bool {
+	ch.listeners.register(func() { ch.listeners.flows = append(ch.listeners.flows, c) }, func() { close(c) })
+	return c
+}
+
+func (ch *channel) NotifyReturn(c chan stdAmqp.Return) chan stdAmqp.Return {
+	ch.listeners.register(func() { ch.listeners.returns = append(ch.listeners.returns, c) }, func() { close(c) })
+	return c
+}
+
+func (ch *channel) NotifyPublish(confirm chan stdAmqp.Confirmation) chan stdAmqp.Confirmation {
+	ch.listeners.register(
+		func() { ch.listeners.confirms = append(ch.listeners.confirms, confirm) },
+		func() { close(confirm) },
+	)
+	return confirm
+}
+
+func (ch *channel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args stdAmqp.Table) error {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return stdAmqp.ErrClosed
+	}
+
+	if err := ch.broker.declareExchange(name, kind, durable, autoDelete, internal); err != nil {
+		return ch.fail(err, noWait)
+	}
+
+	return nil
+}
+
+func (ch *channel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args stdAmqp.Table) (stdAmqp.Queue, error) {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return stdAmqp.Queue{}, stdAmqp.ErrClosed
+	}
+
+	q, err := ch.broker.declareQueue(ch.conn, name, durable, autoDelete, exclusive, args)
+	if err != nil {
+		return stdAmqp.Queue{}, ch.fail(err, noWait)
+	}
+
+	return stdAmqp.Queue{Name: q.name, Messages: len(q.ready), Consumers: len(q.consumers)}, nil
+}
+
+func (ch *channel) QueueBind(name, key, exchange string, noWait bool, args stdAmqp.Table) error {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return stdAmqp.ErrClosed
+	}
+
+	q, err := ch.broker.accessibleQueue(ch.conn, name)
+	if err != nil {
+		return ch.fail(err, noWait)
+	}
+	e, err := ch.broker.namedExchange(exchange)
+	if err != nil {
+		return ch.fail(err, noWait)
+	}
+
+	ch.broker.bindQueue(q, key, e, args)
+
+	return nil
+}
+
+func (ch *channel) QueueUnbind(name, key, exchange string, args stdAmqp.Table) error {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return stdAmqp.ErrClosed
+	}
+
+	q, err := ch.broker.accessibleQueue(ch.conn, name)
+	if err != nil {
+		return ch.fail(err, false)
+	}
+	e, err := ch.broker.namedExchange(exchange)
+	if err != nil {
+		return ch.fail(err, false)
+	}
+
+	ch.broker.unbindQueue(q, key, e, args)
+
+	return nil
+}
+
+func (ch *channel) QueuePurge(name string, noWait bool) (int, error) {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return 0, stdAmqp.ErrClosed
+	}
+
+	q, err := ch.broker.accessibleQueue(ch.conn, name)
+	if err != nil {
+		return 0, ch.fail(err, noWait)
+	}
+
+	purged := len(q.ready)
+	q.ready = nil
+
+	return purged, nil
+}
+
+func (ch *channel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return 0, stdAmqp.ErrClosed
+	}
+
+	if _, ok := ch.broker.queues[name]; !ok {
+		// deleting the queue which doesn't exist is not an error
+		return 0, nil
+	}
+	q, err := ch.broker.accessibleQueue(ch.conn, name)
+	if err != nil {
+		return 0, ch.fail(err, noWait)
+	}
+
+	if ifUnused && len(q.consumers) > 0 {
+		return 0, ch.fail(preconditionFailed("queue '%s' in vhost '/' in use", name), noWait)
+	}
+	if ifEmpty && len(q.ready) > 0 {
+		return 0, ch.fail(preconditionFailed("queue '%s' in vhost '/' is not empty", name), noWait)
+	}
+
+	return ch.broker.deleteQueue(q), nil
+}
+
+func (ch *channel) Publish(exchange, key string, mandatory, immediate bool, msg stdAmqp.Publishing) error {
+	ch.publishLock.Lock()
+	defer ch.publishLock.Unlock()
+
+	ch.broker.lock.Lock()
+
+	if ch.closed {
+		ch.broker.lock.Unlock()
+		return stdAmqp.ErrClosed
+	}
+	if immediate {
+		// RabbitMQ doesn't support immediate flag
+		_ = ch.fail(notImplemented("immediate=true"), true)
+		ch.broker.lock.Unlock()
+		return nil
+	}
+
+	p := publishing{exchange: exchange, routingKey: key, mandatory: mandatory, msg: msg}
+	// headers are copied, because the publisher may modify the table after publishing
+	p.msg.Headers = copyTable(msg.Headers)
+
+	if ch.txMode {
+		ch.txPublishings = append(ch.txPublishings, p)
+		ch.broker.lock.Unlock()
+		return nil
+	}
+
+	if ch.confirmMode {
+		ch.publishSeq++
+		p.confirmTag = ch.publishSeq
+	}
+
+	notifications := ch.publishOrBlock([]publishing{p})
+	ch.broker.lock.Unlock()
+
+	ch.listeners.send(notifications)
+
+	return nil
+}
+
+// publishOrBlock routes publishings, or keeps them until the broker is unblocked.
+// It must be called with publishLock and Broker.lock held. Returned notifications must be sent
+// after Broker.lock is released.
+func (ch *channel) publishOrBlock(publishings []publishing) []notification {
+	if ch.broker.blocked || len(ch.blockedPublishings) > 0 {
+		ch.blockedPublishings = append(ch.blockedPublishings, publishings...)
+		return nil
+	}
+
+	var notifications []notification
+	for _, p := range publishings {
+		queues, err := ch.broker.route(p.exchange, p.routingKey, p.msg.Headers)
+		if err == nil && p.exchange != "" && ch.broker.exchanges[p.exchange].internal {
+			err = accessRefused("cannot publish to internal exchange '%s' in vhost '/'", p.exchange)
+		}
+		if err != nil {
+			// next publishings are lost with the closed channel, like in the broker
+			_ = ch.fail(err, true)
+			return notifications
+		}
+
+		for _, q := range queues {
+			ch.broker.enqueue(q, publishingToDelivery(p.exchange, p.routingKey, p.msg))
+		}
+
+		// the broker sends basic.return before the confirm of the unroutable message
+		if len(queues) == 0 && p.mandatory {
+			notifications = append(notifications, notification{returned: &stdAmqp.Return{
+				ReplyCode:       stdAmqp.NoRoute,
+				ReplyText:       "NO_ROUTE",
+				Exchange:        p.exchange,
+				RoutingKey:      p.routingKey,
+				ContentType:     p.msg.ContentType,
+				ContentEncoding: p.msg.ContentEncoding,
+				Headers:         p.msg.Headers,
+				DeliveryMode:    p.msg.DeliveryMode,
+				Priority:        p.msg.Priority,
+				CorrelationId:   p.msg.CorrelationId,
+				ReplyTo:         p.msg.ReplyTo,
+				Expiration:      p.msg.Expiration,
+				MessageId:       p.msg.MessageId,
+				Timestamp:       p.msg.Timestamp,
+				Type:            p.msg.Type,
+				UserId:          p.msg.UserId,
+				AppId:           p.msg.AppId,
+				Body:            p.msg.Body,
+			}})
+		}
+		if p.confirmTag > 0 {
+			notifications = append(notifications, notification{
+				confirmation: &stdAmqp.Confirmation{DeliveryTag: p.confirmTag, Ack: true},
+			})
+		}
+	}
+
+	return notifications
+}
+
+// flushBlocked routes publishings kept while the broker was blocked.
+func (ch *channel) flushBlocked() {
+	ch.publishLock.Lock()
+	defer ch.publishLock.Unlock()
+
+	ch.broker.lock.Lock()
+	if ch.closed || ch.broker.blocked {
+		ch.broker.lock.Unlock()
+		return
+	}
+	publishings := ch.blockedPublishings
+	ch.blockedPublishings = nil
+	notifications := ch.publishOrBlock(publishings)
+	ch.broker.lock.Unlock()
+
+	ch.listeners.send(notifications)
+}
+
+func (ch *channel) Consume(
+	queue, consumerTag string,
+	autoAck, exclusive, noLocal, noWait bool,
+	args stdAmqp.Table,
+) (<-chan stdAmqp.Delivery, error) {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return nil, stdAmqp.ErrClosed
+	}
+
+	q, err := ch.broker.accessibleQueue(ch.conn, queue)
+	if err == nil {
+		if consumerTag == "" {
+			consumerTag = "amq.ctag-" + watermill.NewShortUUID()
+		}
+
+		if _, ok := ch.consumers[consumerTag]; ok {
+			err = notAllowed("attempt to reuse consumer tag '%s'", consumerTag)
+		} else if q.hasExclusiveConsumer() || (exclusive && len(q.consumers) > 0) {
+			err = accessRefused("queue '%s' in vhost '/' in exclusive use", queue)
+		}
+	}
+	if err != nil {
+		if noWait {
+			// deliveries channel is closed with the channel
+			deliveries := make(chan stdAmqp.Delivery)
+			close(deliveries)
+			return deliveries, ch.fail(err, true)
+		}
+		return nil, ch.fail(err, false)
+	}
+
+	c := newConsumer(consumerTag, ch, q, autoAck, exclusive)
+	ch.consumers[consumerTag] = c
+	q.consumers = append(q.consumers, c)
+	go c.run()
+
+	ch.broker.dispatch(q)
+
+	return c.deliveries, nil
+}
+
+func (ch *channel) Cancel(consumer string, noWait bool) error {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return stdAmqp.ErrClosed
+	}
+
+	c, ok := ch.consumers[consumer]
+	if !ok {
+		// like RabbitMQ, cancelling unknown consumer is not an error
+		return nil
+	}
+
+	delete(ch.consumers, consumer)
+	c.close()
+	ch.broker.removeConsumer(c)
+
+	return nil
+}
+
+func (ch *channel) Get(queue string, autoAck bool) (msg stdAmqp.Delivery, ok bool, err error) {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return stdAmqp.Delivery{}, false, stdAmqp.ErrClosed
+	}
+
+	q, amqpErr := ch.broker.accessibleQueue(ch.conn, queue)
+	if amqpErr != nil {
+		return stdAmqp.Delivery{}, false, ch.fail(amqpErr, false)
+	}
+
+	ch.broker.expire(q)
+	if len(q.ready) == 0 {
+		return stdAmqp.Delivery{}, false, nil
+	}
+
+	m := q.ready[0]
+	q.ready = q.ready[1:]
+
+	delivery := ch.deliver(q, m, nil, autoAck)
+	delivery.MessageCount = uint32(len(q.ready))
+
+	return delivery, true, nil
+}
+
+// deliver returns the delivery of the message. Unless noAck is true, it waits for ack on the channel.
+// It must be called with Broker.lock held.
+func (ch *channel) deliver(q *queue, m *queuedMessage, c *consumer, noAck bool) stdAmqp.Delivery {
+	ch.deliveryTag++
+
+	delivery := m.delivery
+	delivery.Acknowledger = ch
+	delivery.DeliveryTag = ch.deliveryTag
+	if c != nil {
+		delivery.ConsumerTag = c.tag
+	}
+
+	if !noAck {
+		ch.unacked[ch.deliveryTag] = &unackedDelivery{queue: q, message: m, consumer: c}
+		if c != nil {
+			c.unacked++
+		}
+	}
+
+	return delivery
+}
+
+func (ch *channel) Tx() error {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return stdAmqp.ErrClosed
+	}
+	if ch.confirmMode {
+		return ch.fail(preconditionFailed("cannot switch from confirm to tx mode"), false)
+	}
+
+	ch.txMode = true
+
+	return nil
+}
+
+// TxCommit routes messages published in the transaction. Acks are not transactional, they are applied immediately.
+func (ch *channel) TxCommit() error {
+	ch.publishLock.Lock()
+	defer ch.publishLock.Unlock()
+
+	ch.broker.lock.Lock()
+
+	if ch.closed {
+		ch.broker.lock.Unlock()
+		return stdAmqp.ErrClosed
+	}
+	if !ch.txMode {
+		err := ch.fail(preconditionFailed("channel is not transactional"), false)
+		ch.broker.lock.Unlock()
+		return err
+	}
+
+	publishings := ch.txPublishings
+	ch.txPublishings = nil
+	notifications := ch.publishOrBlock(publishings)
+	ch.broker.lock.Unlock()
+
+	ch.listeners.send(notifications)
+
+	return nil
+}
+
+func (ch *channel) TxRollback() error {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return stdAmqp.ErrClosed
+	}
+	if !ch.txMode {
+		return ch.fail(preconditionFailed("channel is not transactional"), false)
+	}
+
+	ch.txPublishings = nil
+
+	return nil
+}
+
+func (ch *channel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, multiple, func(u *unackedDelivery) {})
+}
+
+func (ch *channel) Nack(tag uint64, multiple bool, requeue bool) error {
+	return ch.settle(tag, multiple, func(u *unackedDelivery) {
+		if requeue {
+			ch.broker.requeue(u.queue, u.message)
+		} else {
+			ch.broker.deadLetter(u.queue, u.message, amqp.DeathReasonRejected)
+		}
+	})
+}
+
+func (ch *channel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// settle removes deliveries up to tag (or only tag, when multiple is false) from unacked deliveries
+// and calls settled for every one of them. Unknown delivery tag closes the channel.
+func (ch *channel) settle(tag uint64, multiple bool, settled func(u *unackedDelivery)) error {
+	ch.broker.lock.Lock()
+	defer ch.broker.lock.Unlock()
+
+	if ch.closed {
+		return stdAmqp.ErrClosed
+	}
+
+	var tags []uint64
+	if multiple {
+		for unackedTag := range ch.unacked {
+			// multiple with tag 0 settles all unacked deliveries
+			if tag == 0 || unackedTag <= tag {
+				tags = append(tags, unackedTag)
+			}
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+	} else if _, ok := ch.unacked[tag]; ok {
+		tags = []uint64{tag}
+	}
+
+	if len(tags) == 0 && !(multiple && tag == 0) {
+		return ch.fail(preconditionFailed("unknown delivery tag %d", tag), true)
+	}
+
+	queues := map[*queue]struct{}{}
+	for _, tag := range tags {
+		u := ch.unacked[tag]
+		delete(ch.unacked, tag)
+		if u.consumer != nil {
+			u.consumer.unacked--
+		}
+
+		settled(u)
+		queues[u.queue] = struct{}{}
+	}
+
+	for q := range queues {
+		ch.broker.dispatch(q)
+	}
+	ch.dispatchConsumed()
+
+	return nil
+}
+
+// dispatchConsumed dispatches messages of queues consumed on the channel, after the prefetch capacity changed.
+func (ch *channel) dispatchConsumed() {
+	for _, c := range ch.consumers {
+		ch.broker.dispatch(c.queue)
+	}
+}
+
+func (ch *channel) Close() error {
+	ch.broker.lock.Lock()
+	if ch.closed {
+		ch.broker.lock.Unlock()
+		return stdAmqp.ErrClosed
+	}
+	notify := ch.shutdown(nil)
+	ch.broker.lock.Unlock()
+
+	notify()
+
+	return nil
+}
+
+// shutdown closes the channel and requeues its unacked deliveries. It must be called with Broker.lock held.
+// Returned func notifies listeners and stops consumers, it must be called after Broker.lock is released.
+func (ch *channel) shutdown(err *stdAmqp.Error) func() {
+	if ch.closed {
+		return func() {}
+	}
+	ch.closed = true
+	delete(ch.conn.channels, ch)
+
+	consumers := make([]*consumer, 0, len(ch.consumers))
+	for _, c := range ch.consumers {
+		consumers = append(consumers, c)
+		ch.broker.removeConsumer(c)
+	}
+	ch.consumers = map[string]*consumer{}
+
+	tags := make([]uint64, 0, len(ch.unacked))
+	for tag := range ch.unacked {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+	queues := map[*queue]struct{}{}
+	for _, tag := range tags {
+		u := ch.unacked[tag]
+		ch.broker.requeue(u.queue, u.message)
+		queues[u.queue] = struct{}{}
+	}
+	ch.unacked = map[uint64]*unackedDelivery{}
+	ch.txPublishings = nil
+	ch.blockedPublishings = nil
+
+	for q := range queues {
+		ch.broker.dispatch(q)
+	}
+
+	return func() {
+		ch.listeners.close(err)
+
+		// like in github.com/streadway/amqp, deliveries are closed after close listeners are notified
+		for _, c := range consumers {
+			c.close()
+		}
+	}
+}
+
+// notification is sent to returns or confirms listeners of the channel.
+type notification struct {
+	returned     *stdAmqp.Return
+	confirmation *stdAmqp.Confirmation
+}
+
+// channelListeners are listeners registered with NotifyClose, NotifyFlow, NotifyReturn and NotifyPublish.
+type channelListeners struct {
+	// lock is held for reading while notifications are sent, so listeners are not closed while sending
+	lock     sync.RWMutex
+	closed   bool
+	closes   []chan *stdAmqp.Error
+	flows    []chan bool
+	returns  []chan stdAmqp.Return
+	confirms []chan stdAmqp.Confirmation
+}
+
+// register calls add, or closeListener when the channel is closed already.
+func (l *channelListeners) register(add func(), closeListener func()) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		closeListener()
+		return
+	}
+
+	add()
+}
+
+func (l *channelListeners) send(notifications []notification) {
+	if len(notifications) == 0 {
+		return
+	}
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	if l.closed {
+		return
+	}
+
+	for _, n := range notifications {
+		if n.returned != nil {
+			for _, listener := range l.returns {
+				listener <- *n.returned
+			}
+		}
+		if n.confirmation != nil {
+			for _, listener := range l.confirms {
+				listener <- *n.confirmation
+			}
+		}
+	}
+}
+
+// close closes all listeners, err is sent to close listeners before they are closed, when it's not nil.
+func (l *channelListeners) close(err *stdAmqp.Error) {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return
+	}
+	l.closed = true
+	closes, flows, returns, confirms := l.closes, l.flows, l.returns, l.confirms
+	l.lock.Unlock()
+
+	for _, listener := range flows {
+		close(listener)
+	}
+	for _, listener := range returns {
+		close(listener)
+	}
+	for _, listener := range confirms {
+		close(listener)
+	}
+	for _, listener := range closes {
+		if err != nil {
+			listener <- err
+		}
+		close(listener)
+	}
+}
+
+// consumer sends deliveries dispatched by the broker to the deliveries channel.
+//
+// Like in github.com/streadway/amqp, deliveries are buffered, so the broker is never blocked by the consumer.
+type consumer struct {
+	tag       string
+	channel   *channel
+	queue     *queue
+	noAck     bool
+	exclusive bool
+
+	// unacked and buffer are guarded by Broker.lock
+	unacked int
+	buffer  []stdAmqp.Delivery
+
+	deliveries chan stdAmqp.Delivery
+	wake       chan struct{}
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+func newConsumer(tag string, ch *channel, q *queue, noAck bool, exclusive bool) *consumer {
+	return &consumer{
+		tag:        tag,
+		channel:    ch,
+		queue:      q,
+		noAck:      noAck,
+		exclusive:  exclusive,
+		deliveries: make(chan stdAmqp.Delivery),
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+}
+
+// hasCapacity returns true, when the prefetch count of the channel allows to deliver the next message.
+// It must be called with Broker.lock held.
+func (c *consumer) hasCapacity() bool {
+	ch := c.channel
+	if c.noAck || ch.prefetchCount <= 0 {
+		return true
+	}
+
+	if ch.prefetchGlobal {
+		return len(ch.unacked) < ch.prefetchCount
+	}
+
+	return c.unacked < ch.prefetchCount
+}
+
+// push adds the delivery to the buffer, it must be called with Broker.lock held.
+func (c *consumer) push(delivery stdAmqp.Delivery) {
+	c.buffer = append(c.buffer, delivery)
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends buffered deliveries until the consumer is stopped. Deliveries left in the buffer stay unacked,
+// they are requeued when the channel is closed.
+func (c *consumer) run() {
+	defer close(c.deliveries)
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+
+		c.channel.broker.lock.Lock()
+		if len(c.buffer) == 0 {
+			c.channel.broker.lock.Unlock()
+
+			select {
+			case <-c.wake:
+				continue
+			case <-c.stop:
+				return
+			}
+		}
+		delivery := c.buffer[0]
+		c.buffer = c.buffer[1:]
+		c.channel.broker.lock.Unlock()
+
+		select {
+		case c.deliveries <- delivery:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *consumer) close() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
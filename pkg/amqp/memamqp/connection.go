@@ -0,0 +1,187 @@
+package memamqp
+
+import (
+	"sync"
+
+	stdAmqp "github.com/streadway/amqp"
+
+	"github.com/ThreeDotsLabs/watermill-amqp/pkg/amqp"
+)
+
+// connection implements amqp.AMQPConnection.
+type connection struct {
+	broker *Broker
+
+	// closed and channels are guarded by Broker.lock
+	closed   bool
+	channels map[*channel]struct{}
+
+	listenersLock   sync.Mutex
+	listenersClosed bool
+	closeListeners  []chan *stdAmqp.Error
+	blockListeners  []chan stdAmqp.Blocking
+
+	// blockingLock serializes blocking notifications, blockedSent is the last state sent to the listeners
+	blockingLock sync.Mutex
+	blockedSent  bool
+}
+
+func newConnection(broker *Broker) *connection {
+	return &connection{
+		broker:   broker,
+		channels: map[*channel]struct{}{},
+	}
+}
+
+func (c *connection) Channel() (amqp.AMQPChannel, error) {
+	c.broker.lock.Lock()
+	defer c.broker.lock.Unlock()
+
+	if c.closed {
+		return nil, stdAmqp.ErrClosed
+	}
+
+	ch := newChannel(c)
+	c.channels[ch] = struct{}{}
+
+	return ch, nil
+}
+
+func (c *connection) ServerProperties() stdAmqp.Table {
+	return stdAmqp.Table{"product": "memamqp"}
+}
+
+func (c *connection) NotifyClose(receiver chan *stdAmqp.Error) chan *stdAmqp.Error {
+	c.listenersLock.Lock()
+	defer c.listenersLock.Unlock()
+
+	if c.listenersClosed {
+		close(receiver)
+	} else {
+		c.closeListeners = append(c.closeListeners, receiver)
+	}
+
+	return receiver
+}
+
+// NotifyBlocked registers the listener for blocking notifications.
+// When the broker is blocked, the new connection is notified like after publishing on the blocked broker.
+func (c *connection) NotifyBlocked(receiver chan stdAmqp.Blocking) chan stdAmqp.Blocking {
+	c.listenersLock.Lock()
+	defer c.listenersLock.Unlock()
+
+	if c.listenersClosed {
+		close(receiver)
+		return receiver
+	}
+	c.blockListeners = append(c.blockListeners, receiver)
+
+	go c.syncBlocking()
+
+	return receiver
+}
+
+func (c *connection) IsClosed() bool {
+	c.broker.lock.Lock()
+	defer c.broker.lock.Unlock()
+
+	return c.closed
+}
+
+func (c *connection) Close() error {
+	c.broker.lock.Lock()
+	if c.closed {
+		c.broker.lock.Unlock()
+		return stdAmqp.ErrClosed
+	}
+	notify := c.shutdown(nil)
+	c.broker.lock.Unlock()
+
+	notify()
+
+	return nil
+}
+
+// shutdown closes the connection with all its channels and deletes its exclusive queues.
+// It must be called with Broker.lock held, returned func notifies listeners
+// and it must be called after Broker.lock is released.
+func (c *connection) shutdown(err *stdAmqp.Error) func() {
+	c.closed = true
+	delete(c.broker.connections, c)
+
+	var notifyChannels []func()
+	for ch := range c.channels {
+		notifyChannels = append(notifyChannels, ch.shutdown(err))
+	}
+
+	for _, q := range c.broker.queues {
+		if q.exclusive && q.owner == c {
+			c.broker.deleteQueue(q)
+		}
+	}
+
+	// like in streadway/amqp, listeners of the connection are notified before its channels are shut down
+	return func() {
+		c.listenersLock.Lock()
+		c.listenersClosed = true
+		closeListeners := c.closeListeners
+		blockListeners := c.blockListeners
+		c.listenersLock.Unlock()
+
+		// blockingLock is taken, so the blocking notification is not sent to the closed listener
+		c.blockingLock.Lock()
+		for _, listener := range blockListeners {
+			close(listener)
+		}
+		c.blockingLock.Unlock()
+
+		for _, listener := range closeListeners {
+			if err != nil {
+				listener <- err
+			}
+			close(listener)
+		}
+
+		for _, notify := range notifyChannels {
+			notify()
+		}
+	}
+}
+
+// syncBlocking notifies listeners, when the blocking state of the broker is different than the last one sent.
+func (c *connection) syncBlocking() {
+	c.blockingLock.Lock()
+	defer c.blockingLock.Unlock()
+
+	c.broker.lock.Lock()
+	blocking := stdAmqp.Blocking{Active: c.broker.blocked, Reason: c.broker.blockedReason}
+	c.broker.lock.Unlock()
+
+	c.listenersLock.Lock()
+	closed := c.listenersClosed
+	listeners := c.blockListeners
+	c.listenersLock.Unlock()
+
+	if closed || c.blockedSent == blocking.Active {
+		return
+	}
+	c.blockedSent = blocking.Active
+
+	for _, listener := range listeners {
+		listener <- blocking
+	}
+}
+
+// flushBlocked routes messages published on the connection's channels while the broker was blocked.
+func (c *connection) flushBlocked() {
+	c.broker.lock.Lock()
+	channels := make([]*channel, 0, len(c.channels))
+	for ch := range c.channels {
+		channels = append(channels, ch)
+	}
+	c.broker.lock.Unlock()
+
+	for _, ch := range channels {
+		ch.flushBlocked()
+	}
+}
@@ -0,0 +1,52 @@
+package memamqp
+
+import (
+	"fmt"
+
+	stdAmqp "github.com/streadway/amqp"
+)
+
+// Errors are created like the channel errors sent by RabbitMQ, the reason is prefixed with the name of the code.
+
+func notFound(format string, args ...interface{}) *stdAmqp.Error {
+	return newError(stdAmqp.NotFound, "NOT_FOUND", format, args...)
+}
+
+func accessRefused(format string, args ...interface{}) *stdAmqp.Error {
+	return newError(stdAmqp.AccessRefused, "ACCESS_REFUSED", format, args...)
+}
+
+func resourceLocked(format string, args ...interface{}) *stdAmqp.Error {
+	return newError(stdAmqp.ResourceLocked, "RESOURCE_LOCKED", format, args...)
+}
+
+func preconditionFailed(format string, args ...interface{}) *stdAmqp.Error {
+	return newError(stdAmqp.PreconditionFailed, "PRECONDITION_FAILED", format, args...)
+}
+
+func commandInvalid(format string, args ...interface{}) *stdAmqp.Error {
+	return newError(stdAmqp.CommandInvalid, "COMMAND_INVALID", format, args...)
+}
+
+func notAllowed(format string, args ...interface{}) *stdAmqp.Error {
+	return newError(stdAmqp.NotAllowed, "NOT_ALLOWED", format, args...)
+}
+
+func notImplemented(format string, args ...interface{}) *stdAmqp.Error {
+	return newError(stdAmqp.NotImplemented, "NOT_IMPLEMENTED", format, args...)
+}
+
+func inequivalentArg(arg, kind, name string, received, current interface{}) *stdAmqp.Error {
+	return preconditionFailed(
+		"inequivalent arg '%s' for %s '%s' in vhost '/': received '%v' but current is '%v'",
+		arg, kind, name, received, current,
+	)
+}
+
+func newError(code int, codeName string, format string, args ...interface{}) *stdAmqp.Error {
+	return &stdAmqp.Error{
+		Code:   code,
+		Reason: codeName + " - " + fmt.Sprintf(format, args...),
+		Server: true,
+	}
+}
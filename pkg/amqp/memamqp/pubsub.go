@@ -0,0 +1,28 @@
+package memamqp
+
+import (
+	"github.com/ThreeDotsLabs/watermill"
+
+	"github.com/ThreeDotsLabs/watermill-amqp/pkg/amqp"
+)
+
+// NewPublisher creates amqp.Publisher connected to the in-memory broker.
+// Config.Connection.Dial is set to Broker.Dial, empty Config.Connection.AmqpURI is set to "memamqp://".
+func NewPublisher(broker *Broker, config amqp.Config, logger watermill.LoggerAdapter) (*amqp.Publisher, error) {
+	return amqp.NewPublisher(brokerConfig(broker, config), logger)
+}
+
+// NewSubscriber creates amqp.Subscriber connected to the in-memory broker.
+// Config.Connection.Dial is set to Broker.Dial, empty Config.Connection.AmqpURI is set to "memamqp://".
+func NewSubscriber(broker *Broker, config amqp.Config, logger watermill.LoggerAdapter) (*amqp.Subscriber, error) {
+	return amqp.NewSubscriber(brokerConfig(broker, config), logger)
+}
+
+func brokerConfig(broker *Broker, config amqp.Config) amqp.Config {
+	config.Connection.Dial = broker.Dial
+	if config.Connection.AmqpURI == "" && len(config.Connection.URIs) == 0 {
+		config.Connection.AmqpURI = "memamqp://"
+	}
+
+	return config
+}
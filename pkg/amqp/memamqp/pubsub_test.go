@@ -0,0 +1,1195 @@
+package memamqp_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/tests"
+	"github.com/pkg/errors"
+	stdAmqp "github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ThreeDotsLabs/watermill-amqp/pkg/amqp"
+	"github.com/ThreeDotsLabs/watermill-amqp/pkg/amqp/memamqp"
+)
+
+func createPubSubWithConfig(t *testing.T, broker *memamqp.Broker, config amqp.Config) (message.Publisher, message.Subscriber) {
+	publisher, err := memamqp.NewPublisher(broker, config, nil)
+	require.NoError(t, err)
+
+	subscriber, err := memamqp.NewSubscriber(broker, config, watermill.NewStdLogger(true, false))
+	require.NoError(t, err)
+
+	return publisher, subscriber
+}
+
+func TestPubSub(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	tests.TestPubSub(
+		t,
+		tests.Features{
+			ConsumerGroups:                      true,
+			ExactlyOnceDelivery:                 false,
+			GuaranteedOrder:                     true,
+			GuaranteedOrderWithSingleSubscriber: true,
+			Persistent:                          true,
+			RequireSingleInstance:               true,
+		},
+		func(t *testing.T) (message.Publisher, message.Subscriber) {
+			return createPubSubWithConfig(t, broker, amqp.NewDurablePubSubConfig(
+				"amqp://",
+				amqp.GenerateQueueNameTopicNameWithSuffix("test"),
+			))
+		},
+		func(t *testing.T, consumerGroup string) (message.Publisher, message.Subscriber) {
+			return createPubSubWithConfig(t, broker, amqp.NewDurablePubSubConfig(
+				"amqp://",
+				amqp.GenerateQueueNameTopicNameWithSuffix(consumerGroup),
+			))
+		},
+	)
+}
+
+func TestPubSub_queue(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	tests.TestPubSub(
+		t,
+		tests.Features{
+			ConsumerGroups:                      false,
+			ExactlyOnceDelivery:                 false,
+			GuaranteedOrder:                     true,
+			GuaranteedOrderWithSingleSubscriber: true,
+			Persistent:                          true,
+			RequireSingleInstance:               true,
+		},
+		func(t *testing.T) (message.Publisher, message.Subscriber) {
+			return createPubSubWithConfig(t, broker, amqp.NewDurableQueueConfig("amqp://"))
+		},
+		nil,
+	)
+}
+
+func TestPubSub_topic_exchange(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	publisherConfig := amqp.NewDurablePubSubConfig("amqp://", nil)
+	publisherConfig.Exchange.Type = "topic"
+	publisherConfig.Exchange.GenerateName = amqp.GenerateQueueNameConstant("events")
+	publisherConfig.Publish.GenerateRoutingKey = func(topic string) string {
+		return topic
+	}
+
+	subscriberConfig := publisherConfig
+	subscriberConfig.Queue.GenerateName = amqp.GenerateQueueNameTopicName
+	subscriberConfig.QueueBind.GenerateRoutingKey = func(queueName string) string {
+		return "orders.*"
+	}
+
+	publisher, err := memamqp.NewPublisher(broker, publisherConfig, nil)
+	require.NoError(t, err)
+
+	subscriber, err := memamqp.NewSubscriber(broker, subscriberConfig, nil)
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), "orders_queue")
+	require.NoError(t, err)
+
+	require.NoError(t, publisher.Publish("users.created", message.NewMessage(watermill.NewUUID(), nil)))
+
+	orderMsg := message.NewMessage(watermill.NewUUID(), nil)
+	require.NoError(t, publisher.Publish("orders.created", orderMsg))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, orderMsg.UUID, msg.UUID)
+		msg.Ack()
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+func TestPubSub_nack_requeue(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	publisher, subscriber := createPubSubWithConfig(t, broker, amqp.NewDurableQueueConfig("amqp://"))
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), "queue")
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	require.NoError(t, publisher.Publish("queue", sentMsg))
+
+	for _, ack := range []bool{false, true} {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, sentMsg.UUID, msg.UUID)
+
+			if ack {
+				msg.Ack()
+			} else {
+				msg.Nack()
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message not received")
+		}
+	}
+
+	assert.Equal(t, 0, broker.QueueLength("queue"))
+}
+
+func TestPubSub_exchange_routing_key(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurablePubSubConfig("amqp://", amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+	config.Exchange.Type = "direct"
+	config.Exchange.GenerateName = amqp.GenerateQueueNameConstant("events")
+	config.Exchange.GenerateRoutingKey = func(topic string) string {
+		return "key_" + topic
+	}
+
+	publisher, subscriber := createPubSubWithConfig(t, broker, config)
+	defer subscriber.Close()
+
+	ordersMessages, err := subscriber.Subscribe(context.Background(), "orders")
+	require.NoError(t, err)
+	usersMessages, err := subscriber.Subscribe(context.Background(), "users")
+	require.NoError(t, err)
+
+	orderMsg := message.NewMessage(watermill.NewUUID(), nil)
+	require.NoError(t, publisher.Publish("orders", orderMsg))
+
+	select {
+	case msg := <-ordersMessages:
+		assert.Equal(t, orderMsg.UUID, msg.UUID)
+		msg.Ack()
+	case msg := <-usersMessages:
+		t.Fatalf("message %s routed to the wrong queue", msg.UUID)
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+func TestPubSub_topic_exchange_pattern(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableTopicExchangeConfig(
+		"amqp://",
+		"events",
+		amqp.GenerateQueueNameTopicPatternWithSuffix("test"),
+	)
+
+	publisher, subscriber := createPubSubWithConfig(t, broker, config)
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), "orders.#")
+	require.NoError(t, err)
+
+	require.NoError(t, publisher.Publish("users.created", message.NewMessage(watermill.NewUUID(), nil)))
+
+	orderMsgs := []*message.Message{
+		message.NewMessage(watermill.NewUUID(), nil),
+		message.NewMessage(watermill.NewUUID(), nil),
+	}
+	require.NoError(t, publisher.Publish("orders.created", orderMsgs[0]))
+	require.NoError(t, publisher.Publish("orders.eu.paid", orderMsgs[1]))
+
+	for _, orderMsg := range orderMsgs {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, orderMsg.UUID, msg.UUID)
+			msg.Ack()
+		case <-time.After(time.Second):
+			t.Fatal("message not received")
+		}
+	}
+
+	assert.Equal(t, 0, broker.QueueLength("orders.hash_test"))
+}
+
+func TestPubSub_default_exchange(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Queue.GenerateName = amqp.GenerateQueueNameTopicNameWithSuffix("test")
+	config.Publish.GenerateRoutingKey = nil
+
+	subscriber, err := memamqp.NewSubscriber(broker, config, nil)
+	require.NoError(t, err)
+	require.NoError(t, subscriber.SubscribeInitialize("orders"))
+	require.NoError(t, subscriber.SubscribeInitialize("users"))
+	require.NoError(t, subscriber.Close())
+
+	publisher, err := memamqp.NewPublisher(broker, config, nil)
+	require.NoError(t, err)
+	require.NoError(t, publisher.Publish("orders", message.NewMessage(watermill.NewUUID(), nil)))
+	require.NoError(t, publisher.Close())
+
+	// without GenerateRoutingKey, the queue name is used as the routing key
+	assert.Equal(t, 1, broker.QueueLength("orders_test"))
+
+	config.Publish.GenerateRoutingKey = func(topic string) string {
+		return "users_test"
+	}
+	publisher, err = memamqp.NewPublisher(broker, config, nil)
+	require.NoError(t, err)
+	require.NoError(t, publisher.Publish("orders", message.NewMessage(watermill.NewUUID(), nil)))
+	require.NoError(t, publisher.Close())
+
+	// GenerateRoutingKey takes precedence over the queue name
+	assert.Equal(t, 1, broker.QueueLength("orders_test"))
+	assert.Equal(t, 1, broker.QueueLength("users_test"))
+}
+
+func TestPubSub_role_marshalers(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.PublishMarshaler = amqp.DefaultMarshaler{
+		PostprocessPublishing: func(publishing stdAmqp.Publishing) stdAmqp.Publishing {
+			publishing.Headers["format"] = "v2"
+			return publishing
+		},
+	}
+
+	publisher, subscriber := createPubSubWithConfig(t, broker, config)
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), "queue")
+	require.NoError(t, err)
+
+	require.NoError(t, publisher.Publish("queue", message.NewMessage(watermill.NewUUID(), nil)))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, "v2", msg.Metadata.Get("format"))
+		msg.Ack()
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+func TestPubSub_extra_bindings(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.QueueBind.ExtraBindings = []amqp.ExchangeBinding{
+		{Exchange: "billing", ExchangeType: stdAmqp.ExchangeFanout, ExchangeDurable: true},
+		{Exchange: "shipping", ExchangeType: stdAmqp.ExchangeFanout, ExchangeDurable: true},
+	}
+
+	subscriber, err := memamqp.NewSubscriber(broker, config, watermill.NewStdLogger(true, false))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	// declarations are idempotent, queue is bound only once
+	require.NoError(t, subscriber.SubscribeInitialize("workers"))
+	messages, err := subscriber.Subscribe(context.Background(), "workers")
+	require.NoError(t, err)
+
+	eventsPublisher, err := memamqp.NewPublisher(broker, amqp.NewDurablePubSubConfig("amqp://", nil), nil)
+	require.NoError(t, err)
+
+	sentMsgs := []*message.Message{
+		message.NewMessage(watermill.NewUUID(), nil),
+		message.NewMessage(watermill.NewUUID(), nil),
+	}
+	require.NoError(t, eventsPublisher.Publish("billing", sentMsgs[0]))
+	require.NoError(t, eventsPublisher.Publish("shipping", sentMsgs[1]))
+
+	for _, sentMsg := range sentMsgs {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, sentMsg.UUID, msg.UUID)
+			msg.Ack()
+		case <-time.After(time.Second):
+			t.Fatal("message not received")
+		}
+	}
+
+	assert.Equal(t, 0, broker.QueueLength("workers"))
+}
+
+func TestPubSub_publish_fanout(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurablePubSubConfig("amqp://", amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+	config.Exchange.Type = "direct"
+	config.Exchange.GenerateName = amqp.GenerateQueueNameConstant("events")
+	config.Exchange.GenerateRoutingKey = func(topic string) string {
+		return "key_" + topic
+	}
+
+	publisher, err := memamqp.NewPublisher(broker, config, nil)
+	require.NoError(t, err)
+	subscriber, err := memamqp.NewSubscriber(broker, config, watermill.NewStdLogger(true, false))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	ordersMessages, err := subscriber.Subscribe(context.Background(), "orders")
+	require.NoError(t, err)
+	usersMessages, err := subscriber.Subscribe(context.Background(), "users")
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), nil)
+	require.NoError(t, publisher.PublishFanout("orders", []string{"key_orders", "key_users"}, sentMsg))
+
+	for _, messages := range []<-chan *message.Message{ordersMessages, usersMessages} {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, sentMsg.UUID, msg.UUID)
+			msg.Ack()
+		case <-time.After(time.Second):
+			t.Fatal("message not received")
+		}
+	}
+
+	assert.Error(t, publisher.PublishFanout("orders", nil, sentMsg))
+}
+
+func TestPubSub_unmarshal_error(t *testing.T) {
+	for _, policy := range []amqp.UnmarshalErrorPolicy{amqp.UnmarshalErrorRequeue, amqp.UnmarshalErrorDrop} {
+		broker := memamqp.NewBroker()
+
+		config := amqp.NewDurableQueueConfig("amqp://")
+		// bodies published by DefaultMarshaler are not valid envelopes
+		config.ConsumeMarshaler = amqp.EnvelopeMarshaler{}
+		config.Consume.OnUnmarshalError = policy
+
+		publisher, subscriber := createPubSubWithConfig(t, broker, config)
+
+		messages, err := subscriber.Subscribe(context.Background(), "queue")
+		require.NoError(t, err)
+		require.NoError(t, publisher.Publish("queue", message.NewMessage(watermill.NewUUID(), nil)))
+
+		select {
+		case msg := <-messages:
+			t.Fatalf("message %s which cannot be unmarshaled was delivered", msg.UUID)
+		case <-time.After(100 * time.Millisecond):
+		}
+		require.NoError(t, subscriber.Close())
+
+		if policy == amqp.UnmarshalErrorRequeue {
+			assert.Equal(t, 1, broker.QueueLength("queue"), "message should be requeued")
+		} else {
+			assert.Equal(t, 0, broker.QueueLength("queue"), "message should be dropped")
+		}
+	}
+}
+
+func TestPubSub_filter(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Consume.Filter = func(delivery stdAmqp.Delivery) bool {
+		return delivery.Headers["type"] == "wanted"
+	}
+
+	publisher, subscriber := createPubSubWithConfig(t, broker, config)
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), "queue")
+	require.NoError(t, err)
+
+	filteredMsg := message.NewMessage(watermill.NewUUID(), nil)
+	filteredMsg.Metadata.Set("type", "other")
+	wantedMsg := message.NewMessage(watermill.NewUUID(), nil)
+	wantedMsg.Metadata.Set("type", "wanted")
+	require.NoError(t, publisher.Publish("queue", filteredMsg, wantedMsg))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, wantedMsg.UUID, msg.UUID)
+		msg.Ack()
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+	assert.Equal(t, 0, broker.QueueLength("queue"))
+}
+
+func TestPubSub_requeue_delay(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Consume.Requeue = amqp.RequeueConfig{Delay: 100 * time.Millisecond}
+
+	publisher, subscriber := createPubSubWithConfig(t, broker, config)
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), "queue")
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), nil)
+	require.NoError(t, publisher.Publish("queue", sentMsg))
+
+	var nackedAt time.Time
+	select {
+	case msg := <-messages:
+		nackedAt = time.Now()
+		msg.Nack()
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	// message is dead-lettered back from the delay queue after its TTL
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		assert.True(t, time.Since(nackedAt) >= config.Consume.Requeue.Delay, "message requeued without delay")
+		msg.Ack()
+	case <-time.After(time.Second):
+		t.Fatal("message not redelivered")
+	}
+
+	assert.Equal(t, 0, broker.QueueLength("queue_delay"))
+}
+
+func TestPubSub_reconnect(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Connection.Reconnect = &amqp.ReconnectConfig{
+		BackoffInitialInterval: 10 * time.Millisecond,
+		BackoffMultiplier:      1,
+		BackoffMaxInterval:     10 * time.Millisecond,
+	}
+
+	publisher, subscriber := createPubSubWithConfig(t, broker, config)
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), "queue")
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), nil)
+	require.NoError(t, publisher.Publish("queue", sentMsg))
+
+	select {
+	case msg := <-messages:
+		// unacked message is requeued when the connection is closed
+		broker.CloseConnections()
+		msg.Ack()
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		msg.Ack()
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not redelivered after reconnect")
+	}
+}
+
+func TestPubSub_reconnect_declare_failed(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Connection.Reconnect = &amqp.ReconnectConfig{
+		BackoffInitialInterval: 10 * time.Millisecond,
+		BackoffMultiplier:      1,
+		BackoffMaxInterval:     10 * time.Millisecond,
+	}
+
+	publisher, err := memamqp.NewPublisher(broker, config, nil)
+	require.NoError(t, err)
+	subscriber, err := memamqp.NewSubscriber(broker, config, nil)
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	messages, subscription, err := subscriber.SubscribeWithHandle(context.Background(), "queue")
+	require.NoError(t, err)
+	waitForState(t, subscription, amqp.SubscriptionConsuming)
+
+	// the queue is replaced by the exclusive queue of another connection,
+	// so the consumer is cancelled and the queue cannot be declared again by the subscriber
+	conn, err := broker.Dial("amqp://")
+	require.NoError(t, err)
+	channel, err := conn.Channel()
+	require.NoError(t, err)
+	_, err = channel.QueueDelete("queue", false, false, false)
+	require.NoError(t, err)
+	_, err = channel.QueueDeclare("queue", true, false, true, false, nil)
+	require.NoError(t, err)
+
+	// declaration is retried with backoff, until the exclusive queue is deleted with its connection
+	for i := 0; i < 100 && subscriber.Stats().Reconnects < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, subscriber.Stats().Reconnects >= 3, "declaration not retried")
+	assert.Equal(t, amqp.SubscriptionReconnecting, subscription.State())
+
+	require.NoError(t, conn.Close())
+	waitForState(t, subscription, amqp.SubscriptionConsuming)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), nil)
+	require.NoError(t, publisher.Publish("queue", sentMsg))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		msg.Ack()
+	case <-time.After(time.Second):
+		t.Fatal("message not received after the queue was declared again")
+	}
+}
+
+func waitForState(t *testing.T, subscription *amqp.Subscription, state amqp.SubscriptionState) {
+	for i := 0; i < 100 && subscription.State() != state; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, state, subscription.State())
+}
+
+func TestPubSub_publish_fanout_retry(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurablePubSubConfig("memamqp://", amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+	config.Exchange.Type = "direct"
+	config.Exchange.GenerateName = amqp.GenerateQueueNameConstant("events")
+	config.Exchange.GenerateRoutingKey = func(topic string) string {
+		return "key_" + topic
+	}
+	config.Publish.Retry = amqp.PublishRetryConfig{
+		MaxAttempts: 2,
+		Backoff:     &amqp.ReconnectConfig{BackoffInitialInterval: time.Millisecond, BackoffMaxInterval: time.Millisecond},
+	}
+
+	subscriber, err := memamqp.NewSubscriber(broker, config, nil)
+	require.NoError(t, err)
+	require.NoError(t, subscriber.SubscribeInitialize("orders"))
+	require.NoError(t, subscriber.SubscribeInitialize("users"))
+	require.NoError(t, subscriber.Close())
+
+	// the channel is killed on the second publishing, after the message was published to "key_orders"
+	publishings := new(int32)
+	config.Connection.Dial = func(amqpURI string) (amqp.AMQPConnection, error) {
+		conn, err := broker.Dial(amqpURI)
+		if err != nil {
+			return nil, err
+		}
+		return channelKillingConnection{AMQPConnection: conn, publishings: publishings, killOn: 2}, nil
+	}
+	publisher, err := amqp.NewPublisher(config, nil)
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	require.NoError(t, publisher.PublishFanout("orders", []string{"key_orders", "key_users"}, message.NewMessage(watermill.NewUUID(), nil)))
+
+	// the message is not published again to "key_orders"
+	assert.Equal(t, 1, broker.QueueLength("orders_test"))
+	assert.Equal(t, 1, broker.QueueLength("users_test"))
+}
+
+// channelKillingConnection closes the channel before the publishing number killOn is sent,
+// like when the channel is closed by the broker in the middle of the publish.
+type channelKillingConnection struct {
+	amqp.AMQPConnection
+
+	publishings *int32
+	killOn      int32
+}
+
+func (c channelKillingConnection) Channel() (amqp.AMQPChannel, error) {
+	channel, err := c.AMQPConnection.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	return channelKillingChannel{AMQPChannel: channel, conn: c}, nil
+}
+
+type channelKillingChannel struct {
+	amqp.AMQPChannel
+
+	conn channelKillingConnection
+}
+
+func (c channelKillingChannel) Publish(exchange, key string, mandatory, immediate bool, msg stdAmqp.Publishing) error {
+	if atomic.AddInt32(c.conn.publishings, 1) == c.conn.killOn {
+		_ = c.AMQPChannel.Close()
+	}
+
+	return c.AMQPChannel.Publish(exchange, key, mandatory, immediate, msg)
+}
+
+func TestPubSub_sync_ack(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Consume.SyncAck = true
+
+	publisher, err := memamqp.NewPublisher(broker, config, nil)
+	require.NoError(t, err)
+
+	subscriber, err := memamqp.NewSubscriber(broker, config, nil)
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), "queue")
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, publisher.Publish("queue", message.NewMessage(watermill.NewUUID(), nil)))
+	}
+
+	// every other message is nacked and requeued to the end of the queue
+	for i := 0; i < 6; i++ {
+		select {
+		case msg := <-messages:
+			// the handler of the previous message returned, its ack or nack was already sent
+			stats := subscriber.Stats()
+			assert.EqualValues(t, (i+1)/2, stats.Acked, "message %d", i)
+			assert.EqualValues(t, i/2, stats.Nacked, "message %d", i)
+
+			if i%2 == 0 {
+				msg.Ack()
+			} else {
+				msg.Nack()
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message not received")
+		}
+	}
+}
+
+func TestPubSub_connection(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	subscriber, err := memamqp.NewSubscriber(broker, amqp.NewDurableQueueConfig("amqp://"), nil)
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	connection := subscriber.Connection()
+	require.NotNil(t, connection)
+	assert.False(t, connection.IsClosed())
+
+	_, err = amqp.StreadwayConnection(connection)
+	assert.Equal(t, amqp.ErrNotStreadwayConnection, err)
+}
+
+func TestPubSub_retry_not_confirmed(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Consume.Retry = amqp.RetryConfig{MaxRetries: 3}
+	config.Consume.RepublishTimeout = 50 * time.Millisecond
+
+	publisher, subscriber := createPubSubWithConfig(t, broker, config)
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), "queue")
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), nil)
+	require.NoError(t, publisher.Publish("queue", sentMsg))
+
+	select {
+	case msg := <-messages:
+		// copy published to the retry exchange is never confirmed
+		broker.Block("test")
+		msg.Nack()
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		assert.Empty(t, msg.Metadata.Get(amqp.RetryCountHeader), "original delivery should be requeued instead of the copy")
+		msg.Ack()
+	case <-time.After(time.Second):
+		t.Fatal("message not requeued after confirm timeout")
+	}
+}
+
+func TestPubSub_requeue_delay_close_while_not_confirmed(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Consume.Requeue = amqp.RequeueConfig{Delay: 100 * time.Millisecond}
+
+	publisher, subscriber := createPubSubWithConfig(t, broker, config)
+
+	messages, err := subscriber.Subscribe(context.Background(), "queue")
+	require.NoError(t, err)
+
+	require.NoError(t, publisher.Publish("queue", message.NewMessage(watermill.NewUUID(), nil)))
+
+	select {
+	case msg := <-messages:
+		// copy published to the delay queue is never confirmed
+		broker.Block("test")
+		msg.Nack()
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	closed := make(chan error)
+	go func() {
+		closed <- subscriber.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked by waiting for the confirm")
+	}
+
+	assert.Equal(t, 1, broker.QueueLength("queue"))
+	assert.Equal(t, 0, broker.QueueLength("queue_delay"))
+}
+
+func TestPubSub_ack_batch_context_done_release(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Consume.AckBatch = amqp.AckBatchConfig{MaxCount: 2, MaxDelay: time.Hour}
+	config.Consume.OnContextDone = amqp.ContextDoneRelease
+	config.Consume.Qos.PrefetchCount = 10
+
+	publisher, subscriber := createPubSubWithConfig(t, broker, config)
+	defer subscriber.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	messages, err := subscriber.Subscribe(ctx, "queue")
+	require.NoError(t, err)
+
+	var sentMessages message.Messages
+	for i := 0; i < 3; i++ {
+		sentMessages = append(sentMessages, message.NewMessage(watermill.NewUUID(), nil))
+	}
+	require.NoError(t, publisher.Publish("queue", sentMessages...))
+
+	var received message.Messages
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-messages:
+			received = append(received, msg)
+		case <-time.After(time.Second):
+			t.Fatal("message not received")
+		}
+	}
+
+	// the second message is acked, the first one is released when ctx is done
+	received[1].Ack()
+	cancel()
+
+	// the third message may be still sent, it's released as well
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for range messages {
+		}
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("subscription not stopped")
+	}
+
+	// released messages are requeued when the channel is closed, the acked one is not
+	assert.Equal(t, 2, broker.QueueLength("queue"))
+
+	otherSubscriber, err := memamqp.NewSubscriber(broker, amqp.NewDurableQueueConfig("amqp://"), nil)
+	require.NoError(t, err)
+	defer otherSubscriber.Close()
+
+	redelivered, err := otherSubscriber.Subscribe(context.Background(), "queue")
+	require.NoError(t, err)
+
+	var redeliveredUUIDs []string
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-redelivered:
+			redeliveredUUIDs = append(redeliveredUUIDs, msg.UUID)
+			msg.Ack()
+		case <-time.After(time.Second):
+			t.Fatal("message not redelivered")
+		}
+	}
+	assert.ElementsMatch(t, []string{sentMessages[0].UUID, sentMessages[2].UUID}, redeliveredUUIDs)
+}
+
+func TestPubSub_ack_strategy(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Consume.AckStrategy = ackOnResolveStrategy{}
+
+	publisher, err := memamqp.NewPublisher(broker, config, nil)
+	require.NoError(t, err)
+	subscriber, err := memamqp.NewSubscriber(broker, config, nil)
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), "queue")
+	require.NoError(t, err)
+	require.NoError(t, publisher.Publish("queue", message.NewMessage(watermill.NewUUID(), nil)))
+
+	select {
+	case msg := <-messages:
+		msg.Nack()
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	// nacked message is acked by the strategy, so it's not redelivered
+	select {
+	case msg := <-messages:
+		t.Fatalf("message %s redelivered", msg.UUID)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, amqp.SubscriberStats{Received: 1, Acked: 1}, subscriber.Stats())
+	assert.Equal(t, 0, broker.QueueLength("queue"))
+}
+
+// ackOnResolveStrategy acks the delivery when the message is acked or nacked.
+type ackOnResolveStrategy struct{}
+
+func (ackOnResolveStrategy) Outcome(delivery stdAmqp.Delivery, msg *message.Message, closing <-chan struct{}) amqp.AckOutcome {
+	select {
+	case <-closing:
+		return amqp.AckOutcomeNack
+	case <-msg.Acked():
+	case <-msg.Nacked():
+	}
+
+	return amqp.AckOutcomeAck
+}
+
+func TestPubSub_last_error(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	brokerDown := new(int32)
+	config := amqp.NewDurableQueueConfig("memamqp://")
+	config.Connection.Reconnect = &amqp.ReconnectConfig{
+		BackoffInitialInterval: 10 * time.Millisecond,
+		BackoffMultiplier:      1,
+		BackoffMaxInterval:     10 * time.Millisecond,
+	}
+	config.Connection.Dial = func(amqpURI string) (amqp.AMQPConnection, error) {
+		if atomic.LoadInt32(brokerDown) == 1 {
+			return nil, errors.New("broker is down")
+		}
+		return broker.Dial(amqpURI)
+	}
+
+	publisher, err := amqp.NewPublisher(config, nil)
+	require.NoError(t, err)
+	defer publisher.Close()
+	assert.NoError(t, publisher.LastError())
+
+	atomic.StoreInt32(brokerDown, 1)
+	broker.CloseConnections()
+
+	// the close error is replaced by the error of the failed reconnect
+	reconnectFailed := func() bool {
+		err := publisher.LastError()
+		return err != nil && strings.Contains(err.Error(), "broker is down")
+	}
+	for i := 0; i < 100 && !reconnectFailed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, reconnectFailed(), "unexpected last error: %v", publisher.LastError())
+
+	// the error is cleared after reconnect
+	atomic.StoreInt32(brokerDown, 0)
+	for i := 0; i < 100 && publisher.LastError() != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, publisher.LastError())
+	assert.True(t, publisher.IsConnected())
+}
+
+func TestPubSub_server_named_queue(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewNonDurablePubSubConfig("amqp://", amqp.GenerateQueueNameConstant(""))
+	config.Queue.ServerNamed = true
+
+	publisher, err := memamqp.NewPublisher(broker, config, nil)
+	require.NoError(t, err)
+	subscriber, err := memamqp.NewSubscriber(broker, config, nil)
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	messages, subscription, err := subscriber.SubscribeWithHandle(context.Background(), "events")
+	require.NoError(t, err)
+	waitForState(t, subscription, amqp.SubscriptionConsuming)
+
+	// the queue name assigned by the broker is bound to the exchange and consumed
+	assert.True(t, strings.HasPrefix(subscription.QueueName(), "amq.gen-"), subscription.QueueName())
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), nil)
+	require.NoError(t, publisher.Publish("events", sentMsg))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		msg.Ack()
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+func TestPubSub_unmarshal_error_dead_letter(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	conn, err := broker.Dial("amqp://")
+	require.NoError(t, err)
+	defer conn.Close()
+	channel, err := conn.Channel()
+	require.NoError(t, err)
+	require.NoError(t, channel.ExchangeDeclare("dlx", stdAmqp.ExchangeFanout, true, false, false, false, nil))
+	_, err = channel.QueueDeclare("dead", true, false, false, false, nil)
+	require.NoError(t, err)
+	require.NoError(t, channel.QueueBind("dead", "", "dlx", false, nil))
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	// bodies published by DefaultMarshaler are not valid envelopes
+	config.ConsumeMarshaler = amqp.EnvelopeMarshaler{}
+	config.Consume.OnUnmarshalError = amqp.UnmarshalErrorDeadLetter
+	config.Queue.DeadLetterExchange = "dlx"
+
+	publisher, subscriber := createPubSubWithConfig(t, broker, config)
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), "queue")
+	require.NoError(t, err)
+	require.NoError(t, publisher.Publish("queue", message.NewMessage(watermill.NewUUID(), nil)))
+
+	select {
+	case msg := <-messages:
+		t.Fatalf("message %s which cannot be unmarshaled was delivered", msg.UUID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.Equal(t, 0, broker.QueueLength("queue"))
+	assert.Equal(t, 1, broker.QueueLength("dead"), "message should be dead-lettered")
+}
+
+func TestPubSub_uris_failover(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	var dialedLock sync.Mutex
+	var dialed []string
+	dialedURIs := func() []string {
+		dialedLock.Lock()
+		defer dialedLock.Unlock()
+		return append([]string(nil), dialed...)
+	}
+
+	config := amqp.NewDurableQueueConfig("")
+	config.Connection.URIs = []string{"memamqp://down", "memamqp://first", "memamqp://second"}
+	config.Connection.Reconnect = &amqp.ReconnectConfig{
+		BackoffInitialInterval: 10 * time.Millisecond,
+		BackoffMultiplier:      1,
+		BackoffMaxInterval:     10 * time.Millisecond,
+	}
+	config.Connection.Dial = func(amqpURI string) (amqp.AMQPConnection, error) {
+		dialedLock.Lock()
+		dialed = append(dialed, amqpURI)
+		dialedLock.Unlock()
+
+		if amqpURI == "memamqp://down" {
+			return nil, errors.New("node is down")
+		}
+		return broker.Dial(amqpURI)
+	}
+
+	publisher, err := amqp.NewPublisher(config, nil)
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	assert.Equal(t, []string{"memamqp://down", "memamqp://first"}, dialedURIs())
+
+	// on reconnect, the URI which succeeded the last time is tried first
+	broker.CloseConnections()
+	for i := 0; i < 100 && len(dialedURIs()) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"memamqp://down", "memamqp://first", "memamqp://first"}, dialedURIs())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, publisher.WaitForConnection(ctx))
+}
+
+func TestPubSub_max_message_bytes(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Publish.MaxMessageBytes = 4
+
+	publisher, err := memamqp.NewPublisher(broker, config, nil)
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := memamqp.NewSubscriber(broker, config, nil)
+	require.NoError(t, err)
+	require.NoError(t, subscriber.SubscribeInitialize("queue"))
+	require.NoError(t, subscriber.Close())
+
+	smallMsg := message.NewMessage(watermill.NewUUID(), []byte("1234"))
+	largeMsg := message.NewMessage(watermill.NewUUID(), []byte("12345"))
+
+	err = publisher.Publish("queue", smallMsg, largeMsg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), largeMsg.UUID)
+	assert.Contains(t, err.Error(), "is 5 bytes long, max size is 4 bytes")
+
+	// messages before the oversized one are published
+	assert.Equal(t, 1, broker.QueueLength("queue"))
+}
+
+func TestPubSub_liveness_interval(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Consume.LivenessInterval = 10 * time.Millisecond
+
+	logger := livenessLogger{received: make(chan int, 100)}
+
+	publisher, err := memamqp.NewPublisher(broker, config, nil)
+	require.NoError(t, err)
+	subscriber, err := memamqp.NewSubscriber(broker, config, logger)
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), "queue")
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, publisher.Publish("queue", message.NewMessage(watermill.NewUUID(), nil)))
+
+		select {
+		case msg := <-messages:
+			msg.Ack()
+		case <-time.After(time.Second):
+			t.Fatal("message not received")
+		}
+	}
+
+	// messages are counted in the interval in which they were received
+	received := 0
+	timeout := time.After(time.Second)
+	for received < 2 {
+		select {
+		case n := <-logger.received:
+			received += n
+		case <-timeout:
+			t.Fatalf("liveness logged only %d received messages", received)
+		}
+	}
+	assert.Equal(t, 2, received)
+}
+
+// livenessLogger sends the number of received messages from every liveness log to received.
+type livenessLogger struct {
+	watermill.NopLogger
+
+	received chan int
+}
+
+func (l livenessLogger) Debug(msg string, fields watermill.LogFields) {
+	if msg != "Consumer alive" {
+		return
+	}
+
+	select {
+	case l.received <- fields["received_messages"].(int):
+	default:
+	}
+}
+
+func TestPubSub_context_func(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	type tenantKey struct{}
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.Consume.ContextFunc = func(ctx context.Context, delivery stdAmqp.Delivery) context.Context {
+		return context.WithValue(ctx, tenantKey{}, delivery.Headers["tenant"])
+	}
+
+	publisher, subscriber := createPubSubWithConfig(t, broker, config)
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), "queue")
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), nil)
+	sentMsg.Metadata.Set("tenant", "acme")
+	require.NoError(t, publisher.Publish("queue", sentMsg))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, "acme", msg.Context().Value(tenantKey{}))
+		msg.Ack()
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+func TestPubSub_marshaler_func(t *testing.T) {
+	broker := memamqp.NewBroker()
+
+	config := amqp.NewDurableQueueConfig("amqp://")
+	config.MarshalerFunc = func(topic string) amqp.Marshaler {
+		if topic == "envelopes" {
+			return amqp.EnvelopeMarshaler{}
+		}
+		return nil
+	}
+
+	publisher, subscriber := createPubSubWithConfig(t, broker, config)
+
+	for _, topic := range []string{"envelopes", "plain"} {
+		messages, err := subscriber.Subscribe(context.Background(), topic)
+		require.NoError(t, err)
+
+		sentMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+		sentMsg.Metadata.Set("key", "value")
+		require.NoError(t, publisher.Publish(topic, sentMsg))
+
+		select {
+		case msg := <-messages:
+			assert.True(t, sentMsg.Equals(msg), "topic %s", topic)
+			msg.Ack()
+		case <-time.After(time.Second):
+			t.Fatalf("message not received from topic %s", topic)
+		}
+	}
+
+	require.NoError(t, subscriber.Close())
+
+	// Marshaler is used for topics without the marshaler returned by MarshalerFunc
+	conn, err := broker.Dial("amqp://")
+	require.NoError(t, err)
+	defer conn.Close()
+	channel, err := conn.Channel()
+	require.NoError(t, err)
+
+	for topic, envelope := range map[string]bool{"envelopes": true, "plain": false} {
+		require.NoError(t, publisher.Publish(topic, message.NewMessage(watermill.NewUUID(), []byte("payload"))))
+
+		delivery, ok, err := channel.Get(topic, true)
+		require.NoError(t, err)
+		require.True(t, ok, "message not published to topic %s", topic)
+		assert.Equal(t, envelope, string(delivery.Body) != "payload", "topic %s", topic)
+	}
+}
@@ -1,6 +1,13 @@
 package amqp
 
 import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
 	multierror "github.com/hashicorp/go-multierror"
@@ -8,10 +15,16 @@ import (
 	"github.com/streadway/amqp"
 )
 
+// ErrConnectionBlocked is returned by Publish when Config.Publish.FailFastWhenBlocked is enabled
+// and the connection is blocked by the broker.
+var ErrConnectionBlocked = errors.New("AMQP connection is blocked by the broker")
+
 type Publisher struct {
 	*connectionWrapper
 
 	config Config
+
+	pendingConfirms *pendingConfirms
 }
 
 func NewPublisher(config Config, logger watermill.LoggerAdapter) (*Publisher, error) {
@@ -24,7 +37,84 @@ func NewPublisher(config Config, logger watermill.LoggerAdapter) (*Publisher, er
 		return nil, err
 	}
 
-	return &Publisher{conn, config}, nil
+	return newPublisher(conn, config), nil
+}
+
+// NewPublisherWithConnection creates Publisher, which uses the existing connection instead of dialing its own.
+// It allows to share the connection with other AMQP clients of the application.
+//
+// The connection is owned by the caller: it's not closed by Close and it's not reconnected when it's closed,
+// Publish returns an error until a new Publisher is created with a new connection.
+// Config.Connection is ignored.
+func NewPublisherWithConnection(
+	connection *amqp.Connection,
+	config Config,
+	logger watermill.LoggerAdapter,
+) (*Publisher, error) {
+	if err := config.validatePublisher(); err != nil {
+		return nil, err
+	}
+
+	conn, err := newExistingConnection(connection, config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPublisher(conn, config), nil
+}
+
+func newPublisher(conn *connectionWrapper, config Config) *Publisher {
+	return &Publisher{
+		connectionWrapper: conn,
+		config:            config,
+		pendingConfirms:   newPendingConfirms(),
+	}
+}
+
+// Close closes the publisher.
+//
+// When Config.Publish.ConfirmDelivery is enabled, Close waits for outstanding confirms (up to ConfirmFlushTimeout)
+// before closing the connection. An error listing messages, which were not confirmed, is returned after timeout.
+func (p *Publisher) Close() error {
+	if p.closed {
+		return nil
+	}
+
+	var err error
+
+	if p.config.Publish.ConfirmDelivery {
+		ctx, cancel := context.WithTimeout(context.Background(), p.config.Publish.confirmFlushTimeout())
+		defer cancel()
+
+		err = p.pendingConfirms.wait(ctx)
+	}
+
+	if closeErr := p.connectionWrapper.Close(); closeErr != nil {
+		err = multierror.Append(err, closeErr)
+	}
+
+	return err
+}
+
+// Flush blocks until all messages published so far are confirmed by the broker or ctx is done.
+// It allows to guarantee durability at request boundaries without closing the publisher.
+//
+// Publish doesn't buffer messages, so Flush waits only for messages of concurrent Publish calls,
+// which are still waiting for confirms. When ctx of Publish is done (or Config.Publish.Timeout elapsed)
+// before the messages were confirmed, Publish stops waiting for their confirms and returns an error,
+// so they are not waited for by Flush and it's not known if they were accepted by the broker.
+// It's a no-op, when Config.Publish.ConfirmDelivery is disabled.
+// When ctx is done, an error listing messages which were not confirmed is returned.
+func (p *Publisher) Flush(ctx context.Context) error {
+	if !p.config.Publish.ConfirmDelivery {
+		return nil
+	}
+
+	if err := p.pendingConfirms.wait(ctx); err != nil {
+		return errors.Wrap(err, "flush cancelled or timed out")
+	}
+
+	return nil
 }
 
 // Publish publishes messages to AMQP broker.
@@ -35,29 +125,209 @@ func NewPublisher(config Config, logger watermill.LoggerAdapter) (*Publisher, er
 // to exchange, queue or routing key.
 // For detailed description of nomenclature mapping, please check "Nomenclature" paragraph in doc.go file.
 func (p *Publisher) Publish(topic string, messages ...*message.Message) (err error) {
+	return p.PublishWithContext(context.Background(), topic, messages...)
+}
+
+// PublishWithContext works like Publish, but it returns earlier when ctx is done.
+//
+// Cancellation is respected while waiting for the connection, between retries, while publishing
+// and while waiting for confirms. Config.Publish.Timeout is applied on top of ctx.
+// When ctx is done after some messages were sent to the broker, they are not withdrawn.
+func (p *Publisher) PublishWithContext(ctx context.Context, topic string, messages ...*message.Message) (err error) {
+	return p.publishWithRetries(ctx, topic, nil, messages)
+}
+
+// PublishFanout publishes a copy of every message to each of routingKeys of the topic's exchange,
+// on a single channel and with the message marshaled only once.
+// routingKeys take precedence over GenerateRoutingKey and PublishConfig.RoutingKeyMetadataKey.
+//
+// With Config.Publish.ConfirmDelivery, it returns after all copies are confirmed.
+// When the publish is retried (see Config.Publish.Retry), the message which was published
+// only to some of routingKeys is published again only to the remaining ones.
+func (p *Publisher) PublishFanout(topic string, routingKeys []string, messages ...*message.Message) error {
+	if len(routingKeys) == 0 {
+		return errors.New("no routing keys to publish to")
+	}
+
+	return p.publishWithRetries(context.Background(), topic, routingKeys, messages)
+}
+
+// publishWithRetries publishes messages according to Config.Publish (see PublishWithContext).
+// When routingKeys is not empty, messages are published to each of them (see PublishFanout).
+func (p *Publisher) publishWithRetries(
+	ctx context.Context,
+	topic string,
+	routingKeys []string,
+	messages []*message.Message,
+) (err error) {
 	if p.closed {
 		return errors.New("pub/sub is connection closed")
 	}
 	p.publishingWg.Add(1)
 	defer p.publishingWg.Done()
 
+	if err := p.config.ValidateTopic(topic); err != nil {
+		return errors.Wrapf(err, "invalid topic %s", topic)
+	}
+
+	if p.config.Publish.FailFastWhenBlocked && p.Blocked() {
+		return ErrConnectionBlocked
+	}
+
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "publish cancelled")
+	}
+
+	if p.config.Publish.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.Publish.Timeout)
+		defer cancel()
+	}
+
+	retryConfig := p.config.Publish.Retry
+	retryBackoff := retryConfig.backoffConfig()
+	retryBackoff.Reset()
+
+	// sentCopies is the number of routing keys, to which the first of messages was already published
+	sentCopies := 0
+	for attempt := 1; ; attempt++ {
+		progress, err := p.publishWithDeadline(ctx, topic, routingKeys, messages, sentCopies)
+		if err == nil {
+			return nil
+		}
+		if attempt >= retryConfig.MaxAttempts || !isRetryablePublishError(err) {
+			return err
+		}
+
+		if !p.config.Publish.Transactional {
+			// messages (and copies of the message) published before the error shouldn't be published again,
+			// in transactional mode whole transaction is rolled back
+			messages = messages[progress.published:]
+			sentCopies = progress.sentCopies
+		}
+
+		retryIn := retryBackoff.NextBackOff()
+		p.logger.Error("Publish failed, retrying", err, watermill.LogFields{
+			"topic":    topic,
+			"attempt":  attempt,
+			"retry_in": retryIn,
+		})
+
+		select {
+		case <-time.After(retryIn):
+		case <-p.closing:
+			return err
+		case <-ctx.Done():
+			return multierror.Append(err, errors.Wrap(ctx.Err(), "publish cancelled or timed out"))
+		}
+
+		select {
+		case <-p.connected:
+		case <-p.closing:
+			return err
+		case <-ctx.Done():
+			return multierror.Append(err, errors.Wrap(ctx.Err(), "publish cancelled or timed out"))
+		}
+	}
+}
+
+// publishWithDeadline publishes messages, but returns earlier when ctx is done.
+//
+// Publishing on the channel cannot be interrupted (for example, when the connection is blocked by the broker),
+// so the publish is finished in the background and Close waits for it.
+func (p *Publisher) publishWithDeadline(
+	ctx context.Context,
+	topic string,
+	routingKeys []string,
+	messages []*message.Message,
+	sentCopies int,
+) (progress publishProgress, err error) {
+	if ctx.Done() == nil {
+		return p.publish(ctx, topic, routingKeys, messages, sentCopies)
+	}
+
+	type publishResult struct {
+		progress publishProgress
+		err      error
+	}
+	// buffered, so the goroutine is not blocked after timeout
+	result := make(chan publishResult, 1)
+
+	p.publishingWg.Add(1)
+	go func() {
+		defer p.publishingWg.Done()
+
+		progress, err := p.publish(ctx, topic, routingKeys, messages, sentCopies)
+		result <- publishResult{progress, err}
+	}()
+
+	select {
+	case r := <-result:
+		return r.progress, r.err
+	case <-ctx.Done():
+		// it's not known which messages were published, so the error is not retryable
+		return publishProgress{}, errors.Wrap(ctx.Err(), "publish cancelled or timed out")
+	}
+}
+
+// publishProgress describes how many publishings were passed to the channel before the publish error occurred.
+type publishProgress struct {
+	// published is the number of messages passed to the channel (to all routing keys)
+	published int
+	// sentCopies is the number of routing keys, to which the first not published message was passed
+	sentCopies int
+}
+
+// publish publishes messages on a new channel, to every routing key from routingKeys when not empty.
+// The first of messages is not published to the first sentCopies routing keys (they were published by previous attempt).
+func (p *Publisher) publish(
+	ctx context.Context,
+	topic string,
+	routingKeys []string,
+	messages []*message.Message,
+	sentCopies int,
+) (progress publishProgress, err error) {
+	// progress of the previous attempt is kept for errors returned before publishing
+	progress.sentCopies = sentCopies
+
 	if !p.IsConnected() {
-		return errors.New("not connected to AMQP")
+		return progress, retryablePublishError{errors.New("not connected to AMQP")}
 	}
 
-	channel, err := p.amqpConnection.Channel()
+	channel, err := p.openChannel()
 	if err != nil {
-		return errors.Wrap(err, "cannot open channel")
+		return progress, retryablePublishError{errors.Wrap(err, "cannot open channel")}
+	}
+	if p.config.Publish.ReturnFallbackTopic != "" {
+		// deferred before closing the channel, so it's called after the channel is closed
+		defer p.handleReturns(channel.NotifyReturn(make(chan amqp.Return, publishingsCount(routingKeys, messages))))()
 	}
+	// some publish errors (for example UserId mismatch) are reported by the broker asynchronously by closing the channel
+	notifyCloseChannel := channel.NotifyClose(make(chan *amqp.Error, 1))
 	defer func() {
-		if channelCloseErr := channel.Close(); channelCloseErr != nil {
+		if channelCloseErr := p.closeChannel(channel); channelCloseErr != nil {
 			err = multierror.Append(err, channelCloseErr)
 		}
+		// notifyCloseChannel is always closed after channel.Close()
+		if amqpErr, ok := <-notifyCloseChannel; ok && amqpErr != nil {
+			err = multierror.Append(err, errors.Wrap(amqpErr, "channel closed by AMQP broker"))
+			if p.config.Publish.Immediate && amqpErr.Code == amqp.NotImplemented {
+				err = multierror.Append(err, ErrImmediateNotSupported)
+			}
+		}
 	}()
 
+	var confirms chan amqp.Confirmation
+	if p.config.Publish.ConfirmDelivery {
+		if err := channel.Confirm(false); err != nil {
+			return progress, retryablePublishError{errors.Wrap(err, "cannot put channel into confirm mode")}
+		}
+		confirms = channel.NotifyPublish(make(chan amqp.Confirmation, publishingsCount(routingKeys, messages)))
+	}
+
 	if p.config.Publish.Transactional {
 		if err := p.beginTransaction(channel); err != nil {
-			return err
+			return progress, err
 		}
 
 		defer func() {
@@ -66,7 +336,7 @@ func (p *Publisher) Publish(topic string, messages ...*message.Message) (err err
 	}
 
 	if err := p.preparePublishBindings(topic, channel); err != nil {
-		return err
+		return progress, err
 	}
 
 	logFields := make(watermill.LogFields, 3)
@@ -74,19 +344,261 @@ func (p *Publisher) Publish(topic string, messages ...*message.Message) (err err
 	exchangeName := p.config.Exchange.GenerateName(topic)
 	logFields["amqp_exchange_name"] = exchangeName
 
-	routingKey := p.config.Publish.GenerateRoutingKey(topic)
+	routingKey, err := p.generateRoutingKey(topic, exchangeName)
+	if err != nil {
+		return progress, err
+	}
 	logFields["amqp_routing_key"] = routingKey
 
+	marshaler := p.config.publishMarshaler(topic)
+
+	// msgRoutingKey is the routing key the message was actually published to
+	newPublishError := func(msgUUID string, msgRoutingKey string, err error) error {
+		return &PublishError{
+			Topic:        topic,
+			ExchangeName: exchangeName,
+			RoutingKey:   msgRoutingKey,
+			MessageUUID:  msgUUID,
+			Err:          err,
+		}
+	}
+
+	var publishErr error
+	// sent has a message for every publishing passed to the channel, in the order of confirms,
+	// and sentRoutingKeys has the routing key of every publishing
+	var sent []*message.Message
+	var sentRoutingKeys []string
 	for _, msg := range messages {
-		if err := p.publishMessage(exchangeName, routingKey, msg, channel, logFields); err != nil {
-			return err
+		msgRoutingKeys := routingKeys
+		if len(msgRoutingKeys) == 0 {
+			msgRoutingKeys = []string{p.config.Publish.messageRoutingKeyOrDefault(msg, routingKey)}
+		}
+		// only the first message may be already published to some of routing keys
+		skippedCopies := progress.sentCopies
+
+		if ctx.Err() != nil {
+			// messages published so far are not withdrawn
+			publishErr = newPublishError(
+				msg.UUID, msgRoutingKeys[0], errors.Wrap(ctx.Err(), "publish cancelled before message was sent"),
+			)
+			break
+		}
+
+		// fanout and metadata routing keys are not checked by Config.ValidateTopology,
+		// the broker would close the channel for them
+		if invalidKey, keyErr := firstInvalidRoutingKey(msgRoutingKeys); keyErr != nil {
+			publishErr = newPublishError(msg.UUID, invalidKey, keyErr)
+			break
+		}
+
+		remainingKeys := msgRoutingKeys[skippedCopies:]
+		msgSentCopies, err := p.publishMessage(topic, exchangeName, remainingKeys, marshaler, msg, channel, logFields)
+		for i := 0; i < msgSentCopies; i++ {
+			sent = append(sent, msg)
+			sentRoutingKeys = append(sentRoutingKeys, remainingKeys[i])
+			if confirms != nil {
+				p.pendingConfirms.add(msg.UUID)
+			}
+		}
+		progress.sentCopies = skippedCopies + msgSentCopies
+		if err != nil {
+			// the publishing which failed is the one after the sent copies
+			failedKey := msgRoutingKeys[0]
+			if progress.sentCopies < len(msgRoutingKeys) {
+				failedKey = msgRoutingKeys[progress.sentCopies]
+			}
+			publishErr = newPublishError(msg.UUID, failedKey, err)
+			break
+		}
+		progress.published++
+		progress.sentCopies = 0
+	}
+
+	if confirms != nil && len(sent) > 0 {
+		newConfirmError := func(i int, err error) error {
+			return newPublishError(sent[i].UUID, sentRoutingKeys[i], err)
+		}
+		if confirmErr := p.waitForConfirms(ctx, confirms, sent, logFields, newConfirmError); confirmErr != nil {
+			// it's not known if the messages were accepted, so the error is not retryable
+			if publishErr != nil {
+				return progress, multierror.Append(confirmErr, publishErr)
+			}
+			return progress, confirmErr
+		}
+	}
+
+	return progress, publishErr
+}
+
+// handleReturns collects messages returned by the broker as unroutable.
+// Returned func should be called after the channel is closed, it republishes collected messages in the background
+// to the Config.Publish.ReturnFallbackTopic.
+func (p *Publisher) handleReturns(returns chan amqp.Return) func() {
+	// returns must be drained all the time, otherwise the connection is blocked
+	collected := make(chan []amqp.Return, 1)
+	go func() {
+		var returned []amqp.Return
+		// returns is closed when the channel is closed
+		for r := range returns {
+			returned = append(returned, r)
+		}
+		collected <- returned
+	}()
+
+	return func() {
+		returned := <-collected
+		if len(returned) == 0 {
+			return
+		}
+
+		p.publishingWg.Add(1)
+		go func() {
+			defer p.publishingWg.Done()
+
+			if err := p.publishReturned(returned); err != nil {
+				p.logger.Error("Cannot publish returned messages to fallback topic", err, watermill.LogFields{
+					"topic":             p.config.Publish.ReturnFallbackTopic,
+					"returned_messages": len(returned),
+				})
+			}
+		}()
+	}
+}
+
+// publishReturned publishes returned messages to the Config.Publish.ReturnFallbackTopic.
+//
+// Messages are published without mandatory flag, so when the fallback topic is unroutable as well,
+// messages are dropped by the broker, instead of returning them again in the infinite loop.
+func (p *Publisher) publishReturned(returned []amqp.Return) (err error) {
+	topic := p.config.Publish.ReturnFallbackTopic
+
+	channel, err := p.openChannel()
+	if err != nil {
+		return errors.Wrap(err, "cannot open channel")
+	}
+	defer func() {
+		if channelCloseErr := p.closeChannel(channel); channelCloseErr != nil {
+			err = multierror.Append(err, channelCloseErr)
+		}
+	}()
+
+	if err := p.preparePublishBindings(topic, channel); err != nil {
+		return err
+	}
+
+	exchangeName := p.config.Exchange.GenerateName(topic)
+	routingKey, err := p.generateRoutingKey(topic, exchangeName)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range returned {
+		p.logger.Info("Message returned by the broker, publishing to fallback topic", watermill.LogFields{
+			"amqp_exchange_name":          r.Exchange,
+			"amqp_routing_key":            r.RoutingKey,
+			"amqp_reply_text":             r.ReplyText,
+			"amqp_fallback_exchange_name": exchangeName,
+			"amqp_fallback_routing_key":   routingKey,
+		})
+
+		if err := channel.Publish(exchangeName, routingKey, false, false, returnToPublishing(r)); err != nil {
+			return errors.Wrap(err, "cannot publish msg")
 		}
 	}
 
 	return nil
 }
 
-func (p *Publisher) beginTransaction(channel *amqp.Channel) error {
+func returnToPublishing(r amqp.Return) amqp.Publishing {
+	headers := make(amqp.Table, len(r.Headers)+3)
+	for key, value := range r.Headers {
+		headers[key] = value
+	}
+	headers["x-returned-exchange"] = r.Exchange
+	headers["x-returned-routing-key"] = r.RoutingKey
+	headers["x-returned-reason"] = r.ReplyText
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     r.ContentType,
+		ContentEncoding: r.ContentEncoding,
+		DeliveryMode:    r.DeliveryMode,
+		Priority:        r.Priority,
+		CorrelationId:   r.CorrelationId,
+		ReplyTo:         r.ReplyTo,
+		Expiration:      r.Expiration,
+		MessageId:       r.MessageId,
+		Timestamp:       r.Timestamp,
+		Type:            r.Type,
+		UserId:          r.UserId,
+		AppId:           r.AppId,
+		Body:            r.Body,
+	}
+}
+
+// waitForConfirms waits for confirmation of every published message and removes them from pending confirms.
+// Confirmations are delivered in the same order as messages were published.
+// newPublishError is called with the index of the message in messages, which was not confirmed.
+func (p *Publisher) waitForConfirms(
+	ctx context.Context,
+	confirms chan amqp.Confirmation,
+	messages []*message.Message,
+	logFields watermill.LogFields,
+	newPublishError func(i int, err error) error,
+) error {
+	defer func() {
+		for _, msg := range messages {
+			p.pendingConfirms.remove(msg.UUID)
+		}
+	}()
+
+	for i, msg := range messages {
+		select {
+		case confirmation, ok := <-confirms:
+			if !ok {
+				return newPublishError(i, errors.New("channel closed before message was confirmed"))
+			}
+			if !confirmation.Ack {
+				if p.config.Publish.OnConfirmNack == nil {
+					return newPublishError(i, errors.New(
+						"message was nacked by the broker (for example the queue is full with reject-publish overflow)",
+					))
+				}
+
+				p.logger.Info("Message was nacked by the broker, passing to OnConfirmNack", logFields.Add(watermill.LogFields{
+					"message_uuid": msg.UUID,
+				}))
+				p.config.Publish.OnConfirmNack(msg)
+				continue
+			}
+			p.logger.Trace("Message confirmed", logFields.Add(watermill.LogFields{"message_uuid": msg.UUID}))
+		case <-p.closing:
+			return newPublishError(i, errors.New("publisher closed before message was confirmed"))
+		case <-ctx.Done():
+			return newPublishError(i, errors.Wrap(ctx.Err(), "message was not confirmed before ctx was done"))
+		}
+	}
+
+	return nil
+}
+
+// generateRoutingKey generates routing key for the topic.
+//
+// When exchange name is empty, message is published to the default exchange.
+// The default exchange routes messages to the queue with name equal to the routing key,
+// so when no GenerateRoutingKey is provided, the queue name is used as routing key.
+func (p *Publisher) generateRoutingKey(topic string, exchangeName string) (string, error) {
+	if generateRoutingKey := p.config.topicRoutingKeyConfig(topic).Publish.GenerateRoutingKey; generateRoutingKey != nil {
+		return generateRoutingKey(topic), nil
+	}
+	if exchangeName == "" && p.config.Queue.GenerateName != nil {
+		return p.config.Queue.GenerateName(topic), nil
+	}
+
+	return "", errors.Errorf("missing Config.Publish.GenerateRoutingKey, it's required for exchange %s", exchangeName)
+}
+
+func (p *Publisher) beginTransaction(channel AMQPChannel) error {
 	if err := channel.Tx(); err != nil {
 		return errors.Wrap(err, "cannot start transaction")
 	}
@@ -96,47 +608,211 @@ func (p *Publisher) beginTransaction(channel *amqp.Channel) error {
 	return nil
 }
 
-func (p *Publisher) commitTransaction(channel *amqp.Channel, err error) error {
+func (p *Publisher) commitTransaction(channel AMQPChannel, err error) error {
 	if err != nil {
 		if rollbackErr := channel.TxRollback(); rollbackErr != nil {
 			return multierror.Append(err, rollbackErr)
 		}
+
+		return err
 	}
 
 	return channel.TxCommit()
 }
 
+// firstInvalidRoutingKey returns the first routing key from routingKeys, which is too long for the broker.
+func firstInvalidRoutingKey(routingKeys []string) (string, error) {
+	for _, routingKey := range routingKeys {
+		if err := validateRoutingKey(routingKey); err != nil {
+			return routingKey, err
+		}
+	}
+
+	return "", nil
+}
+
+// publishingsCount returns the number of publishings sent for messages (see Publisher.publish).
+func publishingsCount(routingKeys []string, messages []*message.Message) int {
+	if len(routingKeys) == 0 {
+		return len(messages)
+	}
+
+	return len(routingKeys) * len(messages)
+}
+
+// publishMessage marshals the message and publishes it to every routing key from routingKeys.
+// sent is the number of publishings passed to the channel before the error occurred.
 func (p *Publisher) publishMessage(
-	exchangeName, routingKey string,
+	topic, exchangeName string,
+	routingKeys []string,
+	marshaler Marshaler,
 	msg *message.Message,
-	channel *amqp.Channel,
+	channel AMQPChannel,
 	logFields watermill.LogFields,
-) error {
+) (sent int, err error) {
 	logFields = logFields.Add(watermill.LogFields{"message_uuid": msg.UUID})
 
 	p.logger.Trace("Publishing message", logFields)
 
-	amqpMsg, err := p.config.Marshaler.Marshal(msg)
+	amqpMsg, err := marshaler.Marshal(msg)
 	if err != nil {
-		return errors.Wrap(err, "cannot marshal message")
+		return 0, errors.Wrap(err, "cannot marshal message")
 	}
+	applyMarshalerContentType(marshaler, &amqpMsg)
 
-	if err = channel.Publish(
-		exchangeName,
-		routingKey,
-		p.config.Publish.Mandatory,
-		p.config.Publish.Immediate,
-		amqpMsg,
-	); err != nil {
-		return errors.Wrap(err, "cannot publish msg")
+	p.config.Publish.applyAppAndUserID(msg, &amqpMsg)
+	if amqpMsg.Timestamp.IsZero() && !p.config.Publish.DisableTimestamp {
+		amqpMsg.Timestamp = time.Now()
 	}
+	if err := p.config.Publish.applyDeliveryProperties(msg, &amqpMsg); err != nil {
+		return 0, err
+	}
+	p.config.Publish.applyCorrelationID(msg, &amqpMsg)
 
-	p.logger.Trace("Message published", logFields)
+	if maxBytes := p.config.Publish.MaxMessageBytes; maxBytes > 0 && len(amqpMsg.Body) > maxBytes {
+		return 0, errors.Errorf(
+			"marshaled body of message %s is %d bytes long, max size is %d bytes",
+			msg.UUID, len(amqpMsg.Body), maxBytes,
+		)
+	}
+	if warnBytes := p.config.Publish.LargeMessageWarnBytes; warnBytes > 0 && len(amqpMsg.Body) > warnBytes {
+		p.logger.Info("Published message is larger than Config.Publish.LargeMessageWarnBytes", logFields.Add(watermill.LogFields{
+			"body_bytes":       len(amqpMsg.Body),
+			"warn_bytes":       warnBytes,
+			"content_encoding": amqpMsg.ContentEncoding,
+		}))
+		if p.config.Publish.OnLargeMessage != nil {
+			p.config.Publish.OnLargeMessage(topic, msg, len(amqpMsg.Body))
+		}
+	}
+
+	for _, routingKey := range routingKeys {
+		if err = channel.Publish(
+			exchangeName,
+			routingKey,
+			p.config.Publish.Mandatory,
+			p.config.Publish.Immediate,
+			amqpMsg,
+		); err != nil {
+			// channel.Publish returns error only when message was not sent to the broker
+			return sent, retryablePublishError{errors.Wrap(err, "cannot publish msg")}
+		}
+		sent++
+
+		p.logger.Trace("Message published", logFields.Add(watermill.LogFields{"amqp_routing_key": routingKey}))
+	}
+
+	return sent, nil
+}
+
+const (
+	// DeliveryModeMetadataKey is the metadata key overriding the DeliveryMode property of the published message
+	// ("1" for transient, "2" for persistent), see PublishConfig.DefaultDeliveryMode.
+	DeliveryModeMetadataKey = "_watermill_delivery_mode"
+	// PriorityMetadataKey is the metadata key overriding the Priority property of the published message
+	// (from "0" to "255"), see PublishConfig.DefaultPriority.
+	PriorityMetadataKey = "_watermill_priority"
+	// AppIDMetadataKey is the metadata key overriding the AppId property of the published message,
+	// see PublishConfig.AppID.
+	AppIDMetadataKey = "_watermill_app_id"
+	// UserIDMetadataKey is the metadata key overriding the UserId property of the published message,
+	// see PublishConfig.UserID.
+	UserIDMetadataKey = "_watermill_user_id"
+)
+
+// messageRoutingKey returns the routing key of the message from the metadata (see PublishConfig.RoutingKeyMetadataKey).
+func (p PublishConfig) messageRoutingKey(msg *message.Message) (string, bool) {
+	if p.RoutingKeyMetadataKey == "" {
+		return "", false
+	}
+
+	routingKey := msg.Metadata.Get(p.RoutingKeyMetadataKey)
+	return routingKey, routingKey != ""
+}
+
+// messageRoutingKeyOrDefault returns the routing key of the message from the metadata, or routingKey when not set.
+func (p PublishConfig) messageRoutingKeyOrDefault(msg *message.Message, routingKey string) string {
+	if messageRoutingKey, ok := p.messageRoutingKey(msg); ok {
+		return messageRoutingKey
+	}
+
+	return routingKey
+}
+
+// applyDeliveryProperties sets DeliveryMode and Priority of the publishing from the message metadata,
+// or from the config defaults when they were not set by the Marshaler. Metadata takes precedence.
+func (p PublishConfig) applyDeliveryProperties(msg *message.Message, publishing *amqp.Publishing) error {
+	if publishing.DeliveryMode == 0 {
+		publishing.DeliveryMode = p.DefaultDeliveryMode
+	}
+	if publishing.Priority == 0 {
+		publishing.Priority = p.DefaultPriority
+	}
+
+	if value := msg.Metadata.Get(DeliveryModeMetadataKey); value != "" {
+		mode, err := strconv.ParseUint(value, 10, 8)
+		if err != nil || (uint8(mode) != amqp.Transient && uint8(mode) != amqp.Persistent) {
+			return errors.Errorf("invalid %s metadata %q of message %s", DeliveryModeMetadataKey, value, msg.UUID)
+		}
+		publishing.DeliveryMode = uint8(mode)
+	}
+
+	if value := msg.Metadata.Get(PriorityMetadataKey); value != "" {
+		priority, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			return errors.Errorf("invalid %s metadata %q of message %s", PriorityMetadataKey, value, msg.UUID)
+		}
+		publishing.Priority = uint8(priority)
+	}
 
 	return nil
 }
 
-func (p *Publisher) preparePublishBindings(topic string, channel *amqp.Channel) error {
+// applyAppAndUserID sets AppId and UserId of the publishing from the message metadata,
+// or from the config defaults when they were not set by the Marshaler. Metadata takes precedence.
+func (p PublishConfig) applyAppAndUserID(msg *message.Message, publishing *amqp.Publishing) {
+	if publishing.AppId == "" {
+		publishing.AppId = p.AppID
+	}
+	if publishing.UserId == "" {
+		publishing.UserId = p.UserID
+	}
+
+	if value := msg.Metadata.Get(AppIDMetadataKey); value != "" {
+		publishing.AppId = value
+	}
+	if value := msg.Metadata.Get(UserIDMetadataKey); value != "" {
+		publishing.UserId = value
+	}
+}
+
+// CorrelationIDFromUUID can be used as PublishConfig.CorrelationIDFunc, it uses the message UUID as correlation ID.
+func CorrelationIDFromUUID(msg *message.Message) string {
+	return msg.UUID
+}
+
+// applyCorrelationID sets the CorrelationId of the publishing generated by PublishConfig.CorrelationIDFunc,
+// when it was not set by the Marshaler.
+func (p PublishConfig) applyCorrelationID(msg *message.Message, publishing *amqp.Publishing) {
+	if p.CorrelationIDFunc == nil || publishing.CorrelationId != "" {
+		return
+	}
+
+	publishing.CorrelationId = p.CorrelationIDFunc(msg)
+	if p.CorrelationIDHeader == "" || publishing.CorrelationId == "" {
+		return
+	}
+
+	// headers are copied, because the Marshaler may return the table shared with other publishings
+	headers := make(amqp.Table, len(publishing.Headers)+1)
+	for key, value := range publishing.Headers {
+		headers[key] = value
+	}
+	headers[p.CorrelationIDHeader] = publishing.CorrelationId
+	publishing.Headers = headers
+}
+
+func (p *Publisher) preparePublishBindings(topic string, channel AMQPChannel) error {
 	p.publishBindingsLock.RLock()
 	_, prepared := p.publishBindingsPrepared[topic]
 	p.publishBindingsLock.RUnlock()
@@ -150,7 +826,7 @@ func (p *Publisher) preparePublishBindings(topic string, channel *amqp.Channel)
 
 	if p.config.Exchange.GenerateName(topic) != "" {
 		if err := p.config.TopologyBuilder.ExchangeDeclare(channel, p.config.Exchange.GenerateName(topic), p.config); err != nil {
-			return err
+			return newTopologyMismatchError(topic, err)
 		}
 	}
 
@@ -161,3 +837,108 @@ func (p *Publisher) preparePublishBindings(topic string, channel *amqp.Channel)
 
 	return nil
 }
+
+// retryablePublishError is returned when it's certain that the message was not accepted by the broker,
+// so it can be published again without duplicates.
+type retryablePublishError struct {
+	error
+}
+
+func (e retryablePublishError) Cause() error {
+	return e.error
+}
+
+func isRetryablePublishError(err error) bool {
+	for err != nil {
+		switch typedErr := err.(type) {
+		case retryablePublishError:
+			return true
+		case *multierror.Error:
+			// errors appended later (like channel close error) are consequences of the first error
+			if len(typedErr.Errors) == 0 {
+				return false
+			}
+			err = typedErr.Errors[0]
+		case interface{ Cause() error }:
+			err = typedErr.Cause()
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
+// pendingConfirms tracks published messages, which are not confirmed by the broker yet.
+type pendingConfirms struct {
+	lock     sync.Mutex
+	messages map[string]int
+	count    int
+	// empty is closed when there are no pending confirms
+	empty chan struct{}
+}
+
+func newPendingConfirms() *pendingConfirms {
+	empty := make(chan struct{})
+	close(empty)
+
+	return &pendingConfirms{
+		messages: map[string]int{},
+		empty:    empty,
+	}
+}
+
+func (c *pendingConfirms) add(uuid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.count == 0 {
+		c.empty = make(chan struct{})
+	}
+	c.count++
+	c.messages[uuid]++
+}
+
+func (c *pendingConfirms) remove(uuid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.messages[uuid]--
+	if c.messages[uuid] <= 0 {
+		delete(c.messages, uuid)
+	}
+
+	c.count--
+	if c.count == 0 {
+		close(c.empty)
+	}
+}
+
+// wait blocks until there are no pending confirms or ctx is done.
+// When ctx is done, error listing not confirmed messages is returned.
+func (c *pendingConfirms) wait(ctx context.Context) error {
+	c.lock.Lock()
+	empty := c.empty
+	c.lock.Unlock()
+
+	select {
+	case <-empty:
+		return nil
+	case <-ctx.Done():
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.count == 0 {
+		return nil
+	}
+
+	uuids := make([]string, 0, len(c.messages))
+	for uuid := range c.messages {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	return errors.Errorf("%d message(s) not confirmed: %s", c.count, strings.Join(uuids, ", "))
+}
@@ -0,0 +1,277 @@
+package amqp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishError(t *testing.T) {
+	err := &PublishError{
+		Topic:        "topic",
+		ExchangeName: "exchange",
+		RoutingKey:   "key",
+		MessageUUID:  "uuid",
+		Err:          retryablePublishError{errors.New("cannot publish msg")},
+	}
+
+	assert.Equal(
+		t,
+		`cannot publish message uuid to topic topic (exchange "exchange", routing key "key"): cannot publish msg`,
+		err.Error(),
+	)
+	assert.True(t, isRetryablePublishError(err))
+	assert.True(t, isRetryablePublishError(multierror.Append(err, errors.New("channel close error"))))
+}
+
+func TestPublisher_waitForConfirms_timeout(t *testing.T) {
+	publisher := &Publisher{
+		connectionWrapper: &connectionWrapper{logger: watermill.NopLogger{}, closing: make(chan struct{})},
+		pendingConfirms:   newPendingConfirms(),
+	}
+
+	messages := []*message.Message{message.NewMessage("1", nil), message.NewMessage("2", nil)}
+	for _, msg := range messages {
+		publisher.pendingConfirms.add(msg.UUID)
+	}
+
+	// only the first message is confirmed before timeout
+	confirms := make(chan amqp.Confirmation, len(messages))
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	newPublishError := func(i int, err error) error {
+		return &PublishError{MessageUUID: messages[i].UUID, Err: err}
+	}
+
+	err := publisher.waitForConfirms(ctx, confirms, messages, watermill.LogFields{}, newPublishError)
+	require.Error(t, err)
+	assert.Equal(t, "2", err.(*PublishError).MessageUUID)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	// it's not known if the message was accepted, so it's not retried
+	assert.False(t, isRetryablePublishError(err))
+
+	assert.NoError(t, publisher.pendingConfirms.wait(context.Background()), "pending confirms should be removed")
+}
+
+func TestPublisher_waitForConfirms_OnConfirmNack(t *testing.T) {
+	var nackedMessages []string
+
+	publisher := &Publisher{
+		connectionWrapper: &connectionWrapper{logger: watermill.NopLogger{}, closing: make(chan struct{})},
+		pendingConfirms:   newPendingConfirms(),
+	}
+	publisher.config.Publish.OnConfirmNack = func(msg *message.Message) {
+		nackedMessages = append(nackedMessages, msg.UUID)
+	}
+
+	messages := []*message.Message{message.NewMessage("1", nil), message.NewMessage("2", nil), message.NewMessage("3", nil)}
+	confirms := make(chan amqp.Confirmation, len(messages))
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: true}
+
+	newPublishError := func(i int, err error) error {
+		return &PublishError{MessageUUID: messages[i].UUID, Err: err}
+	}
+
+	err := publisher.waitForConfirms(context.Background(), confirms, messages, watermill.LogFields{}, newPublishError)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2"}, nackedMessages)
+
+	// without OnConfirmNack, nack is returned as the error
+	publisher.config.Publish.OnConfirmNack = nil
+	confirms <- amqp.Confirmation{DeliveryTag: 4, Ack: false}
+
+	err = publisher.waitForConfirms(context.Background(), confirms, messages[:1], watermill.LogFields{}, newPublishError)
+	assert.Error(t, err)
+}
+
+type txChannel struct {
+	AMQPChannel
+
+	calls []string
+}
+
+func (c *txChannel) TxCommit() error {
+	c.calls = append(c.calls, "commit")
+	return nil
+}
+
+func (c *txChannel) TxRollback() error {
+	c.calls = append(c.calls, "rollback")
+	return nil
+}
+
+func TestPublisher_commitTransaction(t *testing.T) {
+	publisher := &Publisher{}
+
+	channel := &txChannel{}
+	publishErr := errors.New("publish failed")
+	assert.Equal(t, publishErr, publisher.commitTransaction(channel, publishErr))
+	// transaction with failed publish is not committed
+	assert.Equal(t, []string{"rollback"}, channel.calls)
+
+	channel = &txChannel{}
+	assert.NoError(t, publisher.commitTransaction(channel, nil))
+	assert.Equal(t, []string{"commit"}, channel.calls)
+}
+
+func TestFirstInvalidRoutingKey(t *testing.T) {
+	tooLong := strings.Repeat("k", maxNameLength+1)
+
+	key, err := firstInvalidRoutingKey([]string{"a", "b"})
+	assert.NoError(t, err)
+	assert.Empty(t, key)
+
+	key, err = firstInvalidRoutingKey([]string{"a", tooLong, "b"})
+	assert.Error(t, err)
+	assert.Equal(t, tooLong, key)
+}
+
+func TestPublisher_generateRoutingKey(t *testing.T) {
+	config := NewDurableQueueConfig("amqp://")
+	config.Publish.GenerateRoutingKey = nil
+	config.Exchange.GenerateRoutingKey = func(topic string) string {
+		return "exchange." + topic
+	}
+	p := &Publisher{config: config}
+
+	// default exchange, routed by the queue name
+	routingKey, err := p.generateRoutingKey("topic", "")
+	require.NoError(t, err)
+	assert.Equal(t, "topic", routingKey)
+
+	config.Exchange.GenerateName = func(topic string) string {
+		return "exchange"
+	}
+	p = &Publisher{config: config}
+
+	routingKey, err = p.generateRoutingKey("topic", "exchange")
+	require.NoError(t, err)
+	assert.Equal(t, "exchange.topic", routingKey)
+}
+
+func TestPublisher_Flush(t *testing.T) {
+	publisher := &Publisher{pendingConfirms: newPendingConfirms()}
+	publisher.pendingConfirms.add("uuid")
+
+	// flush is a no-op without confirms
+	assert.NoError(t, publisher.Flush(context.Background()))
+
+	publisher.config.Publish.ConfirmDelivery = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := publisher.Flush(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "1 message(s) not confirmed: uuid")
+
+	go publisher.pendingConfirms.remove("uuid")
+	assert.NoError(t, publisher.Flush(context.Background()))
+}
+
+func TestPublisher_FailFastWhenBlocked(t *testing.T) {
+	config := NewDurableQueueConfig("amqp://")
+	config.Publish.FailFastWhenBlocked = true
+
+	publisher := newPublisher(&connectionWrapper{logger: watermill.NopLogger{}, closing: make(chan struct{})}, config)
+	publisher.setBlocked(amqp.Blocking{Active: true})
+
+	err := publisher.Publish("topic", message.NewMessage(watermill.NewUUID(), nil))
+	assert.Equal(t, ErrConnectionBlocked, err)
+}
+
+func TestPublishConfig_applyDeliveryProperties(t *testing.T) {
+	config := PublishConfig{
+		DefaultDeliveryMode: amqp.Transient,
+		DefaultPriority:     3,
+	}
+
+	msg := message.NewMessage("1", nil)
+	publishing := amqp.Publishing{}
+	require.NoError(t, config.applyDeliveryProperties(msg, &publishing))
+	assert.Equal(t, amqp.Transient, publishing.DeliveryMode)
+	assert.Equal(t, uint8(3), publishing.Priority)
+
+	// properties set by the marshaler are kept
+	publishing = amqp.Publishing{DeliveryMode: amqp.Persistent, Priority: 5}
+	require.NoError(t, config.applyDeliveryProperties(msg, &publishing))
+	assert.Equal(t, amqp.Persistent, publishing.DeliveryMode)
+	assert.Equal(t, uint8(5), publishing.Priority)
+
+	// metadata takes precedence over the config
+	msg.Metadata.Set(DeliveryModeMetadataKey, "2")
+	msg.Metadata.Set(PriorityMetadataKey, "0")
+	publishing = amqp.Publishing{}
+	require.NoError(t, config.applyDeliveryProperties(msg, &publishing))
+	assert.Equal(t, amqp.Persistent, publishing.DeliveryMode)
+	assert.Equal(t, uint8(0), publishing.Priority)
+
+	msg.Metadata.Set(PriorityMetadataKey, "256")
+	assert.Error(t, config.applyDeliveryProperties(msg, &amqp.Publishing{}))
+
+	msg = message.NewMessage("3", nil)
+	msg.Metadata.Set(DeliveryModeMetadataKey, "3")
+	assert.Error(t, config.applyDeliveryProperties(msg, &amqp.Publishing{}))
+}
+
+func TestPublishConfig_applyAppAndUserID(t *testing.T) {
+	config := PublishConfig{AppID: "app", UserID: "guest"}
+
+	publishing := amqp.Publishing{}
+	config.applyAppAndUserID(message.NewMessage("1", nil), &publishing)
+	assert.Equal(t, "app", publishing.AppId)
+	assert.Equal(t, "guest", publishing.UserId)
+
+	// properties set by the marshaler are kept
+	publishing = amqp.Publishing{AppId: "marshaler_app", UserId: "marshaler_user"}
+	config.applyAppAndUserID(message.NewMessage("2", nil), &publishing)
+	assert.Equal(t, "marshaler_app", publishing.AppId)
+	assert.Equal(t, "marshaler_user", publishing.UserId)
+
+	// metadata takes precedence over the config and the marshaler
+	msg := message.NewMessage("3", nil)
+	msg.Metadata.Set(AppIDMetadataKey, "metadata_app")
+	msg.Metadata.Set(UserIDMetadataKey, "metadata_user")
+	publishing = amqp.Publishing{AppId: "marshaler_app"}
+	config.applyAppAndUserID(msg, &publishing)
+	assert.Equal(t, "metadata_app", publishing.AppId)
+	assert.Equal(t, "metadata_user", publishing.UserId)
+}
+
+func TestPublishConfig_applyCorrelationID(t *testing.T) {
+	config := PublishConfig{
+		CorrelationIDFunc:   CorrelationIDFromUUID,
+		CorrelationIDHeader: "correlation_id",
+	}
+
+	marshalerHeaders := amqp.Table{"foo": "bar"}
+	publishing := amqp.Publishing{Headers: marshalerHeaders}
+	config.applyCorrelationID(message.NewMessage("1", nil), &publishing)
+	assert.Equal(t, "1", publishing.CorrelationId)
+	assert.Equal(t, amqp.Table{"foo": "bar", "correlation_id": "1"}, publishing.Headers)
+	assert.Equal(t, amqp.Table{"foo": "bar"}, marshalerHeaders)
+
+	// correlation ID set by the marshaler is kept
+	publishing = amqp.Publishing{CorrelationId: "from_marshaler"}
+	config.applyCorrelationID(message.NewMessage("2", nil), &publishing)
+	assert.Equal(t, "from_marshaler", publishing.CorrelationId)
+	assert.Empty(t, publishing.Headers)
+
+	publishing = amqp.Publishing{}
+	PublishConfig{}.applyCorrelationID(message.NewMessage("3", nil), &publishing)
+	assert.Empty(t, publishing.CorrelationId)
+}
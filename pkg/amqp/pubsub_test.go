@@ -1,15 +1,22 @@
 package amqp_test
 
 import (
+	"context"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill-amqp/pkg/amqp"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/ThreeDotsLabs/watermill/pubsub/tests"
+	"github.com/pkg/errors"
+	stdAmqp "github.com/streadway/amqp"
 )
 
 func amqpURI() string {
@@ -87,6 +94,28 @@ func createTransactionalPubSub(t *testing.T) (message.Publisher, message.Subscri
 	return publisher, subscriber
 }
 
+func createConfirmDeliveryPubSub(t *testing.T) (message.Publisher, message.Subscriber) {
+	config := amqp.NewDurablePubSubConfig(
+		amqpURI(),
+		amqp.GenerateQueueNameTopicNameWithSuffix("test"),
+	)
+	config.Publish.ConfirmDelivery = true
+
+	publisher, err := amqp.NewPublisher(
+		config,
+		watermill.NewStdLogger(true, true),
+	)
+	require.NoError(t, err)
+
+	subscriber, err := amqp.NewSubscriber(
+		config,
+		watermill.NewStdLogger(true, true),
+	)
+	require.NoError(t, err)
+
+	return publisher, subscriber
+}
+
 func TestPublishSubscribe_pubsub(t *testing.T) {
 	tests.TestPubSub(
 		t,
@@ -153,3 +182,1435 @@ func TestPublishSubscribe_transactional_publish(t *testing.T) {
 		createTransactionalPubSub,
 	)
 }
+
+func TestPublishSubscribe_subscription_cancel(t *testing.T) {
+	subscriber, err := amqp.NewSubscriber(
+		amqp.NewNonDurablePubSubConfig(
+			amqpURI(),
+			amqp.GenerateQueueNameTopicNameWithSuffix("test"),
+		),
+		watermill.NewStdLogger(true, true),
+	)
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+
+	messages, subscription, err := subscriber.SubscribeWithHandle(context.Background(), topic)
+	require.NoError(t, err)
+	assert.Equal(t, topic, subscription.Topic())
+
+	subscription.Cancel()
+
+	select {
+	case _, open := <-messages:
+		assert.False(t, open, "messages channel should be closed after cancel")
+	case <-time.After(5 * time.Second):
+		t.Fatal("messages channel not closed after cancel")
+	}
+
+	// Subscriber should be still usable after subscription is cancelled
+	_, err = subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+}
+
+func TestPublishSubscribe_subscribe_multi(t *testing.T) {
+	publisher, subscriber := createPubSub(t)
+	defer publisher.Close()
+	defer subscriber.Close()
+
+	topics := []string{"topic_" + watermill.NewUUID(), "topic_" + watermill.NewUUID()}
+
+	messages, err := subscriber.(*amqp.Subscriber).SubscribeMulti(context.Background(), topics...)
+	require.NoError(t, err)
+
+	expectedUUIDs := map[string]struct{}{}
+	for _, topic := range topics {
+		msg := message.NewMessage(watermill.NewUUID(), []byte(topic))
+		expectedUUIDs[msg.UUID] = struct{}{}
+
+		require.NoError(t, publisher.Publish(topic, msg))
+	}
+
+	receivedUUIDs := map[string]struct{}{}
+	for len(receivedUUIDs) < len(expectedUUIDs) {
+		select {
+		case msg := <-messages:
+			receivedUUIDs[msg.UUID] = struct{}{}
+			msg.Ack()
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for messages")
+		}
+	}
+
+	assert.Equal(t, expectedUUIDs, receivedUUIDs)
+}
+
+func TestPublishSubscribe_confirm_delivery(t *testing.T) {
+	tests.TestPublishSubscribe(
+		t,
+		tests.TestContext{
+			TestID: tests.NewTestID(),
+			Features: tests.Features{
+				ConsumerGroups:                      true,
+				ExactlyOnceDelivery:                 false,
+				GuaranteedOrder:                     true,
+				GuaranteedOrderWithSingleSubscriber: true,
+				Persistent:                          true,
+			},
+		},
+		createConfirmDeliveryPubSub,
+	)
+}
+
+func TestPublishSubscribe_rpc(t *testing.T) {
+	topic := "rpc_" + watermill.NewUUID()
+
+	serverConfig := amqp.NewNonDurableQueueConfig(amqpURI())
+
+	server, err := amqp.NewSubscriber(serverConfig, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer server.Close()
+
+	replyPublisher, err := amqp.NewPublisher(serverConfig, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer replyPublisher.Close()
+
+	requests, err := server.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	go func() {
+		for request := range requests {
+			reply := amqp.NewRPCReply(request, watermill.NewUUID(), append([]byte("reply_"), request.Payload...))
+			if err := replyPublisher.Publish(request.Metadata.Get(amqp.ReplyToMetadataKey), reply); err != nil {
+				request.Nack()
+				continue
+			}
+			request.Ack()
+		}
+	}()
+
+	client, err := amqp.NewRPCClient(serverConfig, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	reply, err := client.Call(ctx, topic, message.NewMessage(watermill.NewUUID(), []byte("request")))
+	require.NoError(t, err)
+	assert.Equal(t, "reply_request", string(reply.Payload))
+}
+
+func TestPublishSubscribe_purge_and_delete_queue(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	require.NoError(t, subscriber.SubscribeInitialize(topic))
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, publisher.Publish(topic, message.NewMessage(watermill.NewUUID(), nil)))
+	}
+
+	purged, err := subscriber.PurgeQueue(topic)
+	require.NoError(t, err)
+	assert.Equal(t, 3, purged)
+
+	require.NoError(t, subscriber.DeleteQueue(topic, amqp.DeleteQueueOptions{IfEmpty: true}))
+}
+
+func TestPublishSubscribe_subscribe_initialize_info(t *testing.T) {
+	subscriber, err := amqp.NewSubscriber(
+		amqp.NewNonDurablePubSubConfig(
+			amqpURI(),
+			amqp.GenerateQueueNameTopicNameWithSuffix("test"),
+		),
+		watermill.NewStdLogger(true, true),
+	)
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+
+	info, err := subscriber.SubscribeInitializeInfo(topic)
+	require.NoError(t, err)
+
+	assert.Equal(t, topic, info.Topic)
+	assert.Equal(t, topic+"_test", info.QueueName)
+	assert.Equal(t, topic, info.ExchangeName)
+	assert.Equal(t, []string{""}, info.BindingKeys)
+}
+
+func TestPublishSubscribe_get(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	require.NoError(t, subscriber.SubscribeInitialize(topic))
+
+	_, ok, err := subscriber.Get(topic)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	require.NoError(t, publisher.Publish(topic, sentMsg))
+
+	// nacked message is requeued
+	for _, ack := range []bool{false, true} {
+		var msg *message.Message
+		for i := 0; i < 500 && msg == nil; i++ {
+			msg, _, err = subscriber.Get(topic)
+			require.NoError(t, err)
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.NotNil(t, msg)
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+
+		if ack {
+			msg.Ack()
+		} else {
+			msg.Nack()
+		}
+	}
+}
+
+func TestPublishSubscribe_drain(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	require.NoError(t, subscriber.SubscribeInitialize(topic))
+
+	var sentUUIDs []string
+	for i := 0; i < 5; i++ {
+		msg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+		require.NoError(t, publisher.Publish(topic, msg))
+		sentUUIDs = append(sentUUIDs, msg.UUID)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	msgs, err := subscriber.Drain(context.Background(), topic, 3)
+	require.NoError(t, err)
+	require.Len(t, msgs, 3)
+
+	// the queue is empty before max is reached
+	msgs2, err := subscriber.Drain(context.Background(), topic, 10)
+	require.NoError(t, err)
+	require.Len(t, msgs2, 2)
+
+	var drainedUUIDs []string
+	for _, msg := range append(msgs, msgs2...) {
+		drainedUUIDs = append(drainedUUIDs, msg.UUID)
+	}
+	assert.Equal(t, sentUUIDs, drainedUUIDs)
+
+	_, ok, err := subscriber.Get(topic)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestPublishSubscribe_drain_unmarshal_error(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	require.NoError(t, subscriber.SubscribeInitialize(topic))
+
+	connection, err := stdAmqp.Dial(amqpURI())
+	require.NoError(t, err)
+	defer connection.Close()
+	channel, err := connection.Channel()
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	// without the UUID header, the message cannot be unmarshaled
+	require.NoError(t, channel.Publish("", topic, false, false, stdAmqp.Publishing{Body: []byte("invalid")}))
+	require.NoError(t, publisher.Publish(topic, sentMsg))
+	time.Sleep(100 * time.Millisecond)
+
+	// the invalid message doesn't stop draining
+	msgs, err := subscriber.Drain(context.Background(), topic, 10)
+	assert.Error(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, sentMsg.UUID, msgs[0].UUID)
+
+	// the invalid message is requeued (Config.Consume.OnUnmarshalError is UnmarshalErrorRequeue by default)
+	msgs, err = subscriber.Drain(context.Background(), topic, 10)
+	assert.Error(t, err)
+	assert.Empty(t, msgs)
+
+	config.Consume.OnUnmarshalError = amqp.UnmarshalErrorDrop
+	dropSubscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer dropSubscriber.Close()
+
+	_, err = dropSubscriber.Drain(context.Background(), topic, 10)
+	assert.Error(t, err)
+
+	_, ok, err := subscriber.Get(topic)
+	require.NoError(t, err)
+	assert.False(t, ok, "invalid message should be dropped")
+}
+
+func TestPublishSubscribe_no_wait_topology_mismatch(t *testing.T) {
+	topic := "topic_" + watermill.NewUUID()
+
+	subscriber, err := amqp.NewSubscriber(amqp.NewDurableQueueConfig(amqpURI()), watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+	require.NoError(t, subscriber.SubscribeInitialize(topic))
+
+	// the queue already exists as durable, so the broker closes the channel with PRECONDITION_FAILED
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Queue.NoWait = true
+
+	noWaitSubscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer noWaitSubscriber.Close()
+
+	err = noWaitSubscriber.SubscribeInitialize(topic)
+	require.Error(t, err)
+	assert.True(t, amqp.IsTopologyMismatchError(err), "expected topology mismatch, got %v", err)
+}
+
+func TestPublishSubscribe_return_fallback_topic(t *testing.T) {
+	fallbackTopic := "fallback_" + watermill.NewUUID()
+
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Publish.Mandatory = true
+	config.Publish.ReturnFallbackTopic = fallbackTopic
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	messages, err := subscriber.Subscribe(context.Background(), fallbackTopic)
+	require.NoError(t, err)
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	// there is no queue for this topic, so the message is returned
+	sentMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	require.NoError(t, publisher.Publish("unroutable_"+watermill.NewUUID(), sentMsg))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		assert.Equal(t, "NO_ROUTE", msg.Metadata.Get("x-returned-reason"))
+		msg.Ack()
+	case <-time.After(10 * time.Second):
+		t.Fatal("returned message not received from fallback topic")
+	}
+}
+
+func TestPublishSubscribe_single_active_consumer(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Queue.SingleActiveConsumer = true
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+
+	activeSubscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	activeMessages, err := activeSubscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	waitingSubscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer waitingSubscriber.Close()
+
+	waitingMessages, err := waitingSubscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, publisher.Publish(topic, message.NewMessage(watermill.NewUUID(), nil)))
+	}
+
+	for i := 0; i < 10; i++ {
+		select {
+		case msg := <-activeMessages:
+			msg.Ack()
+		case msg := <-waitingMessages:
+			t.Fatalf("message %s received by the waiting consumer", msg.UUID)
+		case <-time.After(10 * time.Second):
+			t.Fatal("message not received by the active consumer")
+		}
+	}
+
+	// waiting consumer takes over after the active consumer is closed
+	require.NoError(t, activeSubscriber.Close())
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), nil)
+	require.NoError(t, publisher.Publish(topic, sentMsg))
+
+	select {
+	case msg := <-waitingMessages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		msg.Ack()
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not received by the consumer which took over")
+	}
+}
+
+func TestPublishSubscribe_subscribe_queue(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+
+	// queue is declared by the publishing side, GenerateName is not used by SubscribeQueue
+	declaringSubscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer declaringSubscriber.Close()
+	require.NoError(t, declaringSubscriber.SubscribeInitialize(topic))
+
+	queueConfig := amqp.NewNonDurableQueueConfig(amqpURI())
+	queueConfig.Queue.GenerateName = func(topic string) string {
+		return "not_used_" + topic
+	}
+
+	subscriber, err := amqp.NewSubscriber(queueConfig, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	messages, err := subscriber.SubscribeQueue(context.Background(), topic)
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	require.NoError(t, publisher.Publish(topic, sentMsg))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		msg.Ack()
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not received from the existing queue")
+	}
+}
+
+func TestPublishSubscribe_process_in_order(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Consume.ProcessInOrder = true
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	var sentMessages message.Messages
+	for i := 0; i < 5; i++ {
+		sentMessages = append(sentMessages, message.NewMessage(watermill.NewUUID(), nil))
+	}
+	require.NoError(t, publisher.Publish(topic, sentMessages...))
+
+	for _, sentMsg := range sentMessages {
+		var msg *message.Message
+		select {
+		case msg = <-messages:
+			assert.Equal(t, sentMsg.UUID, msg.UUID)
+		case <-time.After(10 * time.Second):
+			t.Fatal("message not received")
+		}
+
+		// next message is not delivered until the current one is acked
+		select {
+		case nextMsg := <-messages:
+			t.Fatalf("message %s received before %s was acked", nextMsg.UUID, msg.UUID)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		msg.Ack()
+	}
+}
+
+func TestPublishSubscribe_channel_stats(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+
+	messages, handle, err := subscriber.SubscribeWithHandle(context.Background(), topic)
+	require.NoError(t, err)
+
+	require.NoError(t, publisher.Publish(topic, message.NewMessage(watermill.NewUUID(), nil)))
+	assert.Equal(t, int64(0), publisher.ChannelStats().Open())
+
+	select {
+	case msg := <-messages:
+		msg.Ack()
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	handle.Cancel()
+	<-handle.Done()
+
+	stats := subscriber.ChannelStats()
+	assert.True(t, stats.Opened > 0)
+	assert.Equal(t, int64(0), stats.Open())
+}
+
+func TestPublishSubscribe_connection_health(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Connection.HealthCheckOpenChannel = true
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// connected
+	assert.NoError(t, publisher.WaitForConnection(ctx))
+	assert.NoError(t, publisher.Healthy())
+	assert.NoError(t, publisher.LastError())
+
+	assert.NoError(t, subscriber.WaitForConnection(ctx))
+	assert.NoError(t, subscriber.Healthy())
+	assert.NoError(t, subscriber.LastError())
+
+	require.NoError(t, publisher.Close())
+	require.NoError(t, subscriber.Close())
+
+	// closed
+	assert.Error(t, publisher.Healthy())
+	assert.Error(t, subscriber.Healthy())
+	// connection closed by Close is not an error
+	assert.NoError(t, publisher.LastError())
+	assert.NoError(t, subscriber.LastError())
+
+	assert.Error(t, publisher.WaitForConnection(context.Background()))
+	assert.Error(t, subscriber.WaitForConnection(context.Background()))
+}
+
+func TestPublishSubscribe_with_connection(t *testing.T) {
+	connection, err := stdAmqp.Dial(amqpURI())
+	require.NoError(t, err)
+	defer connection.Close()
+
+	config := amqp.NewNonDurableQueueConfig("")
+
+	publisher, err := amqp.NewPublisherWithConnection(connection, config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	subscriber, err := amqp.NewSubscriberWithConnection(connection, config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+
+	topic := "topic_" + watermill.NewUUID()
+
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	require.NoError(t, publisher.Publish(topic, sentMsg))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		msg.Ack()
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	require.NoError(t, publisher.Close())
+	require.NoError(t, subscriber.Close())
+
+	// connection is owned by the caller
+	assert.False(t, connection.IsClosed())
+}
+
+func TestPublishSubscribe_rebind(t *testing.T) {
+	exchangeName := "exchange_" + watermill.NewUUID()
+
+	config := amqp.NewNonDurablePubSubConfig(amqpURI(), amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+	config.Exchange.GenerateName = func(topic string) string {
+		return exchangeName
+	}
+	config.Exchange.Type = "direct"
+	config.QueueBind.GenerateRoutingKey = func(queueName string) string {
+		return "initial"
+	}
+	config.Publish.GenerateRoutingKey = func(topic string) string {
+		return topic
+	}
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	require.NoError(t, subscriber.Rebind(topic, []string{"tenant_a"}, []string{"initial"}))
+
+	// not bound anymore
+	require.NoError(t, publisher.Publish("initial", message.NewMessage(watermill.NewUUID(), nil)))
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), nil)
+	require.NoError(t, publisher.Publish("tenant_a", sentMsg))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		msg.Ack()
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not received with the added binding")
+	}
+}
+
+func TestPublishSubscribe_fanout(t *testing.T) {
+	exchangeName := "exchange_" + watermill.NewUUID()
+
+	config := amqp.NewNonDurablePubSubConfig(amqpURI(), amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+	config.Exchange.GenerateName = func(topic string) string {
+		return exchangeName
+	}
+	config.Exchange.Type = "direct"
+	config.QueueBind.GenerateRoutingKey = func(queueName string) string {
+		return queueName
+	}
+	config.Publish.ConfirmDelivery = true
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	shards := []string{"shard_a_" + watermill.NewUUID(), "shard_b_" + watermill.NewUUID()}
+	var outputs []<-chan *message.Message
+	for _, shard := range shards {
+		messages, err := subscriber.Subscribe(context.Background(), shard)
+		require.NoError(t, err)
+		outputs = append(outputs, messages)
+	}
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), []byte("broadcast"))
+	require.NoError(t, publisher.PublishFanout(shards[0], []string{shards[0] + "_test", shards[1] + "_test"}, sentMsg))
+
+	for i, messages := range outputs {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, sentMsg.UUID, msg.UUID)
+			assert.Equal(t, sentMsg.Payload, msg.Payload)
+			msg.Ack()
+		case <-time.After(10 * time.Second):
+			t.Fatalf("message not received by %s", shards[i])
+		}
+	}
+
+	assert.Error(t, publisher.PublishFanout(shards[0], nil, sentMsg))
+
+	// too long routing key is reported, instead of closing the channel by the broker
+	tooLongKey := strings.Repeat("k", 256)
+	err = publisher.PublishFanout(shards[0], []string{shards[0] + "_test", tooLongKey}, sentMsg)
+	publishErr, ok := err.(*amqp.PublishError)
+	require.True(t, ok, "expected PublishError, got %v", err)
+	assert.Equal(t, tooLongKey, publishErr.RoutingKey)
+}
+
+func TestPublishSubscribe_publish_error_metadata_routing_key(t *testing.T) {
+	config := amqp.NewNonDurablePubSubConfig(amqpURI(), amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+	config.Publish.RoutingKeyMetadataKey = "routing_key"
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	tooLongKey := strings.Repeat("k", 256)
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+	msg.Metadata.Set("routing_key", tooLongKey)
+
+	err = publisher.Publish("topic_"+watermill.NewUUID(), msg)
+	publishErr, ok := err.(*amqp.PublishError)
+	require.True(t, ok, "expected PublishError, got %v", err)
+	assert.Equal(t, tooLongKey, publishErr.RoutingKey)
+	assert.Equal(t, msg.UUID, publishErr.MessageUUID)
+}
+
+func TestPublishSubscribe_cancel_consumer(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+
+	messages, handle, err := subscriber.SubscribeWithHandle(context.Background(), topic)
+	require.NoError(t, err)
+	require.NotEmpty(t, handle.ConsumerTag())
+
+	require.NoError(t, publisher.Publish(topic, message.NewMessage(watermill.NewUUID(), nil)))
+
+	var msg *message.Message
+	select {
+	case msg = <-messages:
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	require.NoError(t, subscriber.CancelConsumer(handle.ConsumerTag()))
+
+	// delivered message is still processed
+	msg.Ack()
+
+	select {
+	case <-handle.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("subscription not stopped after consumer cancel")
+	}
+
+	_, ok := <-messages
+	assert.False(t, ok)
+
+	assert.Error(t, subscriber.CancelConsumer(handle.ConsumerTag()))
+
+	// acked message is not redelivered
+	_, ok, err = subscriber.Get(topic)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestPublishSubscribe_publish_with_context(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Publish.ConfirmDelivery = true
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = publisher.PublishWithContext(ctx, topic, message.NewMessage(watermill.NewUUID(), nil))
+	require.Error(t, err)
+	assert.Equal(t, context.Canceled, errors.Cause(err))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	require.NoError(t, publisher.PublishWithContext(ctx, topic, message.NewMessage(watermill.NewUUID(), nil)))
+}
+
+func TestPublishSubscribe_app_id_user_id(t *testing.T) {
+	uri, err := stdAmqp.ParseURI(amqpURI())
+	require.NoError(t, err)
+
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Publish.AppID = "test_app"
+	config.Publish.UserID = uri.Username
+	config.Publish.ConfirmDelivery = true
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	defaultMsg := message.NewMessage(watermill.NewUUID(), nil)
+	overriddenMsg := message.NewMessage(watermill.NewUUID(), nil)
+	overriddenMsg.Metadata.Set(amqp.AppIDMetadataKey, "other_app")
+	require.NoError(t, publisher.Publish(topic, defaultMsg, overriddenMsg))
+
+	for _, expectedAppID := range []string{"test_app", "other_app"} {
+		select {
+		case msg := <-messages:
+			delivery, ok := amqp.DeliveryFromContext(msg.Context())
+			require.True(t, ok)
+			assert.Equal(t, expectedAppID, delivery.AppId)
+			assert.Equal(t, uri.Username, delivery.UserId)
+			msg.Ack()
+		case <-time.After(10 * time.Second):
+			t.Fatal("message not received")
+		}
+	}
+
+	// the broker rejects UserId not matching the user of the connection
+	invalidUserMsg := message.NewMessage(watermill.NewUUID(), nil)
+	invalidUserMsg.Metadata.Set(amqp.UserIDMetadataKey, "not_"+uri.Username)
+	err = publisher.Publish(topic, invalidUserMsg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "PRECONDITION_FAILED")
+}
+
+func TestPublishSubscribe_publish_timeout(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Publish.ConfirmDelivery = true
+	config.Publish.Timeout = time.Nanosecond
+	config.Publish.Retry = amqp.PublishRetryConfig{
+		MaxAttempts: 5,
+		Backoff:     &amqp.ReconnectConfig{BackoffInitialInterval: 5 * time.Second, BackoffMultiplier: 1},
+	}
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+
+	// timeout is not retryable, so Publish returns without waiting for the retry backoff
+	start := time.Now()
+	err = publisher.Publish(topic, message.NewMessage(watermill.NewUUID(), nil))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+	assert.True(t, time.Since(start) < 5*time.Second, "publish should not be retried after timeout")
+
+	// the publish finished in the background doesn't break the publisher
+	require.NoError(t, publisher.Flush(context.Background()))
+}
+
+func TestPublishSubscribe_generate_queue_names(t *testing.T) {
+	config := amqp.NewNonDurablePubSubConfig(amqpURI(), amqp.GenerateQueueNameTopicNameWithSuffix("test"))
+	config.Queue.GenerateNames = func(topic string) []string {
+		return []string{topic + "_shard_1", topic + "_shard_2"}
+	}
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+
+	info, err := subscriber.SubscribeInitializeInfo(topic)
+	require.NoError(t, err)
+	assert.Equal(t, []string{topic + "_shard_1", topic + "_shard_2"}, info.QueueNames)
+
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	// fanout exchange routes the message to both queues
+	sentMsg := message.NewMessage(watermill.NewUUID(), nil)
+	require.NoError(t, publisher.Publish(topic, sentMsg))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, sentMsg.UUID, msg.UUID)
+			msg.Ack()
+		case <-time.After(10 * time.Second):
+			t.Fatal("message not received from all queues")
+		}
+	}
+}
+
+func TestPublishSubscribe_retry(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Consume.Retry = amqp.RetryConfig{MaxRetries: 2}
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	require.NoError(t, publisher.Publish(topic, sentMsg))
+
+	// message is republished to the back of the queue with incremented retry count
+	for _, expectedRetries := range []string{"", "1", "2"} {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, sentMsg.UUID, msg.UUID)
+			assert.Equal(t, expectedRetries, msg.Metadata.Get(amqp.RetryCountHeader))
+			msg.Nack()
+		case <-time.After(10 * time.Second):
+			t.Fatalf("message with %q retries not received", expectedRetries)
+		}
+	}
+
+	// after MaxRetries, message is rejected
+	select {
+	case msg := <-messages:
+		t.Fatalf("message %s received after max retries", msg.UUID)
+	case <-time.After(time.Second):
+	}
+}
+
+func TestPublishSubscribe_requeue_with_delay(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Consume.Requeue = amqp.RequeueConfig{Delay: time.Second}
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	require.NoError(t, publisher.Publish(topic, sentMsg))
+
+	var nackedAt time.Time
+	select {
+	case msg := <-messages:
+		nackedAt = time.Now()
+		msg.Nack()
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		assert.True(t, time.Since(nackedAt) >= config.Consume.Requeue.Delay, "message redelivered before the delay")
+		msg.Ack()
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not redelivered after the delay")
+	}
+}
+
+// queueOnlyTopologyBuilder declares only the consumed queue, without the delay queue.
+type queueOnlyTopologyBuilder struct{}
+
+func (queueOnlyTopologyBuilder) BuildTopology(
+	channel amqp.AMQPChannel,
+	queueName string,
+	exchangeName string,
+	config amqp.Config,
+	logger watermill.LoggerAdapter,
+) error {
+	_, err := channel.QueueDeclare(queueName, config.Queue.Durable, config.Queue.AutoDelete, config.Queue.Exclusive, false, nil)
+	return err
+}
+
+func (queueOnlyTopologyBuilder) ExchangeDeclare(
+	channel amqp.AMQPChannel,
+	exchangeName string,
+	config amqp.Config,
+) error {
+	return nil
+}
+
+func TestPublishSubscribe_requeue_with_delay_missing_delay_queue(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Consume.Requeue = amqp.RequeueConfig{Delay: time.Second}
+	config.TopologyBuilder = queueOnlyTopologyBuilder{}
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	require.NoError(t, publisher.Publish(topic, sentMsg))
+
+	// copy is returned by the broker, so the original is requeued instead of lost
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, sentMsg.UUID, msg.UUID)
+			if i == 0 {
+				msg.Nack()
+			} else {
+				msg.Ack()
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("nacked message was lost")
+		}
+	}
+}
+
+func TestPublishSubscribe_retry_unroutable(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Consume.Retry = amqp.RetryConfig{
+		MaxRetries: 2,
+		GenerateRoutingKey: func(queueName string) string {
+			return "missing_" + queueName
+		},
+	}
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	require.NoError(t, publisher.Publish(topic, sentMsg))
+
+	// unroutable copy is returned by the broker, so the original is requeued instead of acked
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, sentMsg.UUID, msg.UUID)
+			assert.Equal(t, "", msg.Metadata.Get(amqp.RetryCountHeader))
+			if i == 0 {
+				msg.Nack()
+			} else {
+				msg.Ack()
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("nacked message was lost")
+		}
+	}
+}
+
+func TestPublishSubscribe_ack_on_receive(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Consume.AckOnReceive = true
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	require.NoError(t, publisher.Publish(topic, sentMsg))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		msg.Nack()
+		<-msg.Context().Done()
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	// message was acked on receive, so nack doesn't requeue it
+	select {
+	case msg := <-messages:
+		t.Fatalf("message %s redelivered", msg.UUID)
+	case <-time.After(time.Second):
+	}
+}
+
+func TestPublishSubscribe_subscription_state(t *testing.T) {
+	subscriber, err := amqp.NewSubscriber(amqp.NewNonDurableQueueConfig(amqpURI()), watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	_, subscription, err := subscriber.SubscribeWithHandle(context.Background(), "topic_"+watermill.NewUUID())
+	require.NoError(t, err)
+
+	for i := 0; i < 500 && subscription.State() != amqp.SubscriptionConsuming; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, amqp.SubscriptionConsuming, subscription.State())
+
+	subscription.Cancel()
+	assert.Equal(t, amqp.SubscriptionStopped, subscription.State())
+}
+
+func TestPublishSubscribe_pause_resume(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	messages, subscription, err := subscriber.SubscribeWithHandle(context.Background(), topic)
+	require.NoError(t, err)
+
+	subscription.Pause()
+	assert.True(t, subscription.IsPaused())
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), []byte("payload"))
+	require.NoError(t, publisher.Publish(topic, sentMsg))
+
+	select {
+	case msg := <-messages:
+		t.Fatalf("message %s received while paused", msg.UUID)
+	case <-time.After(time.Second):
+	}
+
+	subscription.Resume()
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		msg.Ack()
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not received after resume")
+	}
+}
+
+func TestPublishSubscribe_on_reconnect(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+
+	config.Connection.OnReconnect = func(connection *stdAmqp.Connection) error {
+		return errors.New("setup failed")
+	}
+	_, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "setup failed")
+
+	var calls int32
+	config.Connection.OnReconnect = func(connection *stdAmqp.Connection) error {
+		atomic.AddInt32(&calls, 1)
+
+		channel, err := connection.Channel()
+		if err != nil {
+			return err
+		}
+		return channel.Close()
+	}
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+// failingTopologyBuilder declares the topology only the first time, next declarations fail.
+type failingTopologyBuilder struct {
+	amqp.DefaultTopologyBuilder
+	calls int32
+}
+
+func (b *failingTopologyBuilder) BuildTopology(
+	channel amqp.AMQPChannel,
+	queueName string,
+	exchangeName string,
+	config amqp.Config,
+	logger watermill.LoggerAdapter,
+) error {
+	if atomic.AddInt32(&b.calls, 1) > 1 {
+		return errors.New("cannot declare topology")
+	}
+
+	return b.DefaultTopologyBuilder.BuildTopology(channel, queueName, exchangeName, config, logger)
+}
+
+func TestPublishSubscribe_reconnect_max_attempts(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.TopologyBuilder = &failingTopologyBuilder{}
+	config.Connection.Reconnect = amqp.DefaultReconnectConfig()
+	config.Connection.Reconnect.MaxAttempts = 2
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	messages, errs, err := subscriber.SubscribeWithErrors(context.Background(), topic)
+	require.NoError(t, err)
+
+	// queue is declared by SubscribeWithErrors, after the delete the consumer is cancelled by the broker
+	// (or it cannot be started) and the queue cannot be declared again
+	require.NoError(t, subscriber.DeleteQueue(topic, amqp.DeleteQueueOptions{}))
+
+	select {
+	case err := <-errs:
+		assert.Equal(t, amqp.ErrReconnectAttemptsExhausted, errors.Cause(err))
+	case <-time.After(30 * time.Second):
+		t.Fatal("terminal error not received")
+	}
+
+	_, ok := <-messages
+	assert.False(t, ok, "output channel should be closed")
+}
+
+func TestPublishSubscribe_reuse_topology_channel(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Consume.ReuseTopologyChannel = true
+	config.Connection.Reconnect = amqp.DefaultReconnectConfig()
+	config.Connection.Reconnect.BackoffInitialInterval = 10 * time.Millisecond
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	// consumer is cancelled by the broker, the queue is declared again on the consuming channel
+	require.NoError(t, subscriber.DeleteQueue(topic, amqp.DeleteQueueOptions{}))
+
+	sentMsg := message.NewMessage(watermill.NewUUID(), nil)
+	for i := 0; i < 100; i++ {
+		// messages published before the queue is declared again are dropped by the broker
+		require.NoError(t, publisher.Publish(topic, sentMsg))
+
+		select {
+		case msg := <-messages:
+			assert.Equal(t, sentMsg.UUID, msg.UUID)
+			msg.Ack()
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	t.Fatal("message not received after the topology was declared again")
+}
+
+func TestPublishSubscribe_prefetch_size_not_applied_with_rabbitmq(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Consume.Qos.PrefetchSize = 4096
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	// RabbitMQ would close the connection, if the prefetch size was sent
+	sentMsg := message.NewMessage(watermill.NewUUID(), nil)
+	require.NoError(t, publisher.Publish(topic, sentMsg))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMsg.UUID, msg.UUID)
+		msg.Ack()
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not received")
+	}
+	assert.True(t, subscriber.IsConnected())
+}
+
+func TestPublishSubscribe_immediate_not_supported(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Publish.Immediate = true
+	config.Publish.ConfirmDelivery = true
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	err = publisher.Publish("topic_"+watermill.NewUUID(), message.NewMessage(watermill.NewUUID(), nil))
+	require.Error(t, err)
+	assert.True(t, amqp.IsImmediateNotSupportedError(err), "unexpected error: %s", err)
+}
+
+func TestPublishSubscribe_sync_ack(t *testing.T) {
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Consume.SyncAck = true
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	var sentMessages message.Messages
+	for i := 0; i < 3; i++ {
+		sentMessages = append(sentMessages, message.NewMessage(watermill.NewUUID(), nil))
+	}
+	require.NoError(t, publisher.Publish(topic, sentMessages...))
+
+	for i := range sentMessages {
+		select {
+		case msg := <-messages:
+			// all previous messages were acked before this one was received
+			assert.EqualValues(t, i, subscriber.Stats().Acked)
+			msg.Ack()
+		case <-time.After(10 * time.Second):
+			t.Fatal("message not received")
+		}
+	}
+}
+
+func TestPublishSubscribe_large_message_warning(t *testing.T) {
+	var reportedSizes []int
+
+	config := amqp.NewNonDurableQueueConfig(amqpURI())
+	config.Publish.LargeMessageWarnBytes = 100
+	config.Publish.OnLargeMessage = func(topic string, msg *message.Message, bodyBytes int) {
+		reportedSizes = append(reportedSizes, bodyBytes)
+	}
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	require.NoError(t, publisher.Publish(
+		topic,
+		message.NewMessage(watermill.NewUUID(), []byte("small")),
+		message.NewMessage(watermill.NewUUID(), make([]byte, 101)),
+	))
+
+	assert.Equal(t, []int{101}, reportedSizes)
+}
+
+func TestPublishSubscribe_graceful_shutdown(t *testing.T) {
+	config := amqp.NewDurableQueueConfig(amqpURI())
+
+	publisher, err := amqp.NewPublisher(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer publisher.Close()
+
+	subscriber, err := amqp.NewSubscriber(config, watermill.NewStdLogger(true, true))
+	require.NoError(t, err)
+	defer subscriber.Close()
+
+	topic := "topic_" + watermill.NewUUID()
+	require.NoError(t, subscriber.SubscribeInitialize(topic))
+
+	var sentMessages message.Messages
+	for i := 0; i < 3; i++ {
+		sentMessages = append(sentMessages, message.NewMessage(watermill.NewUUID(), nil))
+	}
+	require.NoError(t, publisher.Publish(topic, sentMessages...))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, err := subscriber.Subscribe(ctx, topic)
+	require.NoError(t, err)
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, sentMessages[0].UUID, msg.UUID)
+
+		// consumer is cancelled, but the in-flight message can be still acked
+		cancel()
+		time.Sleep(100 * time.Millisecond)
+		msg.Ack()
+	case <-time.After(10 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	// output channel is closed after the in-flight message is acked
+	for msg := range messages {
+		// message received before the consumer was cancelled
+		msg.Nack()
+	}
+
+	messages, err = subscriber.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	var receivedUUIDs []string
+	for range sentMessages[1:] {
+		select {
+		case msg := <-messages:
+			receivedUUIDs = append(receivedUUIDs, msg.UUID)
+			msg.Ack()
+		case <-time.After(10 * time.Second):
+			t.Fatal("message not redelivered")
+		}
+	}
+	assert.ElementsMatch(t, []string{sentMessages[1].UUID, sentMessages[2].UUID}, receivedUUIDs)
+}
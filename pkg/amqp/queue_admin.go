@@ -0,0 +1,176 @@
+package amqp
+
+import (
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+// DeleteQueueOptions configures Subscriber.DeleteQueue.
+type DeleteQueueOptions struct {
+	// When IfUnused is true, the queue will not be deleted if there are any
+	// consumers on the queue. If there are consumers, an error will be returned and
+	// the channel will be closed.
+	IfUnused bool
+
+	// When IfEmpty is true, the queue will not be deleted if there are any messages
+	// remaining on the queue. If there are messages, an error will be returned and
+	// the channel will be closed.
+	IfEmpty bool
+
+	// When NoWait is true, the queue will be deleted without waiting for a response
+	// from the server. The purged message count will not be meaningful.
+	NoWait bool
+}
+
+// PurgeQueue removes all messages, which are not awaiting acknowledgment, from the queue generated for the topic.
+// It returns the number of purged messages.
+//
+// IMPORTANT: PurgeQueue is destructive, purged messages cannot be restored.
+// It is intended for tests teardown and operational cleanup.
+func (s *Subscriber) PurgeQueue(topic string) (purged int, err error) {
+	queueName, err := s.adminQueueName(topic)
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.withAdminChannel(func(channel AMQPChannel) error {
+		purged, err = channel.QueuePurge(queueName, false)
+		return err
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "cannot purge queue %s", queueName)
+	}
+
+	s.logger.Info("Queue purged", watermill.LogFields{
+		"topic":           topic,
+		"amqp_queue_name": queueName,
+		"purged_messages": purged,
+	})
+
+	return purged, nil
+}
+
+// DeleteQueue deletes the queue generated for the topic. Bindings of the queue are removed as well.
+// Messages in the queue are lost, they are not dead-lettered.
+//
+// IMPORTANT: DeleteQueue is destructive, deleted queue with its messages cannot be restored.
+// It is intended for tests teardown and operational cleanup.
+// Subscriptions consuming from the deleted queue are cancelled by the broker.
+func (s *Subscriber) DeleteQueue(topic string, options DeleteQueueOptions) error {
+	queueName, err := s.adminQueueName(topic)
+	if err != nil {
+		return err
+	}
+
+	var deleted int
+	err = s.withAdminChannel(func(channel AMQPChannel) error {
+		deleted, err = channel.QueueDelete(queueName, options.IfUnused, options.IfEmpty, options.NoWait)
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "cannot delete queue %s", queueName)
+	}
+
+	s.logger.Info("Queue deleted", watermill.LogFields{
+		"topic":            topic,
+		"amqp_queue_name":  queueName,
+		"deleted_messages": deleted,
+	})
+
+	return nil
+}
+
+func (s *Subscriber) adminQueueName(topic string) (string, error) {
+	if err := s.checkSubscribe(); err != nil {
+		return "", err
+	}
+
+	queueName := s.config.Queue.GenerateName(topic)
+	if queueName == "" {
+		return "", errors.New("queue name for the topic is empty, server named queues are not supported")
+	}
+
+	return queueName, nil
+}
+
+// withAdminChannel runs f with a new channel, which is closed afterwards.
+func (s *Subscriber) withAdminChannel(f func(channel AMQPChannel) error) (err error) {
+	channel, err := s.openChannel()
+	if err != nil {
+		return errors.Wrap(err, "cannot open channel")
+	}
+	defer func() {
+		if channelCloseErr := s.closeChannel(channel); channelCloseErr != nil {
+			err = multierror.Append(err, channelCloseErr)
+		}
+	}()
+
+	return f(channel)
+}
+
+// Rebind binds the queue generated for the topic to the topic's exchange with addKeys routing keys
+// and removes bindings with removeKeys routing keys. Bindings are changed on a separate channel,
+// so it's safe to call Rebind while the topic is consumed.
+//
+// Bindings are created with Config.QueueBind.Arguments and removed with the same arguments.
+// Bindings added by Rebind are not restored when the topology is declared again after reconnect,
+// so they are lost when non durable queue is deleted during the outage.
+func (s *Subscriber) Rebind(topic string, addKeys, removeKeys []string) error {
+	queueName, err := s.adminQueueName(topic)
+	if err != nil {
+		return err
+	}
+
+	exchangeName := s.config.Exchange.GenerateName(topic)
+	if exchangeName == "" {
+		return errors.New("exchange name for the topic is empty, queues cannot be bound to the default exchange")
+	}
+
+	for _, keys := range [][]string{addKeys, removeKeys} {
+		for _, key := range keys {
+			if err := validateRoutingKey(key); err != nil {
+				return errors.Wrapf(err, "invalid routing key %q", key)
+			}
+		}
+	}
+
+	logFields := watermill.LogFields{
+		"topic":              topic,
+		"amqp_queue_name":    queueName,
+		"amqp_exchange_name": exchangeName,
+	}
+
+	err = s.withAdminChannel(func(channel AMQPChannel) error {
+		for _, key := range addKeys {
+			if err := channel.QueueBind(
+				queueName,
+				key,
+				exchangeName,
+				s.config.QueueBind.NoWait,
+				s.config.QueueBind.Arguments,
+			); err != nil {
+				return errors.Wrapf(err, "cannot bind with routing key %q", key)
+			}
+		}
+
+		for _, key := range removeKeys {
+			if err := channel.QueueUnbind(queueName, key, exchangeName, s.config.QueueBind.Arguments); err != nil {
+				return errors.Wrapf(err, "cannot unbind routing key %q", key)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "cannot rebind queue %s", queueName)
+	}
+
+	s.logger.Info("Queue rebound", logFields.Add(watermill.LogFields{
+		"added_binding_keys":   addKeys,
+		"removed_binding_keys": removeKeys,
+	}))
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package amqp
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// republisher publishes copies of consumed messages (see ConsumeConfig.Retry and ConsumeConfig.Requeue)
+// on a dedicated channel in confirm mode and with the mandatory flag.
+//
+// publish returns only after the broker confirmed the copy, so the original delivery may be acked safely.
+// Copies which are not routed to any queue, are nacked by the broker or are not confirmed in time
+// are reported as errors, instead of being silently dropped.
+type republisher struct {
+	conn      *connectionWrapper
+	logger    watermill.LoggerAdapter
+	logFields watermill.LogFields
+
+	// timeout limits waiting for the confirm, waiting is stopped also when closing is closed
+	timeout time.Duration
+	closing <-chan struct{}
+
+	// lock serializes publishes, so every confirm and return belongs to the single pending publish
+	lock     sync.Mutex
+	channel  AMQPChannel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+func newRepublisher(
+	conn *connectionWrapper,
+	timeout time.Duration,
+	closing <-chan struct{},
+	logFields watermill.LogFields,
+) *republisher {
+	return &republisher{conn: conn, logger: conn.logger, logFields: logFields, timeout: timeout, closing: closing}
+}
+
+// publish publishes the publishing and waits for the confirm.
+func (r *republisher) publish(exchangeName, routingKey string, publishing amqp.Publishing) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if err := r.openChannel(); err != nil {
+		return err
+	}
+
+	if err := r.channel.Publish(exchangeName, routingKey, true, false, publishing); err != nil {
+		r.closeChannel()
+		return errors.Wrap(err, "cannot publish message")
+	}
+
+	timeout := time.NewTimer(r.timeout)
+	defer timeout.Stop()
+
+	var confirmation amqp.Confirmation
+	select {
+	case c, ok := <-r.confirms:
+		if !ok {
+			r.closeChannel()
+			return errors.New("channel closed before message was confirmed")
+		}
+		confirmation = c
+	case <-timeout.C:
+		// late confirm would be received by the next publish, so the channel is not used anymore
+		r.closeChannel()
+		return errors.Errorf("message was not confirmed in %s", r.timeout)
+	case <-r.closing:
+		r.closeChannel()
+		return errors.New("closing before message was confirmed")
+	}
+
+	// the broker sends basic.return before the confirm of the unroutable message
+	select {
+	case returned := <-r.returns:
+		return errors.Errorf(
+			"message was returned by the broker (exchange %q, routing key %q): %s",
+			exchangeName, routingKey, returned.ReplyText,
+		)
+	default:
+	}
+
+	if !confirmation.Ack {
+		return errors.Errorf("message was nacked by the broker (exchange %q, routing key %q)", exchangeName, routingKey)
+	}
+
+	return nil
+}
+
+// openChannel opens the channel in confirm mode, when it's not open yet.
+func (r *republisher) openChannel() error {
+	if r.channel != nil {
+		return nil
+	}
+
+	channel, err := r.conn.openChannel()
+	if err != nil {
+		return errors.Wrap(err, "cannot open channel")
+	}
+	if err := channel.Confirm(false); err != nil {
+		if closeErr := r.conn.closeChannel(channel); closeErr != nil {
+			r.logger.Error("Failed to close republish channel", closeErr, r.logFields)
+		}
+		return errors.Wrap(err, "cannot put channel into confirm mode")
+	}
+
+	r.channel = channel
+	r.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	r.returns = channel.NotifyReturn(make(chan amqp.Return, 1))
+
+	return nil
+}
+
+// closeChannel closes the channel, a new one is opened by the next publish.
+func (r *republisher) closeChannel() {
+	if r.channel == nil {
+		return
+	}
+
+	if err := r.conn.closeChannel(r.channel); err != nil {
+		r.logger.Debug("Failed to close republish channel", r.logFields.Add(watermill.LogFields{"err": err.Error()}))
+	}
+	r.channel = nil
+}
+
+// close closes the channel, it must be called when the subscription is stopped.
+func (r *republisher) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.closeChannel()
+}
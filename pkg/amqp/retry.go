@@ -0,0 +1,176 @@
+package amqp
+
+import (
+	"strconv"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/streadway/amqp"
+)
+
+// RetryCountHeader is the header with the number of times the message was republished by ConsumeConfig.Retry.
+//
+// DefaultMarshaler copies it to the message metadata (as a string), so the handler can tell the attempt number.
+const RetryCountHeader = "x-retry-count"
+
+// RetryConfig configures republishing of nacked messages to the retry exchange (see ConsumeConfig.Retry).
+//
+// Nacked message is published to the Exchange with RetryCountHeader incremented and the original delivery is acked
+// after the broker confirmed the copy. The copy is published with the mandatory flag on a separate channel,
+// so when it's unroutable or not confirmed, the original delivery is requeued instead.
+// Unlike requeue, the message isn't redelivered in front of the queue, so it doesn't block other messages,
+// and the retry topology (for example a queue with TTL dead-lettering back to the original queue)
+// is up to the user.
+//
+// Message, which was already republished MaxRetries times, is rejected without requeue,
+// so it's dead-lettered when the queue has the dead letter exchange (see QueueConfig.DeadLetterExchange).
+type RetryConfig struct {
+	// MaxRetries is the maximum number of republishes of the message. Retry is enabled when it's greater than zero.
+	MaxRetries int
+
+	// Exchange to which nacked messages are published. When empty, the default exchange is used.
+	Exchange string
+
+	// GenerateRoutingKey generates the routing key of republished message based on the consumed queue name.
+	// When nil, the queue name is used, so with the default exchange the message is published
+	// to the back of the consumed queue.
+	GenerateRoutingKey func(queueName string) string
+
+	// PriorityBump is added to the Priority of the republished message, so it's retried sooner
+	// than messages with the original priority, which are waiting in the queue.
+	// Priority is capped at the "x-max-priority" argument of the queue (see QueueConfig.Arguments),
+	// which is required, when PriorityBump is set.
+	//
+	// It works only when the retried message is routed back to the priority queue.
+	PriorityBump uint8
+}
+
+func (r RetryConfig) enabled() bool {
+	return r.MaxRetries > 0
+}
+
+func (r RetryConfig) routingKey(queueName string) string {
+	if r.GenerateRoutingKey != nil {
+		return r.GenerateRoutingKey(queueName)
+	}
+
+	return queueName
+}
+
+// bumpedPriority returns priority increased by PriorityBump, capped at maxPriority.
+func (r RetryConfig) bumpedPriority(priority uint8, maxPriority uint8) uint8 {
+	bumped := int(priority) + int(r.PriorityBump)
+	if bumped > int(maxPriority) {
+		bumped = int(maxPriority)
+	}
+	if bumped < int(priority) {
+		// priority higher than the queue's max priority is not lowered
+		return priority
+	}
+
+	return uint8(bumped)
+}
+
+// queueMaxPriority returns the "x-max-priority" argument of the queue.
+func queueMaxPriority(arguments amqp.Table) (uint8, bool) {
+	var maxPriority int64
+	switch value := arguments["x-max-priority"].(type) {
+	case int8:
+		maxPriority = int64(value)
+	case int16:
+		maxPriority = int64(value)
+	case int32:
+		maxPriority = int64(value)
+	case int64:
+		maxPriority = value
+	case int:
+		maxPriority = int64(value)
+	case uint8:
+		maxPriority = int64(value)
+	default:
+		return 0, false
+	}
+	if maxPriority < 1 || maxPriority > 255 {
+		return 0, false
+	}
+
+	return uint8(maxPriority), true
+}
+
+// retryCount returns the value of RetryCountHeader. Missing or invalid value is treated as zero.
+//
+// Number is published by the subscriber, but it's accepted also as a string,
+// because it's copied to the metadata as a string and the handler may publish the message again.
+func retryCount(headers amqp.Table) int64 {
+	switch value := headers[RetryCountHeader].(type) {
+	case int8:
+		return int64(value)
+	case int16:
+		return int64(value)
+	case int32:
+		return int64(value)
+	case int64:
+		return value
+	case int:
+		return int64(value)
+	case uint8:
+		return int64(value)
+	case string:
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0
+		}
+		return count
+	default:
+		return 0
+	}
+}
+
+// retry publishes the copy of the message with incremented RetryCountHeader to Config.Consume.Retry.Exchange
+// and returns func acking the original delivery.
+// When Config.Consume.Retry.MaxRetries is exceeded, returned func rejects the delivery.
+//
+// The original delivery is acked only after the broker confirmed the copy. When the copy cannot be published,
+// is unroutable (for example because of wrong Exchange or GenerateRoutingKey), is nacked by the broker
+// or is not confirmed in Config.Consume.RepublishTimeout, the original delivery is nacked with requeue,
+// so the message is not lost.
+func (s *subscription) retry(amqpMsg amqp.Delivery) func() error {
+	retries := retryCount(amqpMsg.Headers)
+	if retries >= int64(s.config.Consume.Retry.MaxRetries) {
+		s.logger.Info("Message retries exceeded, rejecting", s.logFields.Add(watermill.LogFields{
+			"retries": retries,
+		}))
+		return func() error {
+			return s.config.Consume.nack(amqpMsg, false)
+		}
+	}
+
+	publishing := deliveryToPublishing(amqpMsg)
+
+	// headers are copied, so the delivery is not modified when nack is retried
+	publishing.Headers = make(amqp.Table, len(amqpMsg.Headers)+1)
+	for key, value := range amqpMsg.Headers {
+		publishing.Headers[key] = value
+	}
+	publishing.Headers[RetryCountHeader] = retries + 1
+
+	if s.config.Consume.Retry.PriorityBump > 0 {
+		if maxPriority, ok := queueMaxPriority(queueArguments(s.config)); ok {
+			publishing.Priority = s.config.Consume.Retry.bumpedPriority(amqpMsg.Priority, maxPriority)
+		}
+	}
+
+	if err := s.republisher.publish(
+		s.config.Consume.Retry.Exchange,
+		s.config.Consume.Retry.routingKey(s.queueName),
+		publishing,
+	); err != nil {
+		s.logger.Error("Cannot publish message to retry exchange, requeueing", err, s.logFields)
+		return func() error {
+			return s.config.Consume.nack(amqpMsg, true)
+		}
+	}
+
+	return func() error {
+		return amqpMsg.Ack(false)
+	}
+}
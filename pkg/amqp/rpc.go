@@ -0,0 +1,280 @@
+package amqp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// ReplyToMetadataKey is the metadata key mapped to the ReplyTo property by RPCMarshaler.
+	ReplyToMetadataKey = "_watermill_reply_to"
+	// CorrelationIDMetadataKey is the metadata key mapped to the CorrelationId property by RPCMarshaler.
+	CorrelationIDMetadataKey = "_watermill_correlation_id"
+)
+
+// defaultRPCTimeout is used by RPCClient.Call, when ctx has no deadline.
+const defaultRPCTimeout = 30 * time.Second
+
+// RPCMarshaler maps ReplyTo and CorrelationId properties to the ReplyToMetadataKey and CorrelationIDMetadataKey
+// metadata. Everything else is marshaled by the wrapped Marshaler.
+//
+// Metadata is still marshaled by the wrapped Marshaler (as headers in case of DefaultMarshaler),
+// so the RPC server doesn't need to use RPCMarshaler.
+type RPCMarshaler struct {
+	// Marshaler is the wrapped marshaler. When nil, DefaultMarshaler is used.
+	Marshaler Marshaler
+}
+
+func (m RPCMarshaler) marshaler() Marshaler {
+	if m.Marshaler == nil {
+		return DefaultMarshaler{}
+	}
+
+	return m.Marshaler
+}
+
+func (m RPCMarshaler) Marshal(msg *message.Message) (amqp.Publishing, error) {
+	publishing, err := m.marshaler().Marshal(msg)
+	if err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	if replyTo := msg.Metadata.Get(ReplyToMetadataKey); replyTo != "" {
+		publishing.ReplyTo = replyTo
+	}
+	if correlationID := msg.Metadata.Get(CorrelationIDMetadataKey); correlationID != "" {
+		publishing.CorrelationId = correlationID
+	}
+
+	return publishing, nil
+}
+
+func (m RPCMarshaler) Unmarshal(amqpMsg amqp.Delivery) (*message.Message, error) {
+	msg, err := m.marshaler().Unmarshal(amqpMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	if amqpMsg.ReplyTo != "" {
+		msg.Metadata.Set(ReplyToMetadataKey, amqpMsg.ReplyTo)
+	}
+	if amqpMsg.CorrelationId != "" {
+		msg.Metadata.Set(CorrelationIDMetadataKey, amqpMsg.CorrelationId)
+	}
+
+	return msg, nil
+}
+
+// NewRPCReply creates the reply for the request received from RPCClient.
+//
+// Reply should be published to the queue from request's ReplyToMetadataKey metadata via the default exchange,
+// for example with Publisher created with NewNonDurableQueueConfig.
+func NewRPCReply(request *message.Message, uuid string, payload message.Payload) *message.Message {
+	reply := message.NewMessage(uuid, payload)
+	reply.Metadata.Set(CorrelationIDMetadataKey, request.Metadata.Get(CorrelationIDMetadataKey))
+
+	return reply
+}
+
+// RPCClient publishes requests and waits for the correlated replies.
+//
+// Replies are consumed from the server named queue (see QueueConfig.ServerNamed), which exists as long as
+// the connection. Queue name is sent in the ReplyTo property of the request, correlation ID in the CorrelationId
+// property. After reconnect, a new reply queue is declared, so replies for requests sent before are lost
+// and Call returns error after timeout.
+type RPCClient struct {
+	publisher    *Publisher
+	subscriber   *Subscriber
+	subscription *Subscription
+
+	logger watermill.LoggerAdapter
+
+	pending     map[string]chan *message.Message
+	pendingLock sync.Mutex
+}
+
+// wrapRPCMarshaler wraps marshaler with RPCMarshaler, unless it's nil or already wrapped.
+func wrapRPCMarshaler(marshaler Marshaler) Marshaler {
+	if _, ok := marshaler.(RPCMarshaler); marshaler == nil || ok {
+		return marshaler
+	}
+
+	return RPCMarshaler{Marshaler: marshaler}
+}
+
+// NewRPCClient creates RPCClient. Requests are published according to the config,
+// the reply queue is declared according to the config's connection and Consume.Qos.
+func NewRPCClient(config Config, logger watermill.LoggerAdapter) (*RPCClient, error) {
+	if logger == nil {
+		logger = watermill.NopLogger{}
+	}
+
+	if _, ok := config.Marshaler.(RPCMarshaler); !ok {
+		config.Marshaler = RPCMarshaler{Marshaler: config.Marshaler}
+	}
+	config.PublishMarshaler = wrapRPCMarshaler(config.PublishMarshaler)
+	config.ConsumeMarshaler = wrapRPCMarshaler(config.ConsumeMarshaler)
+	if marshalerFunc := config.MarshalerFunc; marshalerFunc != nil {
+		config.MarshalerFunc = func(topic string) Marshaler {
+			return wrapRPCMarshaler(marshalerFunc(topic))
+		}
+	}
+
+	publisher, err := NewPublisher(config, logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create publisher")
+	}
+
+	subscriber, err := NewSubscriber(rpcReplyConfig(config), logger)
+	if err != nil {
+		if closeErr := publisher.Close(); closeErr != nil {
+			logger.Error("Cannot close publisher", closeErr, nil)
+		}
+		return nil, errors.Wrap(err, "cannot create subscriber")
+	}
+
+	replies, subscription, err := subscriber.SubscribeWithHandle(context.Background(), "rpc_replies")
+	if err != nil {
+		if closeErr := publisher.Close(); closeErr != nil {
+			logger.Error("Cannot close publisher", closeErr, nil)
+		}
+		if closeErr := subscriber.Close(); closeErr != nil {
+			logger.Error("Cannot close subscriber", closeErr, nil)
+		}
+		return nil, errors.Wrap(err, "cannot subscribe for replies")
+	}
+
+	client := &RPCClient{
+		publisher:    publisher,
+		subscriber:   subscriber,
+		subscription: subscription,
+		logger:       logger,
+		pending:      map[string]chan *message.Message{},
+	}
+	go client.handleReplies(replies)
+
+	return client, nil
+}
+
+// rpcReplyConfig returns config of the subscriber consuming replies from the server named queue.
+func rpcReplyConfig(config Config) Config {
+	config.Exchange.GenerateName = func(topic string) string {
+		return ""
+	}
+	config.Queue = QueueConfig{
+		GenerateName: GenerateQueueNameConstant(""),
+		ServerNamed:  true,
+	}
+	config.Consume.Requeue = RequeueConfig{}
+
+	return config
+}
+
+// Call publishes the request to the topic and waits for the reply with the same correlation ID.
+//
+// When the request has no CorrelationIDMetadataKey metadata, request's UUID is used as correlation ID.
+// Call waits until ctx is done. When ctx has no deadline, 30 seconds timeout is used.
+func (c *RPCClient) Call(ctx context.Context, topic string, request *message.Message) (*message.Message, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultRPCTimeout)
+		defer cancel()
+	}
+
+	replyTo := c.subscription.QueueName()
+	if replyTo == "" {
+		return nil, errors.New("reply queue is not declared")
+	}
+
+	correlationID := request.Metadata.Get(CorrelationIDMetadataKey)
+	if correlationID == "" {
+		correlationID = request.UUID
+		request.Metadata.Set(CorrelationIDMetadataKey, correlationID)
+	}
+	request.Metadata.Set(ReplyToMetadataKey, replyTo)
+
+	replies, err := c.addPending(correlationID)
+	if err != nil {
+		return nil, err
+	}
+	defer c.removePending(correlationID)
+
+	if err := c.publisher.PublishWithContext(ctx, topic, request); err != nil {
+		return nil, errors.Wrap(err, "cannot publish request")
+	}
+
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "no reply for request with correlation ID %s", correlationID)
+	case <-c.subscription.Done():
+		return nil, errors.New("RPC client is closed")
+	}
+}
+
+func (c *RPCClient) addPending(correlationID string) (chan *message.Message, error) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	if _, ok := c.pending[correlationID]; ok {
+		return nil, errors.Errorf("request with correlation ID %s is already pending", correlationID)
+	}
+
+	// buffered, so handleReplies is never blocked by the caller
+	replies := make(chan *message.Message, 1)
+	c.pending[correlationID] = replies
+
+	return replies, nil
+}
+
+func (c *RPCClient) removePending(correlationID string) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	delete(c.pending, correlationID)
+}
+
+func (c *RPCClient) handleReplies(replies <-chan *message.Message) {
+	for reply := range replies {
+		correlationID := reply.Metadata.Get(CorrelationIDMetadataKey)
+		logFields := watermill.LogFields{"message_uuid": reply.UUID, "correlation_id": correlationID}
+
+		c.pendingLock.Lock()
+		pending, ok := c.pending[correlationID]
+		if ok {
+			// reply is delivered only once, duplicates are dropped
+			delete(c.pending, correlationID)
+		}
+		c.pendingLock.Unlock()
+
+		if ok {
+			pending <- reply
+		} else {
+			c.logger.Info("Received reply for unknown or timed out request, dropping", logFields)
+		}
+
+		reply.Ack()
+	}
+}
+
+// Close closes the RPCClient. Pending calls return an error.
+func (c *RPCClient) Close() error {
+	var err error
+
+	if closeErr := c.subscriber.Close(); closeErr != nil {
+		err = multierror.Append(err, errors.Wrap(closeErr, "cannot close subscriber"))
+	}
+	if closeErr := c.publisher.Close(); closeErr != nil {
+		err = multierror.Append(err, errors.Wrap(closeErr, "cannot close publisher"))
+	}
+
+	return err
+}
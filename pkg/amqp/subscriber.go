@@ -2,7 +2,9 @@ package amqp
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
@@ -17,6 +19,12 @@ type Subscriber struct {
 	*connectionWrapper
 
 	config Config
+
+	// runningSubscriptions is the number of running subscriptions, it's accessed atomically
+	runningSubscriptions int32
+
+	consumers *consumerRegistry
+	counters  *subscriberCounters
 }
 
 func NewSubscriber(config Config, logger watermill.LoggerAdapter) (*Subscriber, error) {
@@ -29,7 +37,40 @@ func NewSubscriber(config Config, logger watermill.LoggerAdapter) (*Subscriber,
 		return nil, err
 	}
 
-	return &Subscriber{conn, config}, nil
+	return &Subscriber{
+		connectionWrapper: conn,
+		config:            config,
+		consumers:         newConsumerRegistry(),
+		counters:          &subscriberCounters{},
+	}, nil
+}
+
+// NewSubscriberWithConnection creates Subscriber, which uses the existing connection instead of dialing its own.
+// It allows to share the connection with other AMQP clients of the application.
+//
+// The connection is owned by the caller: it's not closed by Close and it's not reconnected when it's closed,
+// subscriptions are waiting for the connection until the Subscriber is closed.
+// Close stops all subscriptions and closes their channels. Config.Connection is ignored.
+func NewSubscriberWithConnection(
+	connection *amqp.Connection,
+	config Config,
+	logger watermill.LoggerAdapter,
+) (*Subscriber, error) {
+	if err := config.validateSubscriber(); err != nil {
+		return nil, err
+	}
+
+	conn, err := newExistingConnection(connection, config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Subscriber{
+		connectionWrapper: conn,
+		config:            config,
+		consumers:         newConsumerRegistry(),
+		counters:          &subscriberCounters{},
+	}, nil
 }
 
 // Subscribe consumes messages from AMQP broker.
@@ -37,47 +78,361 @@ func NewSubscriber(config Config, logger watermill.LoggerAdapter) (*Subscriber,
 // Watermill's topic in Subscribe is not mapped to AMQP's topic, but depending on configuration it can be mapped
 // to exchange, queue or routing key.
 // For detailed description of nomenclature mapping, please check "Nomenclature" paragraph in doc.go file.
+//
+// When Config.Queue.GenerateNames is set, messages are consumed from all queues generated for the topic
+// into one channel, like with SubscribeMulti.
 func (s *Subscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	if s.config.Queue.GenerateNames == nil {
+		out, _, err := s.SubscribeWithHandle(ctx, topic)
+		return out, err
+	}
+
+	if err := s.checkSubscribe(); err != nil {
+		return nil, err
+	}
+
+	targets, err := s.prepareTargets(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.startSubscriptions(ctx, targets), nil
+}
+
+// SubscribeWithHandle works like Subscribe, but additionally returns Subscription handle,
+// which allows to stop consuming of the topic without closing the Subscriber.
+//
+// It's not supported with Config.Queue.GenerateNames, because the topic is consumed by multiple subscriptions.
+func (s *Subscriber) SubscribeWithHandle(ctx context.Context, topic string) (<-chan *message.Message, *Subscription, error) {
+	if err := s.checkSubscribe(); err != nil {
+		return nil, nil, err
+	}
+	if s.config.Queue.GenerateNames != nil {
+		return nil, nil, errors.New("SubscribeWithHandle is not supported with Config.Queue.GenerateNames")
+	}
+
+	target, err := s.prepareTarget(topic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := make(chan *message.Message, 0)
+
+	handle := s.startSubscription(ctx, target, out, func() {
+		close(out)
+	})
+
+	return out, handle, nil
+}
+
+// SubscribeWithErrors works like SubscribeWithHandle, but instead of the handle it returns the channel
+// with the terminal error of the subscription (see Subscription.Err).
+//
+// The error is sent when the subscription is stopped because of the error, for example when ReconnectConfig.MaxAttempts
+// were exceeded. Error channel is closed after the output channel is closed.
+func (s *Subscriber) SubscribeWithErrors(ctx context.Context, topic string) (<-chan *message.Message, <-chan error, error) {
+	out, handle, err := s.SubscribeWithHandle(ctx, topic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+
+		<-handle.Done()
+		if err := handle.Err(); err != nil {
+			errs <- err
+		}
+	}()
+
+	return out, errs, nil
+}
+
+// SubscribeMulti consumes messages from multiple topics into one channel.
+//
+// Each topic is consumed by a separate consumer with its own AMQP channel, so acks and nacks of messages
+// are sent to the channel from which message was delivered.
+// Consumers are waiting to send message to the output channel in FIFO order, so topics are dispatched fairly.
+// When Config.Queue.GenerateNames is set, every queue generated for the topics is consumed.
+//
+// Output channel is closed when all topics are stopped consuming.
+func (s *Subscriber) SubscribeMulti(ctx context.Context, topics ...string) (<-chan *message.Message, error) {
+	if err := s.checkSubscribe(); err != nil {
+		return nil, err
+	}
+	if len(topics) == 0 {
+		return nil, errors.New("no topics provided")
+	}
+
+	targets := make([]consumeTarget, 0, len(topics))
+	for _, topic := range topics {
+		topicTargets, err := s.prepareTargets(topic)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, topicTargets...)
+	}
+
+	return s.startSubscriptions(ctx, targets), nil
+}
+
+// startSubscriptions starts consuming of all targets into one channel,
+// which is closed when all subscriptions are stopped.
+func (s *Subscriber) startSubscriptions(ctx context.Context, targets []consumeTarget) <-chan *message.Message {
+	out := make(chan *message.Message, 0)
+
+	running := int32(len(targets))
+	for _, target := range targets {
+		s.startSubscription(ctx, target, out, func() {
+			if atomic.AddInt32(&running, -1) == 0 {
+				close(out)
+			}
+		})
+	}
+
+	return out
+}
+
+// SubscribeQueue consumes messages from the existing queue with the literal queueName.
+// Config.Queue.GenerateName is not used and no topology (queue, exchange or bindings) is declared,
+// so the queue must be declared before, for example by another service.
+//
+// Qos, consume options and ack semantics are the same as for Subscribe.
+// queueName is used as the topic for functions receiving topic (like Config.MarshalerFunc).
+// Delayed requeue (Config.Consume.Requeue) is not supported, because the delay queue is not declared.
+func (s *Subscriber) SubscribeQueue(ctx context.Context, queueName string) (<-chan *message.Message, error) {
+	if err := s.checkSubscribe(); err != nil {
+		return nil, err
+	}
+
+	if queueName == "" {
+		return nil, errors.New("queue name cannot be empty")
+	}
+	if err := validateName(queueName); err != nil {
+		return nil, errors.Wrapf(err, "invalid queue name %q", queueName)
+	}
+	if s.config.Consume.Requeue.enabled() && !s.config.Consume.NoRequeueOnNack {
+		return nil, errors.New("Config.Consume.Requeue is not supported when consuming from the existing queue")
+	}
+
+	target := consumeTarget{
+		topic:         queueName,
+		queueName:     queueName,
+		existingQueue: true,
+	}
+
+	out := make(chan *message.Message, 0)
+
+	s.startSubscription(ctx, target, out, func() {
+		close(out)
+	})
+
+	return out, nil
+}
+
+func (s *Subscriber) checkSubscribe() error {
 	if s.closed {
-		return nil, errors.New("pub/sub is closed")
+		return errors.New("pub/sub is closed")
 	}
 
 	if !s.IsConnected() {
-		return nil, errors.New("not connected to AMQP")
+		return errors.New("not connected to AMQP")
 	}
 
-	logFields := watermill.LogFields{"topic": topic}
+	return nil
+}
 
-	out := make(chan *message.Message, 0)
+// consumeTarget describes the queue consumed by the single subscription.
+type consumeTarget struct {
+	topic        string
+	queueName    string
+	exchangeName string
+
+	// serverNamedQueue is true when queue name is generated by the broker
+	serverNamedQueue bool
+
+	// existingQueue is true when the queue is consumed without declaring the topology (see SubscribeQueue)
+	existingQueue bool
+}
 
-	queueName := s.config.Queue.GenerateName(topic)
-	logFields["amqp_queue_name"] = queueName
+func (t consumeTarget) logFields() watermill.LogFields {
+	return watermill.LogFields{
+		"topic":              t.topic,
+		"amqp_queue_name":    t.queueName,
+		"amqp_exchange_name": t.exchangeName,
+	}
+}
 
-	exchangeName := s.config.Exchange.GenerateName(topic)
-	logFields["amqp_exchange_name"] = exchangeName
+// prepareTarget generates names for the topic and declares the topology.
+func (s *Subscriber) prepareTarget(topic string) (consumeTarget, error) {
+	if err := s.config.ValidateTopic(topic); err != nil {
+		return consumeTarget{}, errors.Wrapf(err, "invalid topic %s", topic)
+	}
 
-	if err := s.prepareConsume(queueName, exchangeName, logFields); err != nil {
-		return nil, errors.Wrap(err, "failed to prepare consume")
+	return s.prepareQueueTarget(topic, s.config.Queue.GenerateName(topic))
+}
+
+// prepareTargets prepares targets of all queues generated for the topic by Config.Queue.GenerateNames.
+// When GenerateNames is nil, the single target generated by Config.Queue.GenerateName is prepared.
+func (s *Subscriber) prepareTargets(topic string) ([]consumeTarget, error) {
+	if s.config.Queue.GenerateNames == nil {
+		target, err := s.prepareTarget(topic)
+		if err != nil {
+			return nil, err
+		}
+		return []consumeTarget{target}, nil
+	}
+
+	if err := s.config.ValidateTopic(topic); err != nil {
+		return nil, errors.Wrapf(err, "invalid topic %s", topic)
+	}
+
+	queueNames := s.config.Queue.GenerateNames(topic)
+	if len(queueNames) == 0 {
+		return nil, errors.Errorf("no queue names generated for topic %s", topic)
+	}
+
+	targets := make([]consumeTarget, 0, len(queueNames))
+	for _, queueName := range queueNames {
+		if queueName == "" {
+			return nil, errors.New("empty queue name generated, server named queues are not supported with GenerateNames")
+		}
+		if err := validateName(queueName); err != nil {
+			return nil, errors.Wrapf(err, "invalid queue name %q", queueName)
+		}
+
+		target, err := s.prepareQueueTarget(topic, queueName)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+// prepareQueueTarget declares the topology of the queue consuming the topic.
+func (s *Subscriber) prepareQueueTarget(topic string, queueName string) (consumeTarget, error) {
+	target := consumeTarget{
+		topic:        topic,
+		queueName:    queueName,
+		exchangeName: s.config.Exchange.GenerateName(topic),
+	}
+	target.serverNamedQueue = s.config.Queue.serverNamed(target.queueName)
+
+	if err := s.prepareConsume(&target); err != nil {
+		return consumeTarget{}, errors.Wrap(err, "failed to prepare consume")
+	}
+
+	return target, nil
+}
+
+// startSubscription starts consuming the target into out in the background.
+// onStopped is called when consuming is stopped, before the subscription is marked as done.
+func (s *Subscriber) startSubscription(
+	ctx context.Context,
+	target consumeTarget,
+	out chan *message.Message,
+	onStopped func(),
+) *Subscription {
+	handle := newSubscription(target.topic, s.closing)
+	handle.setQueueName(target.queueName)
+	handle.consumerTag = s.config.Consume.Consumer
+	if handle.consumerTag == "" {
+		// generated by the Subscriber instead of the library, so it's known before consuming
+		handle.consumerTag = "watermill-" + watermill.NewShortUUID()
+	}
+
+	running := atomic.AddInt32(&s.runningSubscriptions, 1)
+	if s.config.Consume.Qos.Global && running > 1 {
+		s.logger.Info(
+			"Config.Consume.Qos.Global is set with multiple subscriptions, prefetch limit is applied "+
+				"to every subscription separately, not to the whole connection",
+			target.logFields().Add(watermill.LogFields{"running_subscriptions": running}),
+		)
 	}
 
 	s.subscribingWg.Add(1)
 	go func(ctx context.Context) {
 		defer func() {
-			close(out)
-			s.logger.Info("Stopped consuming from AMQP channel", logFields)
+			atomic.AddInt32(&s.runningSubscriptions, -1)
+			handle.setState(SubscriptionStopped)
+			onStopped()
+			close(handle.done)
+			s.logger.Info("Stopped consuming from AMQP channel", target.logFields())
 			s.subscribingWg.Done()
 		}()
 
+		reconnectConfig := s.config.Connection.reconnectConfig()
+		retryBackoff := reconnectConfig.backoffConfig()
+		retryBackoff.Reset()
+		failedAttempts := 0
+
+		// topology was already declared by prepareConsume, it must be declared again
+		// after every reconnect, because it may be lost during the outage (for example non durable queues)
+		declareTopology := false
+
 	ReconnectLoop:
 		for {
+			// queue name may change after reconnect, when server named queue is used
+			logFields := target.logFields()
 			s.logger.Debug("Waiting for s.connected or s.closing in ReconnectLoop", logFields)
 
 			select {
 			case <-s.connected:
 				s.logger.Debug("Connection established in ReconnectLoop", logFields)
 				// runSubscriber blocks until connection fails or Close() is called
-				s.runSubscriber(ctx, out, queueName, exchangeName, logFields)
-			case <-s.closing:
+				err := s.runSubscriber(ctx, handle, out, &target, declareTopology)
+				declareTopology = !target.existingQueue
+
+				if errors.Cause(err) == errConsumerCancelled {
+					break ReconnectLoop
+				}
+				if IsTopologyMismatchError(err) {
+					s.logger.Error("Topology mismatch, retrying is pointless, stopping subscription", err, logFields)
+					handle.setErr(err)
+					break ReconnectLoop
+				}
+				if err != nil {
+					failedAttempts++
+					if reconnectConfig.attemptsExhausted(failedAttempts) {
+						err = errors.Wrapf(ErrReconnectAttemptsExhausted, "after %d attempts: %s", failedAttempts, err)
+						s.logger.Error("Subscriber failed, stopping subscription", err, logFields)
+						handle.setErr(err)
+						break ReconnectLoop
+					}
+				}
+				// runSubscriber returns also after Close, Cancel or ctx done, it's not a reconnect
+				select {
+				case <-handle.stopping:
+					break ReconnectLoop
+				case <-s.closing:
+					break ReconnectLoop
+				case <-ctx.Done():
+					break ReconnectLoop
+				default:
+				}
+				handle.setState(SubscriptionReconnecting)
+				s.counters.addReconnect()
+				if err != nil {
+					retryIn := retryBackoff.NextBackOff()
+					s.logger.Error("Subscriber failed, retrying", err, logFields.Add(watermill.LogFields{
+						"retry_in": retryIn,
+					}))
+					if !sleepUntilStopped(ctx, handle.stopping, retryIn) {
+						break ReconnectLoop
+					}
+					continue ReconnectLoop
+				}
+				retryBackoff.Reset()
+				failedAttempts = 0
+			case <-s.reconnectExhausted:
+				err := errors.Wrap(s.LastError(), "connection is not reconnected anymore")
+				s.logger.Error("Stopping ReconnectLoop", err, logFields)
+				handle.setErr(err)
+				break ReconnectLoop
+			case <-handle.stopping:
 				s.logger.Debug("Stopping ReconnectLoop (closing)", logFields)
 				break ReconnectLoop
 			case <-ctx.Done():
@@ -85,107 +440,259 @@ func (s *Subscriber) Subscribe(ctx context.Context, topic string) (<-chan *messa
 				break ReconnectLoop
 			}
 
-			time.Sleep(time.Millisecond * 100)
+			if !sleepUntilStopped(ctx, handle.stopping, time.Millisecond*100) {
+				break ReconnectLoop
+			}
 		}
 	}(ctx)
 
-	return out, nil
+	return handle
 }
 
-func (s *Subscriber) SubscribeInitialize(topic string) (err error) {
-	if s.closed {
-		return errors.New("pub/sub is closed")
+// sleepUntilStopped sleeps for duration d, but returns earlier when stopping is closed or ctx is done.
+// It returns false when sleep was interrupted.
+func sleepUntilStopped(ctx context.Context, stopping <-chan struct{}, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-stopping:
+		return false
+	case <-ctx.Done():
+		return false
 	}
+}
 
-	if !s.IsConnected() {
-		return errors.New("not connected to AMQP")
+func (s *Subscriber) SubscribeInitialize(topic string) (err error) {
+	_, err = s.SubscribeInitializeInfo(topic)
+	return err
+}
+
+// TopologyInfo describes the topology declared for the topic.
+type TopologyInfo struct {
+	Topic string
+
+	// QueueName is the name of the declared queue.
+	// For server named queues, it's the name generated by the broker.
+	// When Config.Queue.GenerateNames is used, it's the first of QueueNames.
+	QueueName string
+
+	// QueueNames are names of all declared queues, they differ from QueueName only
+	// when Config.Queue.GenerateNames is used.
+	QueueNames []string
+
+	// ExchangeName is the name of the declared exchange, it's empty when the default exchange is used.
+	ExchangeName string
+
+	// BindingKeys are routing keys of the queue bindings to the exchange.
+	BindingKeys []string
+
+	// DelayQueueName is the name of the delay queue (see ConsumeConfig.Requeue),
+	// it's empty when delayed requeue is disabled.
+	DelayQueueName string
+}
+
+// SubscribeInitializeInfo declares the topology for the topic like SubscribeInitialize
+// and returns names of the declared queue, exchange and bindings (after name generation).
+func (s *Subscriber) SubscribeInitializeInfo(topic string) (TopologyInfo, error) {
+	if err := s.checkSubscribe(); err != nil {
+		return TopologyInfo{}, err
 	}
 
-	logFields := watermill.LogFields{"topic": topic}
+	s.logger.Info("Initializing subscribe", watermill.LogFields{"topic": topic})
 
-	queueName := s.config.Queue.GenerateName(topic)
-	logFields["amqp_queue_name"] = queueName
+	targets, err := s.prepareTargets(topic)
+	if err != nil {
+		return TopologyInfo{}, err
+	}
+	target := targets[0]
 
-	exchangeName := s.config.Exchange.GenerateName(topic)
-	logFields["amqp_exchange_name"] = exchangeName
+	info := TopologyInfo{
+		Topic:        topic,
+		QueueName:    target.queueName,
+		ExchangeName: target.exchangeName,
+	}
+	for _, target := range targets {
+		info.QueueNames = append(info.QueueNames, target.queueName)
+	}
+	if target.exchangeName != "" {
+		info.BindingKeys = []string{s.config.topicRoutingKeyConfig(topic).QueueBind.GenerateRoutingKey(target.queueName)}
+	}
+	if s.config.Consume.Requeue.enabled() && !s.config.Consume.NoRequeueOnNack {
+		info.DelayQueueName = s.config.Consume.Requeue.delayQueueName(target.queueName)
+	}
 
-	s.logger.Info("Initializing subscribe", logFields)
+	s.logger.Info("Subscribe initialized", target.logFields().Add(watermill.LogFields{
+		"amqp_binding_keys": info.BindingKeys,
+	}))
 
-	return errors.Wrap(s.prepareConsume(queueName, exchangeName, logFields), "failed to prepare consume")
+	return info, nil
 }
 
-func (s *Subscriber) prepareConsume(queueName string, exchangeName string, logFields watermill.LogFields) (err error) {
-	channel, err := s.openSubscribeChannel(logFields)
+// prepareConsume declares the topology of the target.
+// When server named queue is used, target.queueName is set to the name generated by the broker.
+func (s *Subscriber) prepareConsume(target *consumeTarget) (err error) {
+	channel, err := s.openSubscribeChannel(target.logFields())
 	if err != nil {
 		return err
 	}
+	// errors of declarations without waiting are received only as the channel close sent by the broker,
+	// it must be registered before declaring, because channel.Close returns just amqp.ErrClosed,
+	// when the broker closed the channel first
+	notifyCloseChannel := channel.NotifyClose(make(chan *amqp.Error, 1))
 	defer func() {
-		if channelCloseErr := channel.Close(); channelCloseErr != nil {
+		channelCloseErr := s.closeChannel(channel)
+
+		// notifyCloseChannel is always closed after channel.Close()
+		if amqpErr, ok := <-notifyCloseChannel; ok && amqpErr != nil && s.config.TopologyNoWait() {
+			err = multierror.Append(err, newTopologyMismatchError(
+				target.topic,
+				errors.Wrap(amqpErr, "cannot declare topology without waiting"),
+			))
+			return
+		}
+
+		if channelCloseErr != nil {
 			err = multierror.Append(err, channelCloseErr)
 		}
 	}()
 
-	if err = s.config.TopologyBuilder.BuildTopology(channel, queueName, exchangeName, s.config, s.logger); err != nil {
-		return err
+	return s.declareTopology(channel, target)
+}
+
+// declareTopology declares the topology of the target on the channel.
+// When server named queue is used, target.queueName is set to the name generated by the broker.
+func (s *Subscriber) declareTopology(channel AMQPChannel, target *consumeTarget) error {
+	config := s.config.topicRoutingKeyConfig(target.topic)
+
+	if config.Queue.serverNamed(target.queueName) {
+		config = config.serverNamedQueueConfig()
+
+		queue, err := channel.QueueDeclare(
+			"",
+			config.Queue.Durable,
+			config.Queue.AutoDelete,
+			config.Queue.Exclusive,
+			false, // noWait must be false to receive the generated name
+			queueArguments(config),
+		)
+		if err != nil {
+			return newTopologyMismatchError(target.topic, errors.Wrap(err, "cannot declare server named queue"))
+		}
+
+		target.queueName = queue.Name
+		s.logger.Debug("Server named queue declared", target.logFields())
+	}
+
+	if err := s.config.TopologyBuilder.BuildTopology(channel, target.queueName, target.exchangeName, config, s.logger); err != nil {
+		return newTopologyMismatchError(target.topic, err)
 	}
 
-	s.logger.Debug("Queue bound to exchange", logFields)
+	s.logger.Debug("Queue bound to exchange", target.logFields())
 
 	return nil
 }
 
+// runSubscriber consumes messages until channel is closed, ctx is done, subscription is cancelled or Close() is called.
+// Error is returned when consuming cannot be started or when the consumer is cancelled.
 func (s *Subscriber) runSubscriber(
 	ctx context.Context,
+	handle *Subscription,
 	out chan *message.Message,
-	queueName string,
-	exchangeName string,
-	logFields watermill.LogFields,
-) {
-	channel, err := s.openSubscribeChannel(logFields)
+	target *consumeTarget,
+	declareTopology bool,
+) error {
+	reuseChannel := declareTopology && s.config.Consume.ReuseTopologyChannel
+	if declareTopology && target.serverNamedQueue {
+		// server named queue is deleted with the connection, so a new one is declared
+		target.queueName = ""
+	}
+	if declareTopology && !reuseChannel {
+		if err := s.prepareConsume(target); err != nil {
+			return errors.Wrap(err, "failed to prepare consume")
+		}
+		handle.setQueueName(target.queueName)
+	}
+
+	channel, err := s.openSubscribeChannel(target.logFields())
 	if err != nil {
-		s.logger.Error("Failed to open channel", err, logFields)
-		return
+		return errors.Wrap(err, "failed to open channel")
 	}
 	defer func() {
-		err := channel.Close()
-		s.logger.Error("Failed to close channel", err, logFields)
+		if err := s.closeChannel(channel); err != nil {
+			s.logger.Error("Failed to close channel", err, target.logFields())
+		}
 	}()
 
+	if reuseChannel {
+		// failed declaration closes the channel, it's closed by the deferred func and a new one is opened on retry
+		if err := s.declareTopology(channel, target); err != nil {
+			return errors.Wrap(err, "failed to prepare consume")
+		}
+		handle.setQueueName(target.queueName)
+	}
+
+	logFields := target.logFields()
+
 	notifyCloseChannel := channel.NotifyClose(make(chan *amqp.Error))
 
+	republisher := newRepublisher(s.connectionWrapper, s.config.Consume.republishTimeout(), handle.stopping, logFields)
+	defer republisher.close()
+
 	sub := subscription{
 		out:                out,
 		logFields:          logFields,
 		notifyCloseChannel: notifyCloseChannel,
 		channel:            channel,
-		queueName:          queueName,
+		topic:              target.topic,
+		queueName:          target.queueName,
+		consumerTag:        handle.consumerTag,
+		handle:             handle,
+		consumers:          s.consumers,
+		counters:           s.counters,
+		republisher:        republisher,
 		logger:             s.logger,
-		closing:            s.closing,
+		closing:            handle.stopping,
 		config:             s.config,
 	}
 
 	s.logger.Info("Starting consuming from AMQP channel", logFields)
 
-	sub.ProcessMessages(ctx)
+	return sub.ProcessMessages(ctx)
 }
 
-func (s *Subscriber) openSubscribeChannel(logFields watermill.LogFields) (*amqp.Channel, error) {
+func (s *Subscriber) openSubscribeChannel(logFields watermill.LogFields) (AMQPChannel, error) {
 	if !s.IsConnected() {
 		return nil, errors.New("not connected to AMQP")
 	}
 
-	channel, err := s.amqpConnection.Channel()
+	channel, err := s.openChannel()
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot open channel")
 	}
 	s.logger.Debug("Channel opened", logFields)
 
 	if s.config.Consume.Qos != (QosConfig{}) {
-		err = channel.Qos(
-			s.config.Consume.Qos.PrefetchCount,
-			s.config.Consume.Qos.PrefetchSize,
+		prefetchSize, supported := s.config.Consume.Qos.prefetchSize(s.amqpConnection.ServerProperties())
+		if !supported {
+			s.logger.Info(
+				"Config.Consume.Qos.PrefetchSize is not supported by RabbitMQ, it's not applied",
+				logFields.Add(watermill.LogFields{"prefetch_size": s.config.Consume.Qos.PrefetchSize}),
+			)
+		}
+
+		if err := channel.Qos(
+			s.config.Consume.Qos.prefetchCount(),
+			prefetchSize,
 			s.config.Consume.Qos.Global,
-		)
+		); err != nil {
+			if closeErr := s.closeChannel(channel); closeErr != nil {
+				err = multierror.Append(err, closeErr)
+			}
+			return nil, errors.Wrap(err, "cannot set Qos")
+		}
 		s.logger.Debug("Qos set", logFields)
 	}
 
@@ -196,12 +703,27 @@ type subscription struct {
 	out                chan *message.Message
 	logFields          watermill.LogFields
 	notifyCloseChannel chan *amqp.Error
-	channel            *amqp.Channel
+	channel            AMQPChannel
+	topic              string
 	queueName          string
-
-	logger  watermill.LoggerAdapter
-	closing chan struct{}
+	consumerTag        string
+	handle             *Subscription
+	consumers          *consumerRegistry
+	counters           *subscriberCounters
+	// republisher publishes copies of nacked messages with Config.Consume.Retry and Config.Consume.Requeue
+	republisher *republisher
+
+	logger watermill.LoggerAdapter
+	// closing is closed when Subscriber is closing or the subscription is cancelled
+	closing <-chan struct{}
 	config  Config
+
+	// batcher batches acks of the deliveries (see Config.Consume.AckBatch), it's nil when acks are not batched
+	batcher *ackBatcher
+
+	// filteredMessages is the number of messages acked without processing because of Config.Consume.Filter,
+	// it's accessed only from the ConsumingLoop
+	filteredMessages int
 }
 
 // undelivered represents message that wasn't processed
@@ -212,12 +734,15 @@ type undelivered struct {
 	error
 }
 
-func (s *subscription) ProcessMessages(ctx context.Context) {
+func (s *subscription) ProcessMessages(ctx context.Context) error {
 	amqpMsgs, err := s.createConsumer(s.queueName, s.channel)
 	if err != nil {
-		s.logger.Error("Failed to start consuming messages", err, s.logFields)
-		return
+		return errors.Wrap(err, "failed to start consuming messages")
 	}
+	s.handle.setState(SubscriptionConsuming)
+
+	consumer, unregisterConsumer := s.consumers.register(s.consumerTag, s.channel)
+	defer unregisterConsumer()
 
 	// unproc collects unprocessed deliveries
 	unproc := make(chan undelivered, cap(amqpMsgs)+1) // +1 for close attempt on full buffer
@@ -229,68 +754,343 @@ func (s *subscription) ProcessMessages(ctx context.Context) {
 	// any undelivered message will be Nack`ed
 	// regardless to its error value.
 	go func() {
-		for del := range unproc {
-			if del.error != nil {
-				s.logger.Error("Processing message failed, sending nack", del.error, s.logFields)
-			} else {
-				s.logger.Info("Message wasn't processed, sending nack", s.logFields)
-			}
-
-			if err := s.nackMsg(del.Delivery); err != nil {
-				s.logger.Error("Cannot nack message", err, s.logFields)
-
-				// something went really wrong when we cannot nack, let's reconnect
-				errbreak <- err
-				break
-			}
-		}
+		s.nackUndelivered(unproc, errbreak)
 		close(done)
 	}()
 
 	// wip waits till all processing messages aren't handled
-	var wip sync.WaitGroup
+	wip := &inFlightMessages{}
+
+	if s.config.Consume.AckBatch.enabled() {
+		s.batcher = newAckBatcher(s.config.Consume.AckBatch, s.channel, func(err error) {
+			s.logger.Error("Cannot flush acks batch", err, s.logFields)
+			select {
+			case errbreak <- err:
+			default:
+			}
+		})
+	}
+
+	// liveness is nil (blocks forever), when liveness logging is disabled
+	var liveness <-chan time.Time
+	if s.config.Consume.LivenessInterval > 0 {
+		livenessTicker := time.NewTicker(s.config.Consume.LivenessInterval)
+		defer livenessTicker.Stop()
+		liveness = livenessTicker.C
+	}
+	receivedSinceLastTick := 0
+
+	// deliveries is nil (blocks forever), when the broker paused the channel with channel.flow
+	// or when the subscription is paused with Subscription.Pause
+	flowActive := true
+	flowChanged := s.watchFlow()
+	paused, pauseChanged := s.handle.pauseState()
+	deliveries := activeDeliveries(amqpMsgs, flowActive, paused)
+
+	var stopErr error
+	// cancelConsumer is true when consuming is stopped by the Subscriber, while the consumer is still active
+	cancelConsumer := false
 
 ConsumingLoop:
 	for {
 		select {
-		case amqpMsg := <-amqpMsgs:
-			wip.Add(1)
-			s.processMessage(ctx, amqpMsg, s.out, unproc, &wip, s.logFields)
+		case amqpMsg, ok := <-deliveries:
+			if !ok {
+				// deliveries channel is closed after basic.cancel
+				if consumer.isCancelled() {
+					s.logger.Info("Consumer cancelled, stopping ProcessMessages", s.stoppingLogFields(wip, amqpMsgs))
+					stopErr = errConsumerCancelled
+				} else {
+					stopErr = errors.New("consumer cancelled by AMQP broker")
+					s.logger.Error("Stopping ProcessMessages", stopErr, s.stoppingLogFields(wip, amqpMsgs))
+				}
+				break ConsumingLoop
+			}
+
+			receivedSinceLastTick++
+			if s.batcher != nil {
+				s.batcher.received(&amqpMsg)
+			}
+			wip.add()
+			s.processMessage(ctx, amqpMsg, s.out, unproc, wip, s.logFields)
 			continue ConsumingLoop
 
+		case flowActive = <-flowChanged:
+			deliveries = activeDeliveries(amqpMsgs, flowActive, paused)
+
+		case <-pauseChanged:
+			paused, pauseChanged = s.handle.pauseState()
+			if paused {
+				s.logger.Info("Subscription paused", s.logFields)
+			} else {
+				s.logger.Info("Subscription resumed", s.logFields)
+			}
+			deliveries = activeDeliveries(amqpMsgs, flowActive, paused)
+
+		case <-liveness:
+			s.logger.Debug("Consumer alive", s.logFields.Add(watermill.LogFields{
+				"received_messages": receivedSinceLastTick,
+				"interval":          s.config.Consume.LivenessInterval,
+			}))
+			receivedSinceLastTick = 0
+
 		case <-s.notifyCloseChannel:
-			s.logger.Error("Channel closed, stopping ProcessMessages", nil, s.logFields)
+			s.logger.Error("Channel closed, stopping ProcessMessages", nil, s.stoppingLogFields(wip, amqpMsgs))
+			s.reportDeliveriesLost(wip)
 			break ConsumingLoop
 
 		case <-s.closing:
-			s.logger.Info("Closing from Subscriber received", s.logFields)
+			s.logger.Info(
+				"Closing from Subscriber or subscription cancel received",
+				s.stoppingLogFields(wip, amqpMsgs),
+			)
+			cancelConsumer = true
 			break ConsumingLoop
 
 		case <-ctx.Done():
-			s.logger.Info("Closing from ctx received", s.logFields)
+			s.logger.Info("Closing from ctx received", s.stoppingLogFields(wip, amqpMsgs))
+			cancelConsumer = true
 			break ConsumingLoop
 
 		case err := <-errbreak:
-			s.logger.Error("Something went wrong, stopping ProcessMessages", err, s.logFields)
+			s.logger.Error("Something went wrong, stopping ProcessMessages", err, s.stoppingLogFields(wip, amqpMsgs))
+			cancelConsumer = true
 			break ConsumingLoop
 		}
 	}
 
-	wip.Wait()
+	if cancelConsumer {
+		// new deliveries are stopped before waiting for in-flight messages, so they are not delivered
+		// just to be requeued when the channel is closed
+		s.cancelConsumer()
+	}
+
+	waitingStarted := time.Now()
+	wip.wait()
+	s.logger.Debug("In-flight messages processed, ProcessMessages stopped", s.logFields.Add(watermill.LogFields{
+		"waited": time.Since(waitingStarted),
+	}))
 
 	close(unproc)
 	<-done
+
+	if s.batcher != nil {
+		if err := s.batcher.close(); err != nil {
+			s.logger.Error("Cannot flush acks batch, acked messages will be redelivered", err, s.logFields)
+		}
+	}
+
+	return stopErr
+}
+
+// cancelConsumer sends basic.cancel for the consumer of the subscription.
+// Deliveries which were already prefetched are requeued by the broker, when the channel is closed.
+func (s *subscription) cancelConsumer() {
+	if err := s.channel.Cancel(s.consumerTag, false); err != nil {
+		s.logger.Error("Cannot cancel consumer, deliveries will be requeued when the channel is closed", err, s.logFields)
+		return
+	}
+
+	s.logger.Debug("Consumer cancelled before waiting for in-flight messages", s.logFields)
+}
+
+// activeDeliveries returns amqpMsgs, or nil when consuming is paused by the broker or by the user.
+func activeDeliveries(amqpMsgs <-chan amqp.Delivery, flowActive bool, paused bool) <-chan amqp.Delivery {
+	if !flowActive || paused {
+		return nil
+	}
+
+	return amqpMsgs
+}
+
+// watchFlow returns channel with the channel.flow state sent by the broker (false when the channel is paused).
+//
+// Notifications are received in a separate goroutine, because the library blocks the connection until
+// the notification is received. Only the latest state is kept in the returned channel.
+func (s *subscription) watchFlow() <-chan bool {
+	flow := s.channel.NotifyFlow(make(chan bool, 1))
+	changed := make(chan bool, 1)
+
+	go func() {
+		// flow is closed when the channel is closed
+		for active := range flow {
+			if active {
+				s.logger.Info("Channel flow resumed by AMQP broker, resuming consuming", s.logFields)
+			} else {
+				s.logger.Info("Channel flow paused by AMQP broker, pausing consuming", s.logFields)
+			}
+			if s.config.Consume.OnFlow != nil {
+				s.config.Consume.OnFlow(s.topic, active)
+			}
+
+			select {
+			case <-changed:
+			default:
+			}
+			changed <- active
+		}
+	}()
+
+	return changed
+}
+
+// stoppingLogFields returns log fields with the number of messages which are still processed
+// and the number of deliveries waiting in the delivery buffer, when ProcessMessages is stopping.
+func (s *subscription) stoppingLogFields(wip *inFlightMessages, amqpMsgs <-chan amqp.Delivery) watermill.LogFields {
+	return s.logFields.Add(watermill.LogFields{
+		"in_flight_messages":  wip.count(),
+		"buffered_deliveries": len(amqpMsgs),
+	})
+}
+
+// reportDeliveriesLost calls Config.Consume.OnDeliveriesLost with UUIDs of the messages,
+// which were sent to the consumer and not acked or nacked before the channel was closed.
+func (s *subscription) reportDeliveriesLost(wip *inFlightMessages) {
+	if s.config.Consume.OnDeliveriesLost == nil {
+		return
+	}
+
+	uuids := wip.trackedUUIDs()
+	if len(uuids) == 0 {
+		return
+	}
+
+	s.logger.Info("Channel closed with unacked messages, they will be redelivered", s.logFields.Add(watermill.LogFields{
+		"lost_deliveries": len(uuids),
+	}))
+	s.config.Consume.OnDeliveriesLost(uuids)
+}
+
+// inFlightMessages tracks messages, which are processed (sent to the consumer and not acked or nacked yet).
+type inFlightMessages struct {
+	wg      sync.WaitGroup
+	current int64
+
+	// uuids of the messages sent to the consumer by delivery tag, tracked only with Config.Consume.OnDeliveriesLost
+	uuidsLock sync.Mutex
+	uuids     map[uint64]string
+}
+
+func (i *inFlightMessages) track(deliveryTag uint64, uuid string) {
+	i.uuidsLock.Lock()
+	defer i.uuidsLock.Unlock()
+
+	if i.uuids == nil {
+		i.uuids = make(map[uint64]string)
+	}
+	i.uuids[deliveryTag] = uuid
+}
+
+func (i *inFlightMessages) untrack(deliveryTag uint64) {
+	i.uuidsLock.Lock()
+	defer i.uuidsLock.Unlock()
+
+	delete(i.uuids, deliveryTag)
+}
+
+// trackedUUIDs returns UUIDs of the tracked messages, in the order they were delivered.
+func (i *inFlightMessages) trackedUUIDs() []string {
+	i.uuidsLock.Lock()
+	defer i.uuidsLock.Unlock()
+
+	tags := make([]uint64, 0, len(i.uuids))
+	for tag := range i.uuids {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(a, b int) bool { return tags[a] < tags[b] })
+
+	uuids := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		uuids = append(uuids, i.uuids[tag])
+	}
+
+	return uuids
+}
+
+func (i *inFlightMessages) add() {
+	atomic.AddInt64(&i.current, 1)
+	i.wg.Add(1)
+}
+
+func (i *inFlightMessages) done() {
+	atomic.AddInt64(&i.current, -1)
+	i.wg.Done()
+}
+
+func (i *inFlightMessages) count() int64 {
+	return atomic.LoadInt64(&i.current)
 }
 
-func (s *subscription) createConsumer(queueName string, channel *amqp.Channel) (<-chan amqp.Delivery, error) {
+func (i *inFlightMessages) wait() {
+	i.wg.Wait()
+}
+
+// nackUndelivered nacks deliveries from unproc until it's closed.
+//
+// When nack fails, the error is sent to errbreak to reconnect the subscription, but unproc is still drained,
+// so ack goroutines and ConsumingLoop are never blocked on sending to unproc.
+// Deliveries received after the failure are not nacked, they are redelivered by the broker
+// when the channel is closed.
+func (s *subscription) nackUndelivered(unproc <-chan undelivered, errbreak chan<- error) {
+	nackFailed := false
+
+	for del := range unproc {
+		if nackFailed {
+			s.logger.Info("Not sending nack after nack failure, message will be redelivered after reconnect", s.logFields)
+			continue
+		}
+
+		if del.error != nil {
+			s.logger.Error("Processing message failed, sending nack", del.error, s.logFields)
+		} else {
+			s.logger.Info("Message wasn't processed, sending nack", s.logFields)
+		}
+
+		if err := s.nackMsgWithRetries(del.Delivery); err != nil {
+			s.logger.Error("Cannot nack message", err, s.logFields)
+			nackFailed = true
+
+			// something went really wrong when we cannot nack, let's reconnect
+			select {
+			case errbreak <- err:
+			default:
+			}
+		}
+	}
+}
+
+// nackUndeliveredSync nacks the delivery sent to syncUnproc by processMessage with Config.Consume.SyncAck,
+// so it's nacked before the next delivery is processed. At most one delivery is sent to syncUnproc.
+//
+// When nack fails, the delivery is sent to unproc, so nackUndelivered reconnects the subscription.
+func (s *subscription) nackUndeliveredSync(syncUnproc <-chan undelivered, unproc chan<- undelivered) {
+	var del undelivered
+	select {
+	case del = <-syncUnproc:
+	default:
+		return
+	}
+
+	if del.error != nil {
+		s.logger.Error("Processing message failed, sending nack", del.error, s.logFields)
+	} else {
+		s.logger.Info("Message wasn't processed, sending nack", s.logFields)
+	}
+
+	if err := s.nackMsgWithRetries(del.Delivery); err != nil {
+		unproc <- undelivered{Delivery: del.Delivery, error: errors.Wrap(err, "cannot nack message")}
+	}
+}
+
+func (s *subscription) createConsumer(queueName string, channel AMQPChannel) (<-chan amqp.Delivery, error) {
 	amqpMsgs, err := channel.Consume(
 		queueName,
-		s.config.Consume.Consumer,
+		s.consumerTag,
 		false, // autoAck must be set to false - acks are managed by Watermill
 		s.config.Consume.Exclusive,
 		s.config.Consume.NoLocal,
 		s.config.Consume.NoWait,
-		s.config.Consume.Arguments,
+		s.config.Consume.arguments(s.topic),
 	)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot consume from channel")
@@ -304,20 +1104,43 @@ func (s *subscription) processMessage(
 	amqpMsg amqp.Delivery,
 	out chan *message.Message,
 	unproc chan<- undelivered,
-	wg *sync.WaitGroup,
+	wip *inFlightMessages,
 	logFields watermill.LogFields,
 ) {
 	candef := true
-	defer doif(&candef, wg.Done)
+	defer doif(&candef, wip.done)
+
+	if s.config.Consume.SyncAck {
+		// deferred after wip.done, so it's called before the delivery is marked as processed
+		syncUnproc := make(chan undelivered, 1)
+		defer s.nackUndeliveredSync(syncUnproc, unproc)
+		unproc = syncUnproc
+	}
+
+	s.counters.addReceived()
+	s.observeLatency(amqpMsg)
+
+	if s.config.Consume.Filter != nil && !s.config.Consume.Filter(amqpMsg) {
+		s.filteredMessages++
+		s.logger.Trace("Message filtered out, sending ack", logFields.Add(watermill.LogFields{
+			"filtered_messages": s.filteredMessages,
+		}))
+
+		if err := amqpMsg.Ack(false); err != nil {
+			unproc <- undelivered{Delivery: amqpMsg, error: errors.Wrap(err, "cannot ack filtered message")}
+		}
+		return
+	}
 
-	msg, err := s.config.Marshaler.Unmarshal(amqpMsg)
+	msg, err := s.config.consumeMarshaler(s.topic).Unmarshal(amqpMsg)
 	if err != nil {
-		unproc <- undelivered{Delivery: amqpMsg, error: err}
+		s.handleUnmarshalError(amqpMsg, err, unproc, logFields)
 		return
 	}
 
 	ctx, cancelCtx := context.WithCancel(ctx)
-	msg.SetContext(ctx)
+	ctx, delivery := contextWithDelivery(ctx, amqpMsg)
+	msg.SetContext(s.config.Consume.messageContext(ctx, amqpMsg))
 	defer doif(&candef, cancelCtx)
 
 	msgLogFields := logFields.Add(watermill.LogFields{"message_uuid": msg.UUID})
@@ -327,6 +1150,17 @@ func (s *subscription) processMessage(
 	case <-s.closing:
 		s.logger.Info("Message not consumed, pub/sub is closing", msgLogFields)
 
+		unproc <- undelivered{Delivery: amqpMsg}
+		return
+	case <-s.contextDone(ctx):
+		if s.config.Consume.OnContextDone == ContextDoneRelease {
+			s.logger.Info("Message not consumed, ctx done, releasing", msgLogFields)
+			delivery.release()
+			s.releaseDelivery()
+			return
+		}
+		s.logger.Info("Message not consumed, ctx done", msgLogFields)
+
 		unproc <- undelivered{Delivery: amqpMsg}
 		return
 	case out <- msg:
@@ -336,29 +1170,267 @@ func (s *subscription) processMessage(
 	// now all deferred funcs will be maintained by goroutine
 	candef = false
 
+	if s.config.Consume.AckOnReceive {
+		s.ackOnReceive(ctx, amqpMsg, msg, delivery, cancelCtx, msgLogFields)
+		wip.done()
+		return
+	}
+
+	stopTimeoutWarning := s.warnBeforeConsumerTimeout(amqpMsg, msgLogFields)
+	if s.config.Consume.OnDeliveriesLost != nil {
+		wip.track(amqpMsg.DeliveryTag, msg.UUID)
+	}
+
+	resolve := func() {
+		defer cancelCtx()
+		defer wip.done()
+		defer wip.untrack(amqpMsg.DeliveryTag)
+		defer delivery.release()
+		defer stopTimeoutWarning()
+
+		if err := s.resolveDelivery(ctx, amqpMsg, msg, msgLogFields); err != nil {
+			unproc <- undelivered{Delivery: amqpMsg, error: err}
+			return
+		}
+	}
+
+	if s.config.Consume.ProcessInOrder || s.config.Consume.SyncAck {
+		// next delivery is not received until this one is acked or nacked
+		resolve()
+		return
+	}
+
 	// async message Ack/Nack handling allows unblock
 	// receiving of rest messages and process them simultaneously.
+	go resolve()
+}
+
+// consumerTimeoutWarningRatio is the part of Config.Queue.ConsumerTimeout, after which the not acked message is reported.
+const consumerTimeoutWarningRatio = 0.8
+
+// warnBeforeConsumerTimeout reports the message, which is not acked or nacked after consumerTimeoutWarningRatio
+// of Config.Queue.ConsumerTimeout. Returned func stops the timer, it must be called when the message is resolved.
+func (s *subscription) warnBeforeConsumerTimeout(amqpMsg amqp.Delivery, msgLogFields watermill.LogFields) func() {
+	timeout := s.config.Queue.ConsumerTimeout
+	if timeout <= 0 {
+		return func() {}
+	}
+
+	warnAfter := time.Duration(float64(timeout) * consumerTimeoutWarningRatio)
+	timer := time.AfterFunc(warnAfter, func() {
+		s.logger.Info(
+			"Message is not acked yet, channel will be closed by the broker after consumer timeout",
+			msgLogFields.Add(watermill.LogFields{
+				"elapsed":          warnAfter,
+				"consumer_timeout": timeout,
+			}),
+		)
+		if s.config.Consume.OnConsumerTimeoutWarning != nil {
+			s.config.Consume.OnConsumerTimeoutWarning(s.topic, amqpMsg, warnAfter)
+		}
+	})
+
+	return func() {
+		timer.Stop()
+	}
+}
+
+// ackOnReceive acks the delivery, which was just sent to the consumer (see Config.Consume.AckOnReceive).
+// Ack or nack of the message only cancels its context and releases the delivery (see DeliveryFromContext).
+func (s *subscription) ackOnReceive(
+	ctx context.Context,
+	amqpMsg amqp.Delivery,
+	msg *message.Message,
+	delivery *deliveryHolder,
+	cancelCtx context.CancelFunc,
+	msgLogFields watermill.LogFields,
+) {
+	if err := amqpMsg.Ack(false); err != nil {
+		// message is already processed, so it's not nacked
+		s.logger.Error("Cannot ack message on receive", err, msgLogFields)
+	} else {
+		s.counters.addAcked()
+		s.logger.Trace("Message acked on receive", msgLogFields)
+	}
+
 	go func() {
 		defer cancelCtx()
-		defer wg.Done()
+		defer delivery.release()
 
-		var err error
 		select {
-		case <-s.closing:
-			s.logger.Trace("Closing pub/sub, message discarded before ack", msgLogFields)
-			err = s.nackMsg(amqpMsg)
 		case <-msg.Acked():
-			s.logger.Trace("Message Acked", msgLogFields)
-			err = amqpMsg.Ack(false)
 		case <-msg.Nacked():
-			s.logger.Trace("Message Nacked", msgLogFields)
-			err = s.nackMsg(amqpMsg)
+		case <-ctx.Done():
+		case <-s.closing:
 		}
-		if err != nil {
-			unproc <- undelivered{Delivery: amqpMsg, error: err}
-			return
+	}()
+}
+
+// observeLatency reports the time elapsed since the delivery Timestamp to Config.Consume.OnDeliveryLatency.
+func (s *subscription) observeLatency(amqpMsg amqp.Delivery) {
+	if s.config.Consume.OnDeliveryLatency == nil || amqpMsg.Timestamp.IsZero() {
+		return
+	}
+
+	latency := time.Since(amqpMsg.Timestamp)
+	if latency < 0 {
+		latency = 0
+	}
+
+	s.config.Consume.OnDeliveryLatency(s.topic, latency, amqpMsg)
+}
+
+// handleUnmarshalError handles the delivery which cannot be unmarshaled according to Config.Consume.OnUnmarshalError.
+func (s *subscription) handleUnmarshalError(
+	amqpMsg amqp.Delivery,
+	unmarshalErr error,
+	unproc chan<- undelivered,
+	logFields watermill.LogFields,
+) {
+	s.counters.addUnmarshalError()
+	logUnmarshalErrorDelivery(s.logger, s.config.Consume, amqpMsg, unmarshalErr, logFields)
+
+	var err error
+
+	switch s.config.Consume.OnUnmarshalError {
+	case UnmarshalErrorDrop:
+		s.logger.Error("Cannot unmarshal message, dropping", unmarshalErr, logFields)
+		err = amqpMsg.Ack(false)
+	case UnmarshalErrorDeadLetter:
+		s.logger.Error("Cannot unmarshal message, dead-lettering", unmarshalErr, logFields)
+		err = s.config.Consume.nack(amqpMsg, false)
+	default:
+		unproc <- undelivered{Delivery: amqpMsg, error: unmarshalErr}
+		return
+	}
+
+	if err != nil {
+		unproc <- undelivered{Delivery: amqpMsg, error: err}
+	}
+}
+
+const defaultLogUnmarshalErrorBodyBytes = 1024
+
+// logUnmarshalErrorDelivery logs the delivery, which cannot be unmarshaled, when enabled by
+// Config.Consume.LogUnmarshalErrorDelivery.
+func logUnmarshalErrorDelivery(
+	logger watermill.LoggerAdapter,
+	config ConsumeConfig,
+	amqpMsg amqp.Delivery,
+	unmarshalErr error,
+	logFields watermill.LogFields,
+) {
+	if !config.LogUnmarshalErrorDelivery {
+		return
+	}
+
+	logger.Trace("Delivery which cannot be unmarshaled", logFields.Add(
+		unmarshalErrorDeliveryLogFields(amqpMsg, config.LogUnmarshalErrorBodyBytes),
+	).Add(watermill.LogFields{"err": unmarshalErr.Error()}))
+}
+
+func unmarshalErrorDeliveryLogFields(amqpMsg amqp.Delivery, maxBodyBytes int) watermill.LogFields {
+	if maxBodyBytes == 0 {
+		maxBodyBytes = defaultLogUnmarshalErrorBodyBytes
+	}
+
+	body := amqpMsg.Body
+	truncated := false
+	if maxBodyBytes > 0 && len(body) > maxBodyBytes {
+		body = body[:maxBodyBytes]
+		truncated = true
+	}
+
+	return watermill.LogFields{
+		"content_type":     amqpMsg.ContentType,
+		"content_encoding": amqpMsg.ContentEncoding,
+		"headers":          amqpMsg.Headers,
+		"body":             string(body),
+		"body_bytes":       len(amqpMsg.Body),
+		"body_truncated":   truncated,
+	}
+}
+
+// resolveDelivery waits for the AckStrategy outcome and acks or nacks the delivery.
+// ctx is the context of the subscription, it's handled according to Config.Consume.OnContextDone.
+func (s *subscription) resolveDelivery(
+	ctx context.Context,
+	amqpMsg amqp.Delivery,
+	msg *message.Message,
+	msgLogFields watermill.LogFields,
+) error {
+	switch s.config.Consume.ackStrategy().Outcome(amqpMsg, msg, s.resolveClosing(ctx)) {
+	case AckOutcomeAck:
+		s.logger.Trace("Message Acked", msgLogFields)
+		if err := amqpMsg.Ack(false); err != nil {
+			return err
+		}
+		s.counters.addAcked()
+		return nil
+	default:
+		if s.releasedOnContextDone(ctx, msg) {
+			s.logger.Info("Ctx done, message released without nack", msgLogFields)
+			s.releaseDelivery()
+			return nil
+		}
+		s.logger.Trace("Message Nacked", msgLogFields)
+		return s.nackMsg(amqpMsg)
+	}
+}
+
+// releaseDelivery is called for the delivery, which is left without ack or nack because of ContextDoneRelease.
+// It's redelivered by the broker when the channel is closed, so it must not be acked by the batched cumulative ack.
+func (s *subscription) releaseDelivery() {
+	if s.batcher != nil {
+		s.batcher.release()
+	}
+}
+
+// contextDone returns ctx.Done(), or nil (blocks forever) when Config.Consume.OnContextDone is ContextDoneWait.
+func (s *subscription) contextDone(ctx context.Context) <-chan struct{} {
+	if s.config.Consume.OnContextDone == ContextDoneWait {
+		return nil
+	}
+
+	return ctx.Done()
+}
+
+// resolveClosing returns the closing channel passed to AckStrategy.
+// Unless Config.Consume.OnContextDone is ContextDoneWait, it's closed also when ctx is done.
+func (s *subscription) resolveClosing(ctx context.Context) <-chan struct{} {
+	ctxDone := s.contextDone(ctx)
+	if ctxDone == nil {
+		return s.closing
+	}
+
+	closing := make(chan struct{})
+	go func() {
+		defer close(closing)
+
+		select {
+		case <-s.closing:
+		case <-ctxDone:
 		}
 	}()
+
+	return closing
+}
+
+// releasedOnContextDone returns true, when the delivery resolved because of ctx done
+// must not be nacked (see ContextDoneRelease). Explicitly nacked messages are still nacked.
+func (s *subscription) releasedOnContextDone(ctx context.Context, msg *message.Message) bool {
+	if s.config.Consume.OnContextDone != ContextDoneRelease || ctx.Err() == nil {
+		return false
+	}
+
+	select {
+	case <-s.closing:
+		return false
+	case <-msg.Nacked():
+		return false
+	default:
+		return true
+	}
 }
 
 // doif is suitable for deferred execution func
@@ -374,6 +1446,104 @@ func doif(cond *bool, f func()) {
 	f()
 }
 
+// nackRetryInterval is multiplied by the retry number to get delay before the nack retry.
+const nackRetryInterval = time.Millisecond * 100
+
+// nackMsgWithRetries nacks the message retrying up to Config.Consume.NackRetries times.
+//
+// Only acking or nacking of the delivery is retried. The copy published by Config.Consume.Retry
+// or Config.Consume.Requeue is published once, so it's not duplicated when the copy was published,
+// but the original delivery cannot be acked. Retrying is stopped when the subscription is closing.
+func (s *subscription) nackMsgWithRetries(amqpMsg amqp.Delivery) error {
+	settle := s.prepareNack(amqpMsg)
+	err := settle()
+
+	for retry := 1; err != nil && retry <= s.config.Consume.NackRetries; retry++ {
+		retryIn := nackRetryInterval * time.Duration(retry)
+		s.logger.Info("Cannot nack message, retrying", s.logFields.Add(watermill.LogFields{
+			"err":      err.Error(),
+			"retry":    retry,
+			"retry_in": retryIn,
+		}))
+
+		select {
+		case <-time.After(retryIn):
+		case <-s.closing:
+			return errors.Wrap(err, "nack not retried, subscription is closing")
+		}
+		err = settle()
+	}
+
+	if err == nil {
+		s.counters.addNacked()
+	}
+
+	return err
+}
+
 func (s *subscription) nackMsg(amqpMsg amqp.Delivery) error {
-	return amqpMsg.Nack(false, !s.config.Consume.NoRequeueOnNack)
+	err := s.prepareNack(amqpMsg)()
+	if err == nil {
+		s.counters.addNacked()
+	}
+
+	return err
+}
+
+// prepareNack publishes the copy of the message, when it's required by Config.Consume.Retry
+// or Config.Consume.Requeue, and returns func, which acks or nacks the original delivery.
+func (s *subscription) prepareNack(amqpMsg amqp.Delivery) func() error {
+	switch {
+	case s.config.Consume.Retry.enabled():
+		return s.retry(amqpMsg)
+	case s.config.Consume.Requeue.enabled() && !s.config.Consume.NoRequeueOnNack:
+		return s.requeueWithDelay(amqpMsg)
+	default:
+		return func() error {
+			return s.config.Consume.nack(amqpMsg, !s.config.Consume.NoRequeueOnNack)
+		}
+	}
+}
+
+// requeueWithDelay publishes message to the delay queue and returns func acking the original delivery.
+// Message is dead-lettered back to the queue after Config.Consume.Requeue.Delay.
+//
+// The original delivery is acked only after the broker confirmed the copy. When the delay queue doesn't exist
+// (for example when it's not declared by a custom TopologyBuilder), the copy is returned by the broker
+// and the original delivery is requeued immediately instead. It's requeued also when the copy is not confirmed
+// in Config.Consume.RepublishTimeout or the subscription is closing.
+func (s *subscription) requeueWithDelay(amqpMsg amqp.Delivery) func() error {
+	if err := s.republisher.publish(
+		"",
+		s.config.Consume.Requeue.delayQueueName(s.queueName),
+		deliveryToPublishing(amqpMsg),
+	); err != nil {
+		s.logger.Error("Cannot publish message to delay queue, requeueing without delay", err, s.logFields)
+		return func() error {
+			return s.config.Consume.nack(amqpMsg, true)
+		}
+	}
+
+	return func() error {
+		return amqpMsg.Ack(false)
+	}
+}
+
+func deliveryToPublishing(amqpMsg amqp.Delivery) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         amqpMsg.Headers,
+		ContentType:     amqpMsg.ContentType,
+		ContentEncoding: amqpMsg.ContentEncoding,
+		DeliveryMode:    amqpMsg.DeliveryMode,
+		Priority:        amqpMsg.Priority,
+		CorrelationId:   amqpMsg.CorrelationId,
+		ReplyTo:         amqpMsg.ReplyTo,
+		Expiration:      amqpMsg.Expiration,
+		MessageId:       amqpMsg.MessageId,
+		Timestamp:       amqpMsg.Timestamp,
+		Type:            amqpMsg.Type,
+		UserId:          amqpMsg.UserId,
+		AppId:           amqpMsg.AppId,
+		Body:            amqpMsg.Body,
+	}
 }
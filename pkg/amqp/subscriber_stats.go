@@ -0,0 +1,72 @@
+package amqp
+
+import "sync/atomic"
+
+// SubscriberStats contains counters of messages consumed by the Subscriber, see Subscriber.Stats.
+type SubscriberStats struct {
+	// Received is the number of deliveries received from the broker (including filtered out deliveries).
+	Received int64
+	// Acked is the number of messages acked after processing.
+	Acked int64
+	// Nacked is the number of nacked messages (including requeued with delay or republished for retry).
+	Nacked int64
+	// UnmarshalErrors is the number of deliveries, which couldn't be unmarshaled.
+	UnmarshalErrors int64
+	// Reconnects is the number of times a subscription was restarted after consuming stopped
+	// (for example after the connection or the channel was closed).
+	Reconnects int64
+}
+
+// subscriberCounters are updated atomically by subscriptions of the Subscriber.
+// Methods can be called on nil counters, for example by Subscriber.Get.
+type subscriberCounters struct {
+	received        int64
+	acked           int64
+	nacked          int64
+	unmarshalErrors int64
+	reconnects      int64
+}
+
+func (c *subscriberCounters) addReceived() {
+	if c != nil {
+		atomic.AddInt64(&c.received, 1)
+	}
+}
+
+func (c *subscriberCounters) addAcked() {
+	if c != nil {
+		atomic.AddInt64(&c.acked, 1)
+	}
+}
+
+func (c *subscriberCounters) addNacked() {
+	if c != nil {
+		atomic.AddInt64(&c.nacked, 1)
+	}
+}
+
+func (c *subscriberCounters) addUnmarshalError() {
+	if c != nil {
+		atomic.AddInt64(&c.unmarshalErrors, 1)
+	}
+}
+
+func (c *subscriberCounters) addReconnect() {
+	if c != nil {
+		atomic.AddInt64(&c.reconnects, 1)
+	}
+}
+
+// Stats returns counters of messages consumed since the Subscriber was created.
+//
+// It's a lightweight alternative to metrics, for example for a debug endpoint.
+// Counters are read separately, so they may be slightly inconsistent with each other while consuming.
+func (s *Subscriber) Stats() SubscriberStats {
+	return SubscriberStats{
+		Received:        atomic.LoadInt64(&s.counters.received),
+		Acked:           atomic.LoadInt64(&s.counters.acked),
+		Nacked:          atomic.LoadInt64(&s.counters.nacked),
+		UnmarshalErrors: atomic.LoadInt64(&s.counters.unmarshalErrors),
+		Reconnects:      atomic.LoadInt64(&s.counters.reconnects),
+	}
+}
@@ -0,0 +1,202 @@
+package amqp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// SubscriptionState is the state of the Subscription, see Subscription.State.
+type SubscriptionState int32
+
+const (
+	// SubscriptionInitializing is the state before the consumer is started for the first time.
+	SubscriptionInitializing SubscriptionState = iota
+	// SubscriptionConsuming is the state when the consumer is started and deliveries are received.
+	SubscriptionConsuming
+	// SubscriptionReconnecting is the state when consuming failed (for example the connection was lost)
+	// and the subscription is waiting for the connection or retrying to start the consumer.
+	SubscriptionReconnecting
+	// SubscriptionStopped is the state when the subscription is stopped and the output channel is closed.
+	SubscriptionStopped
+)
+
+func (s SubscriptionState) String() string {
+	switch s {
+	case SubscriptionInitializing:
+		return "initializing"
+	case SubscriptionConsuming:
+		return "consuming"
+	case SubscriptionReconnecting:
+		return "reconnecting"
+	case SubscriptionStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// Subscription is a handle of the single topic subscription, returned by Subscriber.SubscribeWithHandle.
+// It allows to stop the subscription without closing the whole Subscriber.
+type Subscription struct {
+	topic string
+
+	queueName     string
+	queueNameLock sync.RWMutex
+
+	consumerTag string
+
+	// state is SubscriptionState, accessed atomically
+	state int32
+
+	paused bool
+	// pauseChanged is closed (and replaced) when the subscription is paused or resumed
+	pauseChanged chan struct{}
+	pauseLock    sync.Mutex
+
+	cancel     chan struct{}
+	cancelOnce sync.Once
+
+	err     error
+	errLock sync.RWMutex
+
+	// stopping is closed when Cancel is called or when Subscriber is closing
+	stopping chan struct{}
+	// done is closed when subscription is stopped and output channel is closed
+	done chan struct{}
+}
+
+func newSubscription(topic string, closing chan struct{}) *Subscription {
+	sub := &Subscription{
+		topic:        topic,
+		pauseChanged: make(chan struct{}),
+		cancel:       make(chan struct{}),
+		stopping:     make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	go func() {
+		select {
+		case <-closing:
+		case <-sub.cancel:
+		case <-sub.done:
+			return
+		}
+		close(sub.stopping)
+	}()
+
+	return sub
+}
+
+// Topic returns the topic of the subscription.
+func (s *Subscription) Topic() string {
+	return s.topic
+}
+
+// QueueName returns name of the consumed queue.
+//
+// When server named queue is used (see QueueConfig.ServerNamed), the name is generated by the broker
+// and it changes after every reconnect.
+func (s *Subscription) QueueName() string {
+	s.queueNameLock.RLock()
+	defer s.queueNameLock.RUnlock()
+
+	return s.queueName
+}
+
+func (s *Subscription) setQueueName(queueName string) {
+	s.queueNameLock.Lock()
+	defer s.queueNameLock.Unlock()
+
+	s.queueName = queueName
+}
+
+// State returns the current state of the subscription.
+// Unlike Subscriber.IsConnected, it tells whether the consumer of this subscription is actually running.
+func (s *Subscription) State() SubscriptionState {
+	return SubscriptionState(atomic.LoadInt32(&s.state))
+}
+
+func (s *Subscription) setState(state SubscriptionState) {
+	atomic.StoreInt32(&s.state, int32(state))
+}
+
+// ConsumerTag returns the consumer tag of the subscription, which can be used with Subscriber.CancelConsumer.
+// It's ConsumeConfig.Consumer or a tag generated for the subscription, when ConsumeConfig.Consumer is empty.
+func (s *Subscription) ConsumerTag() string {
+	return s.consumerTag
+}
+
+// Pause stops sending messages to the output channel, without stopping the consumer.
+// Messages which are already processed are not affected.
+//
+// While paused, the connection and the consumer stay alive, deliveries are not received from the broker,
+// so the broker stops sending them when Qos.PrefetchCount unacknowledged deliveries are prefetched.
+// Pause is kept after reconnect. It is safe to call Pause multiple times.
+func (s *Subscription) Pause() {
+	s.setPaused(true)
+}
+
+// Resume resumes sending messages to the output channel after Pause.
+func (s *Subscription) Resume() {
+	s.setPaused(false)
+}
+
+// IsPaused returns true, when the subscription is paused with Pause.
+func (s *Subscription) IsPaused() bool {
+	paused, _ := s.pauseState()
+	return paused
+}
+
+func (s *Subscription) setPaused(paused bool) {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+
+	if s.paused == paused {
+		return
+	}
+
+	s.paused = paused
+	close(s.pauseChanged)
+	s.pauseChanged = make(chan struct{})
+}
+
+// pauseState returns whether the subscription is paused and channel, which is closed when it changes.
+func (s *Subscription) pauseState() (bool, <-chan struct{}) {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+
+	return s.paused, s.pauseChanged
+}
+
+// Cancel stops consuming of the topic and closes the output channel.
+// Messages which are not acked yet are nacked.
+//
+// Cancel blocks until the subscription is stopped. It is safe to call Cancel multiple times.
+func (s *Subscription) Cancel() {
+	s.cancelOnce.Do(func() {
+		close(s.cancel)
+	})
+	<-s.done
+}
+
+// Err returns the error, which stopped the subscription (for example TopologyMismatchError or
+// ErrReconnectAttemptsExhausted, see ReconnectConfig.MaxAttempts).
+// It's nil while the subscription is running or when it was stopped by Cancel, ctx or close of the Subscriber.
+func (s *Subscription) Err() error {
+	s.errLock.RLock()
+	defer s.errLock.RUnlock()
+
+	return s.err
+}
+
+func (s *Subscription) setErr(err error) {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+
+	s.err = err
+}
+
+// Done returns channel, which is closed when the subscription is stopped.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
@@ -1,6 +1,8 @@
 package amqp
 
 import (
+	"time"
+
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/pkg/errors"
 	"github.com/streadway/amqp"
@@ -14,14 +16,15 @@ import (
 // 	config := NewDurablePubSubConfig()
 // 	config.TopologyBuilder = MyProCustomBuilder{}
 //
+// The channel is AMQPChannel, which is implemented by *amqp.Channel from github.com/streadway/amqp.
 type TopologyBuilder interface {
-	BuildTopology(channel *amqp.Channel, queueName string, exchangeName string, config Config, logger watermill.LoggerAdapter) error
-	ExchangeDeclare(channel *amqp.Channel, exchangeName string, config Config) error
+	BuildTopology(channel AMQPChannel, queueName string, exchangeName string, config Config, logger watermill.LoggerAdapter) error
+	ExchangeDeclare(channel AMQPChannel, exchangeName string, config Config) error
 }
 
 type DefaultTopologyBuilder struct{}
 
-func (builder DefaultTopologyBuilder) ExchangeDeclare(channel *amqp.Channel, exchangeName string, config Config) error {
+func (builder DefaultTopologyBuilder) ExchangeDeclare(channel AMQPChannel, exchangeName string, config Config) error {
 	return channel.ExchangeDeclare(
 		exchangeName,
 		config.Exchange.Type,
@@ -29,27 +32,35 @@ func (builder DefaultTopologyBuilder) ExchangeDeclare(channel *amqp.Channel, exc
 		config.Exchange.AutoDeleted,
 		config.Exchange.Internal,
 		config.Exchange.NoWait,
-		config.Exchange.Arguments,
+		exchangeArguments(config),
 	)
 }
 
-func (builder *DefaultTopologyBuilder) BuildTopology(channel *amqp.Channel, queueName string, exchangeName string, config Config, logger watermill.LoggerAdapter) error {
+func (builder *DefaultTopologyBuilder) BuildTopology(channel AMQPChannel, queueName string, exchangeName string, config Config, logger watermill.LoggerAdapter) error {
 	if _, err := channel.QueueDeclare(
 		queueName,
 		config.Queue.Durable,
 		config.Queue.AutoDelete,
 		config.Queue.Exclusive,
 		config.Queue.NoWait,
-		config.Queue.Arguments,
+		queueArguments(config),
 	); err != nil {
 		return errors.Wrap(err, "cannot declare queue")
 	}
 
 	logger.Debug("Queue declared", nil)
 
+	if config.Consume.Requeue.enabled() && !config.Consume.NoRequeueOnNack {
+		if err := builder.declareDelayQueue(channel, queueName, config); err != nil {
+			return errors.Wrap(err, "cannot declare delay queue")
+		}
+
+		logger.Debug("Delay queue declared", nil)
+	}
+
 	if exchangeName == "" {
 		logger.Debug("No exchange to declare", nil)
-		return nil
+		return builder.bindExtraExchanges(channel, queueName, config, logger)
 	}
 	if err := builder.ExchangeDeclare(channel, exchangeName, config); err != nil {
 		return errors.Wrap(err, "cannot declare exchange")
@@ -66,5 +77,136 @@ func (builder *DefaultTopologyBuilder) BuildTopology(channel *amqp.Channel, queu
 	); err != nil {
 		return errors.Wrap(err, "cannot bind queue")
 	}
+	return builder.bindExtraExchanges(channel, queueName, config, logger)
+}
+
+// bindExtraExchanges declares exchanges from Config.QueueBind.ExtraBindings and binds the queue to them.
+func (builder *DefaultTopologyBuilder) bindExtraExchanges(
+	channel AMQPChannel,
+	queueName string,
+	config Config,
+	logger watermill.LoggerAdapter,
+) error {
+	for _, binding := range config.QueueBind.ExtraBindings {
+		if binding.ExchangeType != "" {
+			if err := channel.ExchangeDeclare(
+				binding.Exchange,
+				binding.ExchangeType,
+				binding.ExchangeDurable,
+				binding.ExchangeAutoDeleted,
+				binding.ExchangeInternal,
+				binding.ExchangeNoWait,
+				binding.ExchangeArguments,
+			); err != nil {
+				return errors.Wrapf(err, "cannot declare exchange %s", binding.Exchange)
+			}
+		}
+
+		if err := channel.QueueBind(
+			queueName,
+			binding.RoutingKey,
+			binding.Exchange,
+			config.QueueBind.NoWait,
+			binding.Arguments,
+		); err != nil {
+			return errors.Wrapf(err, "cannot bind queue to exchange %s", binding.Exchange)
+		}
+
+		logger.Debug("Queue bound to extra exchange", watermill.LogFields{
+			"amqp_exchange_name": binding.Exchange,
+			"amqp_routing_key":   binding.RoutingKey,
+		})
+	}
+
 	return nil
 }
+
+// declareDelayQueue declares queue without consumers, from which messages are dead-lettered
+// back to the queueName (via default exchange) after Config.Consume.Requeue.Delay.
+func (builder *DefaultTopologyBuilder) declareDelayQueue(channel AMQPChannel, queueName string, config Config) error {
+	_, err := channel.QueueDeclare(
+		config.Consume.Requeue.delayQueueName(queueName),
+		config.Queue.Durable,
+		config.Queue.AutoDelete,
+		false,
+		config.Queue.NoWait,
+		amqp.Table{
+			"x-message-ttl":             int64(config.Consume.Requeue.Delay / time.Millisecond),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queueName,
+		},
+	)
+	return err
+}
+
+// queueArguments returns Config.Queue.Arguments extended with arguments generated from the config.
+func queueArguments(config Config) amqp.Table {
+	generated := amqp.Table{}
+
+	if config.Queue.DeadLetterExchange != "" {
+		generated["x-dead-letter-exchange"] = config.Queue.DeadLetterExchange
+	}
+	if config.Queue.DeadLetterRoutingKey != "" {
+		generated["x-dead-letter-routing-key"] = config.Queue.DeadLetterRoutingKey
+	}
+	if config.Queue.Deduplication {
+		generated["x-message-deduplication"] = true
+	}
+	if config.Queue.SingleActiveConsumer {
+		generated["x-single-active-consumer"] = true
+	}
+	if config.Queue.Lazy {
+		generated["x-queue-mode"] = "lazy"
+	}
+	if config.Queue.ConsumerTimeout > 0 {
+		generated["x-consumer-timeout"] = int64(config.Queue.ConsumerTimeout / time.Millisecond)
+	}
+	if config.Queue.MaxLength > 0 {
+		generated["x-max-length"] = config.Queue.MaxLength
+	}
+	if config.Queue.MaxLengthBytes > 0 {
+		generated["x-max-length-bytes"] = config.Queue.MaxLengthBytes
+	}
+	if config.Queue.Overflow != "" {
+		generated["x-overflow"] = string(config.Queue.Overflow)
+	}
+
+	return mergeArguments(generated, config.Queue.Arguments)
+}
+
+// exchangeArguments returns Config.Exchange.Arguments extended with arguments generated from the config.
+func exchangeArguments(config Config) amqp.Table {
+	generated := amqp.Table{}
+
+	if config.Exchange.Type == "x-delayed-message" {
+		generated["x-delayed-type"] = "direct"
+	}
+	if config.Exchange.Type == DeduplicationExchangeType {
+		if config.Exchange.DeduplicationCacheSize > 0 {
+			generated["x-cache-size"] = int64(config.Exchange.DeduplicationCacheSize)
+		}
+		if config.Exchange.DeduplicationCacheTTL > 0 {
+			generated["x-cache-ttl"] = int64(config.Exchange.DeduplicationCacheTTL / time.Millisecond)
+		}
+	}
+
+	return mergeArguments(generated, config.Exchange.Arguments)
+}
+
+// mergeArguments merges generated arguments with arguments provided by the user.
+// Arguments provided by the user take precedence.
+func mergeArguments(generated amqp.Table, user amqp.Table) amqp.Table {
+	if len(generated) == 0 {
+		return user
+	}
+
+	merged := make(amqp.Table, len(generated)+len(user))
+	for key, value := range generated {
+		merged[key] = value
+	}
+	for key, value := range user {
+		merged[key] = value
+	}
+
+	return merged
+}
@@ -0,0 +1,121 @@
+package amqp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueArguments_user_arguments_take_precedence(t *testing.T) {
+	config := NewDurableQueueConfig("amqp://")
+	config.Queue.DeadLetterExchange = "dlx"
+	config.Queue.SingleActiveConsumer = true
+	config.Queue.Arguments = amqp.Table{
+		"x-max-length":             int64(100),
+		"x-single-active-consumer": false,
+	}
+
+	assert.Equal(t, amqp.Table{
+		"x-dead-letter-exchange":   "dlx",
+		"x-max-length":             int64(100),
+		"x-single-active-consumer": false,
+	}, queueArguments(config))
+
+	// user arguments are not modified
+	assert.Equal(t, amqp.Table{
+		"x-max-length":             int64(100),
+		"x-single-active-consumer": false,
+	}, config.Queue.Arguments)
+}
+
+func TestQueueArguments_max_length(t *testing.T) {
+	config := NewDurableQueueConfig("amqp://")
+	config.Queue.MaxLength = 100
+	config.Queue.MaxLengthBytes = 1024
+	config.Queue.Overflow = QueueOverflowRejectPublish
+
+	assert.Equal(t, amqp.Table{
+		"x-max-length":       int64(100),
+		"x-max-length-bytes": int64(1024),
+		"x-overflow":         "reject-publish",
+	}, queueArguments(config))
+}
+
+func TestExchangeArguments(t *testing.T) {
+	config := NewDurablePubSubConfig("amqp://", nil)
+	config.Exchange.Arguments = amqp.Table{"alternate-exchange": "unrouted"}
+	assert.Equal(t, amqp.Table{"alternate-exchange": "unrouted"}, exchangeArguments(config))
+
+	config.Exchange.Type = "x-delayed-message"
+	assert.Equal(t, amqp.Table{
+		"alternate-exchange": "unrouted",
+		"x-delayed-type":     "direct",
+	}, exchangeArguments(config))
+
+	config.Exchange.Arguments = amqp.Table{"x-delayed-type": "topic"}
+	assert.Equal(t, amqp.Table{"x-delayed-type": "topic"}, exchangeArguments(config))
+
+	config.Exchange.Type = DeduplicationExchangeType
+	config.Exchange.Arguments = nil
+	config.Exchange.DeduplicationCacheSize = 1000
+	config.Exchange.DeduplicationCacheTTL = time.Minute
+	assert.Equal(t, amqp.Table{
+		"x-cache-size": int64(1000),
+		"x-cache-ttl":  int64(60000),
+	}, exchangeArguments(config))
+}
+
+type declaringChannel struct {
+	AMQPChannel
+
+	calls []string
+}
+
+func (c *declaringChannel) ExchangeDeclare(
+	name, kind string,
+	durable, autoDelete, internal, noWait bool,
+	args amqp.Table,
+) error {
+	c.calls = append(c.calls, fmt.Sprintf(
+		"declare %s %s durable=%t autoDelete=%t internal=%t noWait=%t",
+		name, kind, durable, autoDelete, internal, noWait,
+	))
+	return nil
+}
+
+func (c *declaringChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	c.calls = append(c.calls, fmt.Sprintf("bind %s to %s key=%s", name, exchange, key))
+	return nil
+}
+
+func TestDefaultTopologyBuilder_bindExtraExchanges(t *testing.T) {
+	config := NewDurablePubSubConfig("amqp://", GenerateQueueNameTopicNameWithSuffix("test"))
+	config.Exchange.NoWait = true
+	config.QueueBind.ExtraBindings = []ExchangeBinding{
+		{
+			Exchange:            "billing",
+			ExchangeType:        amqp.ExchangeTopic,
+			ExchangeAutoDeleted: true,
+			ExchangeInternal:    true,
+			RoutingKey:          "invoice.*",
+		},
+		// not declared, it's owned by other service
+		{Exchange: "shipping", RoutingKey: "parcel"},
+	}
+
+	channel := &declaringChannel{}
+	err := (&DefaultTopologyBuilder{}).bindExtraExchanges(channel, "queue", config, watermill.NopLogger{})
+	require.NoError(t, err)
+
+	// flags of the topic's exchange are not used for extra exchanges
+	assert.Equal(t, []string{
+		"declare billing topic durable=false autoDelete=true internal=true noWait=false",
+		"bind queue to billing key=invoice.*",
+		"bind queue to shipping key=parcel",
+	}, channel.calls)
+}